@@ -0,0 +1,285 @@
+package awsnet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Net blocks for networks and zones can be given outright ("10.0.1.0/24"), or just by size ("/24"), or not at all,
+// in which case the next free block of that (or the default) size is allocated. Networks are allocated from
+// NetworkPool, and must not overlap any other network in the environment, since the admin network routes to all of
+// them. Zones are allocated from their network's block, and must not overlap each other.
+
+// NetworkPool is where networks are allocated from when they are not given a net block.
+const NetworkPool = "10.0.0.0/8"
+
+// DefaultNetworkPrefix is the size of the networks allocated when no size is given.
+const DefaultNetworkPrefix = 24
+
+// DefaultZoneSplit is how many bits longer than its network's prefix an allocated zone's is when no size is given,
+// i.e. a /24 network has room for sixteen /28 zones.
+const DefaultZoneSplit = 4
+
+// AWS only allows VPC and subnet blocks of these sizes.
+const minPrefix = 16
+const maxPrefix = 28
+
+// parseBlock parses an IPv4 net block, which must start at its network address.
+func parseBlock(cidr string) (*net.IPNet, error) {
+	ip, block, err := net.ParseCIDR(cidr)
+	if err != nil || ip.To4() == nil {
+		return nil, fmt.Errorf("Bad net block: %s", cidr)
+	}
+	if !ip.Equal(block.IP) {
+		return nil, fmt.Errorf("Bad net block: %s (did you mean %s?)", cidr, block)
+	}
+	return block, nil
+}
+
+// parsePrefix parses a net block size, like "/24".
+func parsePrefix(size string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimPrefix(size, "/"))
+	if err != nil || n < minPrefix || n > maxPrefix {
+		return 0, fmt.Errorf("Bad net block size: %s (must be /%d to /%d)", size, minPrefix, maxPrefix)
+	}
+	return n, nil
+}
+
+func usedBlocks(cidrs []string) []*net.IPNet {
+	used := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if _, block, err := net.ParseCIDR(cidr); err == nil {
+			used = append(used, block)
+		}
+	}
+	return used
+}
+
+func overlaps(a *net.IPNet, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+func within(inner *net.IPNet, outer *net.IPNet) bool {
+	innerOnes, _ := inner.Mask.Size()
+	outerOnes, _ := outer.Mask.Size()
+	return outer.Contains(inner.IP) && innerOnes >= outerOnes
+}
+
+// nextFreeBlock returns the lowest block of the given prefix length within the container that overlaps none of the
+// used ones.
+func nextFreeBlock(container *net.IPNet, used []*net.IPNet, prefixLen int) (*net.IPNet, error) {
+	ones, bits := container.Mask.Size()
+	if prefixLen < ones {
+		return nil, fmt.Errorf("A /%d block does not fit in %s", prefixLen, container)
+	}
+	start := binary.BigEndian.Uint32(container.IP.To4())
+	size := uint64(1) << uint(bits-prefixLen)
+	end := uint64(start) + uint64(1)<<uint(bits-ones)
+	mask := net.CIDRMask(prefixLen, bits)
+	for addr := uint64(start); addr < end; addr += size {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, uint32(addr))
+		candidate := &net.IPNet{IP: ip, Mask: mask}
+		free := true
+		for _, u := range used {
+			if overlaps(candidate, u) {
+				free = false
+				if u.Contains(ip) {
+					//skip to the end of the used block rather than stepping through it
+					uOnes, _ := u.Mask.Size()
+					if uOnes < prefixLen {
+						uEnd := uint64(binary.BigEndian.Uint32(u.IP.To4())) + uint64(1)<<uint(bits-uOnes)
+						addr = uEnd - size
+					}
+				}
+				break
+			}
+		}
+		if free {
+			return candidate, nil
+		}
+	}
+	return nil, fmt.Errorf("No free /%d block left in %s", prefixLen, container)
+}
+
+// planBlock checks the requested block against the container and the used ones, or allocates one of the requested
+// size (or the default one) when only a size (or nothing) is given.
+func planBlock(requested string, container *net.IPNet, used []*net.IPNet, defaultPrefix int, what string) (string, error) {
+	if requested == "" || strings.HasPrefix(requested, "/") {
+		prefixLen := defaultPrefix
+		if requested != "" {
+			n, err := parsePrefix(requested)
+			if err != nil {
+				return "", err
+			}
+			prefixLen = n
+		}
+		block, err := nextFreeBlock(container, used, prefixLen)
+		if err != nil {
+			return "", fmt.Errorf("Cannot allocate a block for the %s: %v", what, err)
+		}
+		return block.String(), nil
+	}
+	block, err := parseBlock(requested)
+	if err != nil {
+		return "", err
+	}
+	if _, err := parsePrefix(strings.SplitN(requested, "/", 2)[1]); err != nil {
+		return "", err
+	}
+	if container != nil && !within(block, container) {
+		return "", fmt.Errorf("The %s block %s is not within %s", what, requested, container)
+	}
+	for _, u := range used {
+		if overlaps(block, u) {
+			return "", fmt.Errorf("The %s block %s overlaps %s", what, requested, u)
+		}
+	}
+	return requested, nil
+}
+
+// PlanNetworkBlock returns the net block a new network would get: the one requested, if it overlaps no other network
+// in the environment, or else the next free one of the requested size ("/20"), or of DefaultNetworkPrefix when
+// nothing is requested.
+func (cloud *Cloud) PlanNetworkBlock(requested string) (string, error) {
+	res, err := cloud.ec2.DescribeVpcs(&ec2.DescribeVpcsInput{Filters: []*ec2.Filter{filter("tag:Env", cloud.Name)}})
+	if err != nil {
+		return "", err
+	}
+	cidrs := make([]string, 0, len(res.Vpcs))
+	for _, vpc := range res.Vpcs {
+		cidrs = append(cidrs, aws.StringValue(vpc.CidrBlock))
+	}
+	if cloud.RemoteAdmin != nil { //it is routed to all the same
+		cidrs = append(cidrs, cloud.RemoteAdmin.NetBlock)
+	}
+	used := usedBlocks(cidrs)
+	var pool *net.IPNet
+	if requested == "" || strings.HasPrefix(requested, "/") {
+		_, pool, _ = net.ParseCIDR(NetworkPool)
+	}
+	return planBlock(requested, pool, used, DefaultNetworkPrefix, "network")
+}
+
+// PlanZoneBlock returns the net block a new zone in the network would get: the one requested, if it is within the
+// network and overlaps none of its other zones, or else the next free one of the requested size ("/26"), or
+// DefaultZoneSplit bits smaller than the network when nothing is requested.
+func (net *Network) PlanZoneBlock(requested string) (string, error) {
+	container, err := parseBlock(net.AddressBlock)
+	if err != nil {
+		return "", err
+	}
+	res, err := net.Cloud.ec2.DescribeSubnets(&ec2.DescribeSubnetsInput{Filters: []*ec2.Filter{filter("vpc-id", net.Id)}})
+	if err != nil {
+		return "", err
+	}
+	cidrs := make([]string, 0, len(res.Subnets))
+	for _, sn := range res.Subnets {
+		cidrs = append(cidrs, aws.StringValue(sn.CidrBlock))
+	}
+	used := usedBlocks(cidrs)
+	ones, _ := container.Mask.Size()
+	return planBlock(requested, container, used, defaultZonePrefix(ones), "zone")
+}
+
+func defaultZonePrefix(networkPrefix int) int {
+	if networkPrefix+DefaultZoneSplit > maxPrefix {
+		return maxPrefix
+	}
+	return networkPrefix + DefaultZoneSplit
+}
+
+// splitBits is how many bits longer the prefix of each of count equal parts of a block is.
+func splitBits(count int) int {
+	n := 0
+	for 1<<uint(n) < count {
+		n++
+	}
+	return n
+}
+
+// spreadZoneSize returns the size of a zone spread across count availability zones, with room for a subnet of the
+// default zone size in each.
+func (net *Network) spreadZoneSize(count int) (string, error) {
+	container, err := parseBlock(net.AddressBlock)
+	if err != nil {
+		return "", err
+	}
+	ones, _ := container.Mask.Size()
+	prefixLen := defaultZonePrefix(ones) - splitBits(count)
+	if prefixLen < ones {
+		prefixLen = ones
+	}
+	return fmt.Sprintf("/%d", prefixLen), nil
+}
+
+// splitBlock carves the block into count equal parts, the first count of the smallest power of two that is enough.
+func splitBlock(cidr string, count int) ([]string, error) {
+	block, err := parseBlock(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := block.Mask.Size()
+	prefixLen := ones + splitBits(count)
+	if prefixLen > maxPrefix {
+		return nil, fmt.Errorf("Cannot split %s into %d subnets of /%d or larger", cidr, count, maxPrefix)
+	}
+	start := binary.BigEndian.Uint32(block.IP.To4())
+	size := uint32(1) << uint(bits-prefixLen)
+	lst := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, start+uint32(i)*size)
+		lst = append(lst, fmt.Sprintf("%s/%d", ip, prefixLen))
+	}
+	return lst, nil
+}
+
+// spanBlock returns the smallest block that contains all of the given ones, i.e. the block splitBlock carved them from.
+func spanBlock(cidrs []string) (string, error) {
+	var first, last uint32
+	prefixLen := 32
+	for i, cidr := range cidrs {
+		block, err := parseBlock(cidr)
+		if err != nil {
+			return "", err
+		}
+		ones, bits := block.Mask.Size()
+		start := binary.BigEndian.Uint32(block.IP.To4())
+		end := start + (uint32(1) << uint(bits-ones)) - 1
+		if i == 0 || start < first {
+			first = start
+		}
+		if i == 0 || end > last {
+			last = end
+		}
+		if ones < prefixLen {
+			prefixLen = ones
+		}
+	}
+	for prefixLen > 0 && first>>uint(32-prefixLen) != last>>uint(32-prefixLen) {
+		prefixLen--
+	}
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, first&^((uint32(1)<<uint(32-prefixLen))-1))
+	return fmt.Sprintf("%s/%d", ip, prefixLen), nil
+}
+
+// WholeBlock returns the net block the zone was created with: for a zone spread across availability zones, the one
+// its subnets were carved from, otherwise the block of its only subnet.
+func (zone *Zone) WholeBlock() string {
+	blocks := make([]string, 0, len(zone.Subnets))
+	for _, sn := range zone.Subnets {
+		blocks = append(blocks, sn.AddressBlock)
+	}
+	block, err := spanBlock(blocks)
+	if err != nil {
+		return zone.AddressBlock
+	}
+	return block
+}
@@ -0,0 +1,131 @@
+package awsnet
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPlanNetworkBlock(t *testing.T) {
+	cloud, _ := newTestCloud(t)
+	err := cloud.Setup("0.0.0.0/0", AdminNetBlock, BastionNetBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cloud.CreateNetwork("a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ requested, want, fails string }{
+		{"", "10.0.1.0/24", ""},
+		{"/20", "10.0.16.0/20", ""},
+		{"10.0.2.0/24", "10.0.2.0/24", ""},
+		{"10.0.0.0/16", "", "overlaps 10.0.0.0/24"},
+		{"10.255.0.0/16", "", "overlaps 10.255.255.0/24"},
+		{"10.0.2.5/24", "", "did you mean 10.0.2.0/24"},
+		{"/8", "", "must be /16 to /28"},
+	} {
+		block, err := cloud.PlanNetworkBlock(c.requested)
+		switch {
+		case c.fails != "" && (err == nil || !strings.Contains(err.Error(), c.fails)):
+			t.Errorf("PlanNetworkBlock(%q): expected an error with %q, got %v", c.requested, c.fails, err)
+		case c.fails == "" && (err != nil || block != c.want):
+			t.Errorf("PlanNetworkBlock(%q): expected %s, got %s (%v)", c.requested, c.want, block, err)
+		}
+	}
+}
+
+func TestPlanNetworkBlockRemoteAdmin(t *testing.T) {
+	cloud, _ := newTestCloud(t)
+	cloud.RemoteAdmin = &RemoteAdmin{NetBlock: "10.0.0.0/24"}
+	block, err := cloud.PlanNetworkBlock("")
+	if err != nil || block != "10.0.1.0/24" {
+		t.Fatalf("Expected the remote admin network's block to be skipped, got %s (%v)", block, err)
+	}
+}
+
+func TestPlanZoneBlock(t *testing.T) {
+	cloud, _ := newTestCloud(t)
+	err := cloud.Setup("0.0.0.0/0", AdminNetBlock, BastionNetBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	net, err := cloud.CreateNetwork("a", "10.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = net.CreateZone("first", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ requested, want, fails string }{
+		{"", "10.0.0.16/28", ""},
+		{"/26", "10.0.0.64/26", ""},
+		{"10.0.0.0/28", "", "overlaps 10.0.0.0/28"},
+		{"10.0.1.0/28", "", "is not within 10.0.0.0/24"},
+		{"/29", "", "must be /16 to /28"},
+	} {
+		block, err := net.PlanZoneBlock(c.requested)
+		switch {
+		case c.fails != "" && (err == nil || !strings.Contains(err.Error(), c.fails)):
+			t.Errorf("PlanZoneBlock(%q): expected an error with %q, got %v", c.requested, c.fails, err)
+		case c.fails == "" && (err != nil || block != c.want):
+			t.Errorf("PlanZoneBlock(%q): expected %s, got %s (%v)", c.requested, c.want, block, err)
+		}
+	}
+}
+
+func TestNextFreeBlock(t *testing.T) {
+	container, _ := parseBlock("10.0.0.0/16")
+	for _, c := range []struct {
+		used      []string
+		prefixLen int
+		want      string
+	}{
+		{nil, 24, "10.0.0.0/24"},
+		{[]string{"10.0.0.0/24"}, 24, "10.0.1.0/24"},
+		{[]string{"10.0.0.0/24", "10.0.2.0/24"}, 24, "10.0.1.0/24"},
+		{[]string{"10.0.0.0/24"}, 20, "10.0.16.0/20"},
+		{[]string{"10.0.0.0/17"}, 24, "10.0.128.0/24"},
+		{[]string{"10.0.0.0/28"}, 28, "10.0.0.16/28"},
+		{[]string{"10.1.0.0/16"}, 24, "10.0.0.0/24"},
+	} {
+		block, err := nextFreeBlock(container, usedBlocks(c.used), c.prefixLen)
+		if err != nil || block.String() != c.want {
+			t.Errorf("nextFreeBlock(/%d) with %v used: expected %s, got %v (%v)", c.prefixLen, c.used, c.want, block, err)
+		}
+	}
+	_, err := nextFreeBlock(container, usedBlocks([]string{"10.0.0.0/16"}), 24)
+	if err == nil {
+		t.Error("Expected no free block in a used container")
+	}
+	_, err = nextFreeBlock(container, nil, 12)
+	if err == nil {
+		t.Error("Expected a /12 not to fit in a /16")
+	}
+}
+
+func TestSplitBlock(t *testing.T) {
+	for _, c := range []struct {
+		cidr  string
+		count int
+		want  string
+	}{
+		{"10.0.0.0/24", 1, "10.0.0.0/24"},
+		{"10.0.0.0/24", 2, "10.0.0.0/25 10.0.0.128/25"},
+		{"10.0.0.0/24", 3, "10.0.0.0/26 10.0.0.64/26 10.0.0.128/26"},
+		{"10.0.0.0/26", 4, "10.0.0.0/28 10.0.0.16/28 10.0.0.32/28 10.0.0.48/28"},
+	} {
+		lst, err := splitBlock(c.cidr, c.count)
+		if err != nil || strings.Join(lst, " ") != c.want {
+			t.Errorf("splitBlock(%s, %d): expected %s, got %v (%v)", c.cidr, c.count, c.want, lst, err)
+		}
+		block, err := spanBlock(lst)
+		if err != nil || block != c.cidr {
+			t.Errorf("spanBlock(%v): expected %s, got %s (%v)", lst, c.cidr, block, err)
+		}
+	}
+	_, err := splitBlock("10.0.0.0/27", 3)
+	if err == nil {
+		t.Error("Expected a /27 not to split into 3 blocks of /28 or larger")
+	}
+}
@@ -0,0 +1,1732 @@
+// Package awsnet manages environments of AWS VPCs (Networks), their subnets (Zones) and instances (Machines). Each
+// environment has an 'admin' Network with a jumphost, which is peered with every other Network in the environment.
+package awsnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Quiet suppresses progress messages.
+var Quiet = false
+
+func pretty(obj interface{}) string {
+	b, _ := json.MarshalIndent(obj, "", "   ")
+	return string(b)
+}
+
+type Cloud struct {
+	Name         string
+	Offline      bool         //skip polling delays and remote readiness checks, i.e. when running against a FakeEC2
+	DryRun       bool         //destructive operations only record what they would remove, in Removals
+	Removals     []*Removal   //what a dry run would have removed, in order
+	SweepOrphans bool         //Cleanup also releases unassociated EIPs that are not tagged for any environment
+	User         string       //the SSH login user for every machine, overriding their User tags and ImageUsers
+	Image        string       //the image to launch the jumphost with, empty for BuiltinSettings.Image
+	Type         string       //the instance type to launch the jumphost with, empty for BuiltinSettings.Type
+	Key          string       //the keypair to launch the jumphost with, empty for DefaultKeyName
+	KeepPartial  bool         //a failed operation leaves what it created for Rollback, rather than removing it
+	RemoteAdmin  *RemoteAdmin //the admin network, when it is in another AWS account, nil when it is in this one
+	ec2          EC2API
+	journal      *Journal //of the operation in progress, if any
+}
+
+// a Removal is a resource that a dry run of a destructive operation would have deleted, terminated or released.
+type Removal struct {
+	Kind string
+	Id   string
+	Name string
+}
+
+func (r *Removal) String() string {
+	if r.Name == "" {
+		return fmt.Sprintf("%s %s", r.Kind, r.Id)
+	}
+	return fmt.Sprintf("%s %s (%s)", r.Kind, r.Id, r.Name)
+}
+
+func (cloud *Cloud) wouldRemove(kind string, id string, name string) {
+	cloud.Removals = append(cloud.Removals, &Removal{Kind: kind, Id: id, Name: name})
+}
+
+// wouldTerminate reports whether a dry run has already recorded the instance for termination.
+func (cloud *Cloud) wouldTerminate(instId string) bool {
+	for _, r := range cloud.Removals {
+		if r.Kind == "instance" && r.Id == instId {
+			return true
+		}
+	}
+	return false
+}
+
+// a Network represents an AWS VPC (Virtual Private Cloud), containing multiple subnets
+type Network struct {
+	Cloud        *Cloud `json:"-"`
+	Name         string
+	Id           string
+	AddressBlock string
+	vpc          *ec2.Vpc
+}
+
+func (cloud *Cloud) newNetwork(vpc *ec2.Vpc) *Network {
+	net := &Network{vpc: vpc}
+	net.Cloud = cloud
+	net.Name = findTag(vpc.Tags, "Name")
+	net.Id = *net.vpc.VpcId
+	net.AddressBlock = *net.vpc.CidrBlock
+	return net
+}
+
+func (net *Network) String() string {
+	return pretty(net)
+}
+
+// shortName is the network's name within its environment, i.e. "myapp" for "dev.myapp".
+func (net *Network) shortName() string {
+	return strings.TrimPrefix(net.Name, net.Cloud.Name+".")
+}
+
+// a Zone is a subnet/security group in a specific network. A zone spread across availability zones has a subnet in
+// each, all with the zone's name; Id, AddressBlock and AvailabilityZone are those of the first.
+type Zone struct {
+	Network          *Network
+	Name             string
+	Id               string
+	AddressBlock     string
+	AvailabilityZone string
+	Private          bool //its outbound internet traffic goes through the network's NAT gateway
+	Subnets          []*Subnet
+	subnets          []*ec2.Subnet
+}
+
+// a Subnet is one of a zone's subnets, in one availability zone.
+type Subnet struct {
+	Id               string
+	AddressBlock     string
+	AvailabilityZone string
+}
+
+func (zone *Zone) String() string {
+	return pretty(zone)
+}
+
+// a Machine is a convenience wrapper for a (virtual) machine instance
+type Machine struct {
+	Cloud       *Cloud
+	Name        string
+	Network     string
+	Zone        string
+	User        string //the login user for SSH
+	ec2Instance *ec2.Instance
+}
+
+func (machine *Machine) Id() string {
+	return *machine.ec2Instance.InstanceId
+}
+
+func (machine *Machine) PublicIp() string {
+	tmp := machine.ec2Instance.PublicIpAddress
+	if tmp == nil {
+		return ""
+	}
+	return *tmp
+}
+
+func (machine *Machine) PrivateIp() string {
+	tmp := machine.ec2Instance.PrivateIpAddress
+	if tmp == nil {
+		return ""
+	}
+	return *tmp
+}
+
+func (machine *Machine) String() string {
+	s := "{"
+	s += "\"id\": \""
+	s += *machine.ec2Instance.InstanceId
+	s += "\", "
+
+	s += "\"name\": \""
+	s += machine.Name
+	s += "\", "
+
+	s += "\"net\": \""
+	s += machine.Cloud.Name + "." + machine.Network
+	s += "\", "
+	if machine.ec2Instance.PublicIpAddress != nil {
+		s += "\"public-ip\": \""
+		s += *machine.ec2Instance.PublicIpAddress
+		s += "\", "
+	}
+	s += "\"private-ip\": \""
+	s += *machine.ec2Instance.PrivateIpAddress
+	s += "\"}"
+	return s
+}
+
+// create a wrapper for the remote named cloud, which may or may not currently exist.
+func NamedCloud(name string) *Cloud {
+	return NewCloud(name, ec2.New(session.New()))
+}
+
+// create a wrapper for the named cloud that talks to the given EC2 implementation.
+func NewCloud(name string, api EC2API) *Cloud {
+	return &Cloud{Name: name, ec2: api}
+}
+
+// pause between polls of a resource that is changing state. There is nothing to wait for when offline.
+func (cloud *Cloud) pause(delayInSeconds float64) {
+	if !cloud.Offline {
+		dur := time.Duration(delayInSeconds * float64(time.Second))
+		time.Sleep(dur)
+	}
+}
+
+const AdminNetName = "admin"
+
+// the default net blocks of the admin network and of its bastion zone, which Setup can be given others instead of.
+const AdminNetBlock = "10.255.255.0/24"
+const BastionNetBlock = "10.255.255.0/28"
+
+// checkAdminBlocks makes sure the admin and bastion blocks are CIDRs, and that the bastion zone fits in the admin
+// network.
+func checkAdminBlocks(adminNetBlock string, bastionNetBlock string) error {
+	_, admin, err := net.ParseCIDR(adminNetBlock)
+	if err != nil {
+		return fmt.Errorf("Bad admin net block: %s", adminNetBlock)
+	}
+	bastionIp, bastion, err := net.ParseCIDR(bastionNetBlock)
+	if err != nil {
+		return fmt.Errorf("Bad bastion net block: %s", bastionNetBlock)
+	}
+	adminOnes, _ := admin.Mask.Size()
+	bastionOnes, _ := bastion.Mask.Size()
+	if !admin.Contains(bastionIp) || bastionOnes < adminOnes {
+		return fmt.Errorf("The bastion net block %s is not within the admin net block %s", bastionNetBlock, adminNetBlock)
+	}
+	return nil
+}
+
+// adminBlocks returns the net blocks the admin VPC was set up with. Those set up before they were recorded have the
+// whole admin network stand in for the bastion zone.
+func adminBlocks(adminVpc *ec2.Vpc) (string, string) {
+	adminNetBlock := findTag(adminVpc.Tags, "AdminNetBlock")
+	if adminNetBlock == "" {
+		adminNetBlock = aws.StringValue(adminVpc.CidrBlock)
+	}
+	bastionNetBlock := findTag(adminVpc.Tags, "BastionNetBlock")
+	if bastionNetBlock == "" {
+		bastionNetBlock = adminNetBlock
+	}
+	return adminNetBlock, bastionNetBlock
+}
+
+func (cloud *Cloud) createNetwork(name string, cidr string) (*Network, error) {
+	fullName := cloud.Name + "." + name
+	if !Quiet {
+		fmt.Printf("Creating network '%s' - %s\n", fullName, cidr)
+	}
+	vpcOut, err := cloud.ec2.CreateVpc(&ec2.CreateVpcInput{
+		CidrBlock:       aws.String(cidr),
+		InstanceTenancy: aws.String("default"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	vpc := vpcOut.Vpc
+	vpcId := *vpc.VpcId
+	cloud.record("vpc", vpcId, "", fullName) //removed again by the journal, should anything below fail
+	_, err = cloud.ec2.CreateTags(&ec2.CreateTagsInput{
+		Resources: []*string{aws.String(vpcId)},
+		Tags: []*ec2.Tag{
+			&ec2.Tag{Key: aws.String("Name"), Value: aws.String(fullName)},
+			&ec2.Tag{Key: aws.String("Env"), Value: aws.String(cloud.Name)},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if *vpc.State != "available" {
+		if *vpc.State != "pending" {
+			if !Quiet {
+				fmt.Println("cannot wait, VPC status is: ", *vpc.State)
+			}
+			return nil, fmt.Errorf("Cannot wait for vpc with state of %v", *vpc.State)
+		}
+		for vpc != nil && *vpc.State == "pending" {
+			cloud.pause(2.0)
+			vpc, err = cloud.findVpc(name)
+			if err != nil {
+				return nil, err
+			}
+			if vpc == nil {
+				return nil, fmt.Errorf("Cannot wait: vpc '%s' disappeared", vpcId)
+			}
+		}
+	}
+	return cloud.newNetwork(vpc), nil
+}
+
+// Setup creates the admin network with the given net block, and its jumphost in a bastion zone with the given
+// block within it, reachable by SSH from the controlling net block. Both blocks are recorded as tags on the admin
+// VPC, for the app networks to be peered with later. Setup converges: whatever part of the admin network already
+// exists (as found by its tags) is kept, and only the missing parts are created, so a setup that failed partway can
+// just be run again.
+func (cloud *Cloud) Setup(ctrlNetBlock string, adminNetBlock string, bastionNetBlock string) error {
+	return cloud.journaled("setup", func() error {
+		return cloud.setup(ctrlNetBlock, adminNetBlock, bastionNetBlock)
+	})
+}
+
+func (cloud *Cloud) setup(ctrlNetBlock string, adminNetBlock string, bastionNetBlock string) error {
+	err := checkAdminBlocks(adminNetBlock, bastionNetBlock)
+	if err != nil {
+		return err
+	}
+	vpc, err := cloud.findVpc(AdminNetName)
+	if err != nil {
+		return err
+	}
+	var adminNet *Network
+	if vpc != nil {
+		adminNet = cloud.newNetwork(vpc)
+		if adminNet.AddressBlock != adminNetBlock {
+			return fmt.Errorf("The admin network of %s is already set up with %s, not %s", cloud.Name, adminNet.AddressBlock, adminNetBlock)
+		}
+		recorded := findTag(vpc.Tags, "BastionNetBlock")
+		if recorded == "" {
+			//set up before the blocks were recorded, the bastion zone has whatever block it was created with
+			bastionZone, err := cloud.GetZone(adminNet.Name + ".bastion")
+			if err != nil {
+				return err
+			}
+			if bastionZone != nil {
+				recorded = bastionZone.AddressBlock
+			}
+		}
+		if recorded != "" && recorded != bastionNetBlock {
+			return fmt.Errorf("The bastion zone of %s is already set up with %s, not %s", cloud.Name, recorded, bastionNetBlock)
+		}
+		if !Quiet {
+			fmt.Printf("Found VPC '%s' (%s) - %s\n", adminNet.Name, adminNet.Id, adminNet.AddressBlock)
+		}
+	} else {
+		adminNet, err = cloud.createNetwork(AdminNetName, adminNetBlock)
+		if err != nil {
+			return err
+		}
+		if !Quiet {
+			fmt.Printf("Created VPC '%s' (%s) - %s\n", adminNet.Name, *adminNet.vpc.VpcId, *adminNet.vpc.CidrBlock)
+		}
+	}
+	_, err = cloud.ec2.CreateTags(&ec2.CreateTagsInput{
+		Resources: []*string{adminNet.vpc.VpcId},
+		Tags: []*ec2.Tag{
+			&ec2.Tag{Key: aws.String("AdminNetBlock"), Value: aws.String(adminNetBlock)},
+			&ec2.Tag{Key: aws.String("BastionNetBlock"), Value: aws.String(bastionNetBlock)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	err = cloud.initAdminNetwork(adminNet, ctrlNetBlock, bastionNetBlock)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (cloud *Cloud) Status() error {
+	vpcAdmin, err := cloud.findVpc(AdminNetName)
+	if err == nil && vpcAdmin != nil {
+		fmt.Printf("Status of %s:\n", cloud.Name)
+		lst, err := cloud.ListNetworks()
+		if err != nil {
+			return err
+		}
+		for _, net := range lst {
+			fmt.Printf("  network %s (%s) - %s:\n", net.Name, *net.vpc.VpcId, *net.vpc.CidrBlock)
+			lstZones, err := net.ListZones()
+			if err != nil {
+				return err
+			}
+			for _, zone := range lstZones {
+				access := ""
+				if zone.Private {
+					access = " (private)"
+				}
+				for _, sn := range zone.Subnets {
+					fmt.Printf("    zone %s (%s) - %s in %s%s\n", zone.Name, sn.Id, sn.AddressBlock, sn.AvailabilityZone, access)
+				}
+				rtId, routes, err := zone.Routes()
+				if err != nil {
+					return err
+				}
+				for _, route := range routes {
+					fmt.Printf("      route %s via %s\n", route, rtId)
+				}
+			}
+			peerings, err := net.Peerings()
+			if err != nil {
+				return err
+			}
+			for _, p := range peerings {
+				fmt.Printf("    peering %s\n", p)
+			}
+			lst, err := cloud.ListMachines()
+			if err != nil {
+				return err
+			}
+			for _, machine := range lst {
+				if machine.Network == net.Name {
+					pub := machine.PublicIp()
+					if pub == "" {
+						pub = "(no public ip)"
+					}
+					fmt.Printf("    machine %s (%s) - %s/%s\n", machine.Name, machine.Id(), machine.PrivateIp(), pub)
+				}
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("Cloud not set up: %s", cloud.Name)
+}
+
+func (net *Network) createSecurityGroup(name string, descr string) (*string, error) {
+	vpc := net.vpc
+	vpcId := vpc.VpcId
+	sgName := net.Name + "." + name
+	sg, err := net.Cloud.ec2.CreateSecurityGroup(&ec2.CreateSecurityGroupInput{
+		Description: aws.String(descr),
+		GroupName:   aws.String(sgName),
+		VpcId:       vpcId,
+	})
+	if err != nil {
+		return nil, err
+	}
+	net.Cloud.record("security-group", *sg.GroupId, "", sgName)
+	_, err = net.Cloud.ec2.CreateTags(&ec2.CreateTagsInput{Resources: []*string{sg.GroupId}, Tags: net.tags(sgName)})
+	if err != nil {
+		return nil, err
+	}
+	return sg.GroupId, nil
+}
+
+// initAdminNetwork brings the admin network's bastion security group, bastion zone, internet gateway, default route,
+// jumphost and the jumphost's EIP into being, keeping those that already exist.
+func (cloud *Cloud) initAdminNetwork(net *Network, ctrlNetBlock string, bastionNetBlock string) error {
+	sgBastionId, err := net.findSecurityGroup("bastion")
+	if err != nil {
+		return err
+	}
+	if sgBastionId == nil {
+		sgBastionId, err = net.createSecurityGroup("bastion", "Bastion security group for "+net.Name)
+		if err != nil {
+			return err
+		}
+		if !Quiet {
+			fmt.Println("Created 'bastion' security group for " + cloud.Name + "." + net.Name)
+		}
+	} else if !Quiet {
+		fmt.Printf("Found 'bastion' security group (%s)\n", *sgBastionId)
+	}
+
+	err = cloud.authorizeInboundAddress(sgBastionId, ctrlNetBlock, "tcp", 22)
+	if err != nil && !strings.Contains(err.Error(), "InvalidPermission.Duplicate") {
+		return err
+	}
+	if !Quiet {
+		fmt.Println("Authorized inbound traffic for tcp/22 from " + ctrlNetBlock + " to the bastion security group")
+	}
+
+	if false {
+		//to do: figure out the vpc peering, that is what we want to restrict, not this
+		err = cloud.revokeOutboundDefault(sgBastionId) //this means it cannot even access AWS itself, or internet anything
+		if err != nil {
+			return nil
+		}
+		if !Quiet {
+			fmt.Println("Revoked default outbound rule from bastion security group")
+		}
+	}
+
+	bastionZone, err := cloud.GetZone(net.Name + ".bastion")
+	if err != nil {
+		return err
+	}
+	if bastionZone == nil {
+		bastionZone, err = net.CreateZone("bastion", bastionNetBlock)
+		if err != nil {
+			return err
+		}
+		if !Quiet {
+			fmt.Printf("Created zone: %v\n", bastionZone)
+		}
+	} else {
+		_, err = bastionZone.ensureRouteTable()
+		if err != nil {
+			return err
+		}
+		if !Quiet {
+			fmt.Printf("Found zone '%s' (%s) - %s\n", bastionZone.Name, bastionZone.Id, bastionZone.AddressBlock)
+		}
+	}
+
+	gwId, err := net.ensureInternetGateway()
+	if err != nil {
+		return err
+	}
+	err = net.addRoute("0.0.0.0/0", *gwId)
+	if err != nil {
+		return err
+	}
+	if !Quiet {
+		fmt.Println("Default route goes to internet gateway", *gwId)
+	}
+
+	//launch the jumphost
+	keyName := DefaultKeyName
+	if cloud.Key != "" {
+		keyName = cloud.Key
+	}
+	instance, err := net.findJumphost()
+	if err != nil {
+		return err
+	}
+	if instance == nil {
+		if !Quiet {
+			fmt.Println("Launching jumphost...")
+		}
+		instanceImage := BuiltinSettings.Image
+		if cloud.Image != "" {
+			instanceImage = cloud.Image
+		}
+		instanceType := BuiltinSettings.Type
+		if cloud.Type != "" {
+			instanceType = cloud.Type
+		}
+		instance, err = cloud.launchInstance(bastionZone, "jumphost", keyName, sgBastionId, instanceImage, instanceType)
+		if err != nil {
+			return err
+		}
+		if !Quiet {
+			fmt.Printf("\nJumphost launched: %s\n", *instance.InstanceId)
+		}
+	} else {
+		if findTag(instance.Tags, "Key") != "" {
+			keyName = findTag(instance.Tags, "Key")
+		}
+		if *instance.State.Name == "stopping" {
+			err = cloud.waitForInstanceState(instance, "stopped")
+			if err != nil {
+				return err
+			}
+			instance.State.Name = aws.String("stopped")
+		}
+		if *instance.State.Name == "stopped" {
+			_, err = cloud.ec2.StartInstances(&ec2.StartInstancesInput{InstanceIds: []*string{instance.InstanceId}})
+			if err != nil {
+				return err
+			}
+		}
+		if *instance.State.Name != "running" {
+			err = cloud.waitForInstanceState(instance, "running")
+			if err != nil {
+				return err
+			}
+		}
+		if !Quiet {
+			fmt.Printf("Found jumphost: %s\n", *instance.InstanceId)
+		}
+	}
+	instanceId := *instance.InstanceId
+
+	//set up an EIP
+	eip, err := net.findAddress(net.Name + ".jumphost")
+	if err != nil {
+		return err
+	}
+	if eip == nil {
+		res, err := cloud.ec2.AllocateAddress(&ec2.AllocateAddressInput{Domain: aws.String(ec2.DomainTypeVpc)})
+		if err != nil {
+			return err
+		}
+		cloud.record("address", *res.AllocationId, "", aws.StringValue(res.PublicIp))
+		_, err = cloud.ec2.CreateTags(&ec2.CreateTagsInput{Resources: []*string{res.AllocationId}, Tags: net.tags(net.Name + ".jumphost")})
+		if err != nil {
+			return err
+		}
+		if !Quiet {
+			fmt.Println("Allocated new elastic IP: ", *res.PublicIp)
+		}
+		eip = &ec2.Address{AllocationId: res.AllocationId, PublicIp: res.PublicIp}
+	}
+
+	if aws.StringValue(eip.InstanceId) != instanceId {
+		assoc, err := cloud.ec2.AssociateAddress(&ec2.AssociateAddressInput{
+			AllocationId:       eip.AllocationId,
+			AllowReassociation: aws.Bool(true),
+			InstanceId:         instance.InstanceId,
+		})
+		if err != nil {
+			return err
+		}
+		cloud.record("address-association", aws.StringValue(assoc.AssociationId), "", aws.StringValue(eip.PublicIp))
+		if !Quiet {
+			i, _ := cloud.getInstance(instanceId)
+			fmt.Println("Associated Elastic IP with the jumphost instance: ", *i.PublicIpAddress)
+		}
+	}
+	err = cloud.waitForInstance(instance, keyName)
+	if err == nil && !Quiet {
+		fmt.Println("Admin network is active")
+	}
+	return err
+}
+
+// findSecurityGroup returns the id of the network's named security group, or nil if it has none by that name.
+func (net *Network) findSecurityGroup(name string) (*string, error) {
+	res, err := net.Cloud.ec2.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{Filters: []*ec2.Filter{
+		filter("vpc-id", net.Id),
+		filter("group-name", net.Name+"."+name),
+	}})
+	if err != nil || len(res.SecurityGroups) == 0 {
+		return nil, err
+	}
+	return res.SecurityGroups[0].GroupId, nil
+}
+
+// findJumphost returns the network's jumphost, if it has one that is not on its way out.
+func (net *Network) findJumphost() (*ec2.Instance, error) {
+	lst, err := net.listInstancesIn("pending", "running", "stopping", "stopped")
+	if err != nil {
+		return nil, err
+	}
+	for _, inst := range lst {
+		if findTag(inst.Tags, "Name") == net.Name+".jumphost" {
+			return inst, nil
+		}
+	}
+	return nil, nil
+}
+
+// findAddress returns the network's EIP with the given name tag, or nil if it has none.
+func (net *Network) findAddress(name string) (*ec2.Address, error) {
+	res, err := net.Cloud.ec2.DescribeAddresses(&ec2.DescribeAddressesInput{Filters: []*ec2.Filter{
+		filter("tag:Env", net.Cloud.Name),
+		filter("tag:Name", name),
+	}})
+	if err != nil || len(res.Addresses) == 0 {
+		return nil, err
+	}
+	return res.Addresses[0], nil
+}
+
+func (cloud *Cloud) findVpc(name string) (*ec2.Vpc, error) {
+	fullName := cloud.Name + "." + name
+	req := &ec2.DescribeVpcsInput{}
+	if name != "" {
+		req.Filters = []*ec2.Filter{filter("tag:Name", fullName)}
+	}
+	res, err := cloud.ec2.DescribeVpcs(req)
+	if err != nil {
+		return nil, err
+	}
+	//should only be 1 of them
+	for _, vpc := range res.Vpcs {
+		return vpc, nil
+	}
+	return nil, nil
+}
+
+func (cloud *Cloud) FindNetwork(name string) (*Network, error) {
+	vpc, err := cloud.findVpc(name)
+	if err != nil {
+		return nil, err
+	}
+	if vpc == nil {
+		return nil, nil
+	}
+	return cloud.newNetwork(vpc), nil
+}
+
+func findTag(tags []*ec2.Tag, key string) string {
+	for _, tag := range tags {
+		if *tag.Key == key {
+			return *tag.Value
+		}
+	}
+	return ""
+}
+
+func (cloud *Cloud) ListNetworks() ([]*Network, error) {
+	res, err := cloud.ec2.DescribeVpcs(&ec2.DescribeVpcsInput{Filters: []*ec2.Filter{filter("tag:Env", cloud.Name)}})
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Vpcs) == 0 {
+		return nil, fmt.Errorf("run 'vpc setup' before using")
+	}
+	lst := make([]*Network, 0)
+	for _, vpc := range res.Vpcs {
+		lst = append(lst, cloud.newNetwork(vpc))
+	}
+	return lst, nil
+}
+
+// CreateNetwork creates the network, peered with the admin network. The net block is planned by PlanNetworkBlock, so
+// it can be given as a size ("/20"), or left empty, to be allocated.
+func (cloud *Cloud) CreateNetwork(vpcName string, cidr string) (*Network, error) {
+	var net *Network
+	err := cloud.journaled("create "+vpcName, func() error {
+		var err error
+		net, err = cloud.createAppNetwork(vpcName, cidr)
+		return err
+	})
+	return net, err
+}
+
+func (cloud *Cloud) createAppNetwork(vpcName string, cidr string) (*Network, error) {
+	vpc, err := cloud.findVpc(vpcName)
+	if err != nil {
+		return nil, err
+	}
+	if vpc != nil {
+		return nil, fmt.Errorf("Network already exists in %s: %s", cloud.Name, vpcName)
+	}
+	cidr, err = cloud.PlanNetworkBlock(cidr)
+	if err != nil {
+		return nil, err
+	}
+	net, err := cloud.createNetwork(vpcName, cidr)
+	if err != nil {
+		return nil, err
+	}
+	err = cloud.initAppNetwork(net)
+	if err != nil {
+		return nil, err
+	}
+	return net, nil
+}
+
+// DestroyNetwork terminates the network's machines, and deletes its peerings (and the admin network's routes over
+// them) and the network itself. With DryRun set, nothing is touched, and Removals lists what would have been.
+func (cloud *Cloud) DestroyNetwork(vpcName string) error {
+	vpc, err := cloud.findVpc(vpcName)
+	if err != nil {
+		return err
+	}
+	if vpc != nil {
+		net := cloud.newNetwork(vpc)
+
+		//delete all peering connections involving this vpc, and the routes over them on the other side
+		peerings, err := net.Peerings()
+		if err != nil {
+			return err
+		}
+		failed := make([]string, 0)
+		for _, p := range peerings {
+			err = net.deletePeering(p)
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %v", p.Id, err))
+			}
+		}
+		if len(failed) > 0 {
+			//the vpc cannot be deleted while a peering is left
+			return fmt.Errorf("Cannot delete the peerings of network '%s': %s", vpcName, strings.Join(failed, "; "))
+		}
+		//bring down all running instances. And wait for them to terminate (takes a while)
+		err = net.killAllInstances()
+		if err != nil {
+			return err
+		}
+		//and destroy the vpc, releasing all its resources
+		err = cloud.destroyVpc(vpc, cloud.Name)
+		if err != nil {
+			return fmt.Errorf("Failed to destroy network '%s': %v", vpcName, err)
+		}
+	}
+	return nil
+}
+
+func (cloud *Cloud) GetZone(zoneName string) (*Zone, error) {
+	lst := strings.Split(zoneName, ".")
+	if len(lst) != 3 || lst[0] != cloud.Name {
+		return nil, fmt.Errorf("Zone name must be fully specified, i.e. " + cloud.Name + ".{network}.{zone}")
+	}
+	net, err := cloud.FindNetwork(lst[1])
+	if err != nil {
+		return nil, err
+	}
+	if net == nil {
+		return nil, fmt.Errorf("No such network: %s.%s", lst[0], lst[1])
+	}
+	req := &ec2.DescribeSubnetsInput{Filters: []*ec2.Filter{filter("tag:Name", zoneName)}}
+	res, err := cloud.ec2.DescribeSubnets(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Subnets) > 0 {
+		return net.newZone(res.Subnets), nil
+	}
+	return nil, nil
+}
+
+func (cloud *Cloud) initAppNetwork(net *Network) error {
+	if cloud.RemoteAdmin != nil {
+		return cloud.requestAdminPeering(net)
+	}
+	vpc := net.vpc
+
+	adminVpc, err := cloud.findVpc(AdminNetName)
+	if err != nil {
+		return err
+	}
+	if adminVpc == nil {
+		return fmt.Errorf("Cloud not set up: %s", cloud.Name)
+	}
+	adminNetBlock, bastionNetBlock := adminBlocks(adminVpc)
+	peeringId, err := cloud.peerWithAdmin(adminVpc, net)
+	if err != nil {
+		return err
+	}
+	err = cloud.newNetwork(adminVpc).addRoute(*vpc.CidrBlock, *peeringId) //the entire app vpc, from every admin zone
+	if err != nil {
+		return err
+	}
+	err = net.addRoute(adminNetBlock, *peeringId) //the entire admin block. Hmm.
+	if err != nil {
+		return err
+	}
+
+	sg, err := net.defaultSecurityGroup()
+	if err != nil {
+		return err
+	}
+	err = cloud.authorizeInboundAddress(sg.GroupId, bastionNetBlock, "tcp", 22) //only the jumphost needs in
+	if err != nil {
+		return err
+	}
+	if !Quiet {
+		fmt.Println("Authorized inbound traffic for tcp/22 from " + bastionNetBlock + " to " + net.Name)
+	}
+
+	if !Quiet {
+		fmt.Println("Set up peering from", *adminVpc.VpcId, "to", *vpc.VpcId, "and route for", *vpc.CidrBlock)
+	}
+	return err
+}
+
+// defaultSecurityGroup returns the network's default security group, which machines launched into it get.
+func (net *Network) defaultSecurityGroup() (*ec2.SecurityGroup, error) {
+	res, err := net.Cloud.ec2.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{Filters: []*ec2.Filter{
+		filter("vpc-id", net.Id),
+		filter("group-name", "default"),
+	}})
+	if err != nil {
+		return nil, err
+	}
+	if len(res.SecurityGroups) == 0 {
+		return nil, fmt.Errorf("Network %s has no default security group", net.Name)
+	}
+	return res.SecurityGroups[0], nil
+}
+
+// newZone wraps the subnets of a zone, which all have its name, ordered by availability zone.
+func (net *Network) newZone(subnets []*ec2.Subnet) *Zone {
+	sort.Slice(subnets, func(i, j int) bool {
+		return aws.StringValue(subnets[i].AvailabilityZone) < aws.StringValue(subnets[j].AvailabilityZone)
+	})
+	result := &Zone{Network: net, Name: findTag(subnets[0].Tags, "Name"), subnets: subnets}
+	result.Private = findTag(subnets[0].Tags, "Access") == "private"
+	for _, sn := range subnets {
+		result.Subnets = append(result.Subnets, &Subnet{Id: *sn.SubnetId, AddressBlock: *sn.CidrBlock, AvailabilityZone: aws.StringValue(sn.AvailabilityZone)})
+	}
+	result.Id = result.Subnets[0].Id
+	result.AddressBlock = result.Subnets[0].AddressBlock
+	result.AvailabilityZone = result.Subnets[0].AvailabilityZone
+	return result
+}
+
+// CreateZone creates the zone in the network, in whichever availability zone AWS picks. The net block is planned by
+// PlanZoneBlock, so it can be given as a size ("/26"), or left empty, to be allocated.
+func (net *Network) CreateZone(subnetName string, cidr string) (*Zone, error) {
+	return net.CreateZoneIn(subnetName, cidr, "", false)
+}
+
+// CreateZoneIn creates the zone in the network, in the given availability zone, i.e. "us-west-2b". With private set,
+// it is made private (see MakePrivate) as part of the same operation, so a failure rolls back the zone too.
+func (net *Network) CreateZoneIn(subnetName string, cidr string, availabilityZone string, private bool) (*Zone, error) {
+	var zone *Zone
+	err := net.Cloud.journaled("create-zone "+subnetName, func() error {
+		var err error
+		zone, err = net.createZoneIn(subnetName, cidr, availabilityZone)
+		if err == nil && private {
+			err = zone.makePrivate()
+		}
+		return err
+	})
+	return zone, err
+}
+
+func (net *Network) createZoneIn(subnetName string, cidr string, availabilityZone string) (*Zone, error) {
+	cidr, err := net.PlanZoneBlock(cidr)
+	if err != nil {
+		return nil, err
+	}
+	subnet, err := net.createSubnet(subnetName, cidr, availabilityZone)
+	if err != nil {
+		return nil, err
+	}
+	zone := net.newZone([]*ec2.Subnet{subnet})
+	_, err = zone.createRouteTable()
+	if err != nil {
+		return nil, err
+	}
+	return zone, nil
+}
+
+// CreateSpreadZone creates the zone in the network with a subnet in each of the first count availability zones of
+// the region, carving its net block into equal parts for them. With no net block, or just a size, one is allocated
+// that fits a subnet of the default zone size in each. With private set, it is made private, as with CreateZoneIn.
+func (net *Network) CreateSpreadZone(subnetName string, cidr string, count int, private bool) (*Zone, error) {
+	var zone *Zone
+	err := net.Cloud.journaled("create-zone "+subnetName, func() error {
+		var err error
+		zone, err = net.createSpreadZone(subnetName, cidr, count)
+		if err == nil && private {
+			err = zone.makePrivate()
+		}
+		return err
+	})
+	return zone, err
+}
+
+func (net *Network) createSpreadZone(subnetName string, cidr string, count int) (*Zone, error) {
+	azs, err := net.Cloud.availabilityZones()
+	if err != nil {
+		return nil, err
+	}
+	if count < 1 || count > len(azs) {
+		return nil, fmt.Errorf("Cannot spread a zone across %d availability zones, the region has %d", count, len(azs))
+	}
+	if cidr == "" {
+		cidr, err = net.spreadZoneSize(count)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cidr, err = net.PlanZoneBlock(cidr)
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := splitBlock(cidr, count)
+	if err != nil {
+		return nil, err
+	}
+	subnets := make([]*ec2.Subnet, 0, count)
+	for i, block := range blocks {
+		subnet, err := net.createSubnet(subnetName, block, azs[i])
+		if err != nil {
+			return nil, err
+		}
+		subnets = append(subnets, subnet)
+	}
+	zone := net.newZone(subnets)
+	_, err = zone.createRouteTable()
+	if err != nil {
+		return nil, err
+	}
+	return zone, nil
+}
+
+// availabilityZones returns the names of the region's available availability zones, in order.
+func (cloud *Cloud) availabilityZones() ([]string, error) {
+	res, err := cloud.ec2.DescribeAvailabilityZones(&ec2.DescribeAvailabilityZonesInput{Filters: []*ec2.Filter{filter("state", "available")}})
+	if err != nil {
+		return nil, err
+	}
+	lst := make([]string, 0, len(res.AvailabilityZones))
+	for _, az := range res.AvailabilityZones {
+		lst = append(lst, aws.StringValue(az.ZoneName))
+	}
+	sort.Strings(lst)
+	return lst, nil
+}
+
+// Destroy the zone, and its route table if it has one. Any machines in it must have been terminated first.
+func (zone *Zone) Destroy() error {
+	cloud := zone.Network.Cloud
+	for _, sn := range zone.subnets {
+		_, err := cloud.ec2.DeleteSubnet(&ec2.DeleteSubnetInput{SubnetId: sn.SubnetId})
+		if err != nil {
+			return err
+		}
+	}
+	//deleting the subnets let go of the route table
+	rts, err := cloud.ec2.DescribeRouteTables(&ec2.DescribeRouteTablesInput{Filters: []*ec2.Filter{
+		filter("vpc-id", zone.Network.Id),
+		filter("tag:Zone", zone.Name),
+	}})
+	if err != nil {
+		return err
+	}
+	for _, rt := range rts.RouteTables {
+		_, err = cloud.ec2.DeleteRouteTable(&ec2.DeleteRouteTableInput{RouteTableId: rt.RouteTableId})
+		if err != nil {
+			return err
+		}
+	}
+	if !Quiet {
+		fmt.Printf("Deleted zone '%s' (%s)\n", zone.Name, zone.Id)
+	}
+	return nil
+}
+
+// placeMachine picks the subnet a new machine in the zone goes in: the one with the fewest machines, the first of
+// them on a tie, so that machines take turns across the zone's availability zones.
+func (zone *Zone) placeMachine() (string, error) {
+	if len(zone.Subnets) == 1 {
+		return zone.Id, nil
+	}
+	insts, err := zone.Network.listInstancesIn("pending", "running")
+	if err != nil {
+		return "", err
+	}
+	counts := make(map[string]int)
+	for _, inst := range insts {
+		counts[aws.StringValue(inst.SubnetId)]++
+	}
+	best := zone.Subnets[0].Id
+	for _, sn := range zone.Subnets[1:] {
+		if counts[sn.Id] < counts[best] {
+			best = sn.Id
+		}
+	}
+	return best, nil
+}
+
+func (cloud *Cloud) LaunchMachine(zone *Zone, tagName string, keyName string, instanceImage string, instanceType string) (*Machine, error) {
+	var machine *Machine
+	err := cloud.journaled("run-machine "+tagName, func() error {
+		var err error
+		machine, err = cloud.launchMachine(zone, tagName, keyName, instanceImage, instanceType)
+		return err
+	})
+	return machine, err
+}
+
+func (cloud *Cloud) launchMachine(zone *Zone, tagName string, keyName string, instanceImage string, instanceType string) (*Machine, error) {
+	var sgName *string
+	//the default sg needs to allow tcp/22 from 10.255.255.0/24 !!!
+	if sgName == nil {
+		//grab from the Network itself
+		s, err := cloud.FindSecurityGroup(zone.Network.Name + ".default-sg")
+		if err == nil {
+			sgName = &s
+			if !Quiet {
+				fmt.Println("using default security group: ", s)
+			}
+		}
+	}
+	instance, err := cloud.launchInstance(zone, tagName, keyName, sgName, instanceImage, instanceType)
+	if err != nil {
+		return nil, err
+	}
+	return cloud.newMachine(instance), nil
+}
+
+func (cloud *Cloud) authorizeInboundAddress(secId *string, addr string, protocol string, port int) error {
+	_, err := cloud.ec2.AuthorizeSecurityGroupIngress(&ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId:    secId,
+		CidrIp:     aws.String(addr),
+		FromPort:   aws.Int64(int64(port)),
+		ToPort:     aws.Int64(int64(port)),
+		IpProtocol: aws.String(protocol),
+	})
+	return err
+}
+
+func (cloud *Cloud) authorizeInboundGroup(secId *string, group *string, owner *string, protocol string, port int) error {
+	_, err := cloud.ec2.AuthorizeSecurityGroupIngress(&ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId: secId,
+		IpPermissions: []*ec2.IpPermission{&ec2.IpPermission{
+			FromPort:         aws.Int64(int64(port)),
+			IpProtocol:       aws.String(protocol),
+			ToPort:           aws.Int64(int64(port)),
+			UserIdGroupPairs: []*ec2.UserIdGroupPair{&ec2.UserIdGroupPair{GroupId: group, UserId: owner}},
+		}},
+	})
+	return err
+}
+
+func (cloud *Cloud) authorizeOutboundAddress(secId *string, addr string, protocol string, port int) error {
+	_, err := cloud.ec2.AuthorizeSecurityGroupEgress(&ec2.AuthorizeSecurityGroupEgressInput{
+		GroupId: secId,
+		IpPermissions: []*ec2.IpPermission{&ec2.IpPermission{
+			FromPort:   aws.Int64(int64(port)),
+			IpProtocol: aws.String(protocol),
+			ToPort:     aws.Int64(int64(port)),
+			IpRanges:   []*ec2.IpRange{&ec2.IpRange{CidrIp: aws.String(addr)}},
+		}},
+	})
+	return err
+}
+
+func (cloud *Cloud) authorizeOutboundGroup(secId *string, group *string, owner *string, protocol string, port int) error {
+	_, err := cloud.ec2.AuthorizeSecurityGroupEgress(&ec2.AuthorizeSecurityGroupEgressInput{
+		GroupId: secId,
+		IpPermissions: []*ec2.IpPermission{&ec2.IpPermission{
+			FromPort:         aws.Int64(int64(port)),
+			IpProtocol:       aws.String(protocol),
+			ToPort:           aws.Int64(int64(port)),
+			UserIdGroupPairs: []*ec2.UserIdGroupPair{&ec2.UserIdGroupPair{GroupId: group, UserId: owner}},
+		}},
+	})
+	return err
+}
+
+func (cloud *Cloud) revokeOutboundDefault(secId *string) error {
+	//remove the default security egress rule
+	_, err := cloud.ec2.RevokeSecurityGroupEgress(&ec2.RevokeSecurityGroupEgressInput{
+		GroupId: secId,
+		IpPermissions: []*ec2.IpPermission{&ec2.IpPermission{
+			FromPort:   aws.Int64(-1),
+			IpProtocol: aws.String("-1"),
+			ToPort:     aws.Int64(-1),
+			IpRanges:   []*ec2.IpRange{&ec2.IpRange{CidrIp: aws.String("0.0.0.0/0")}},
+		}},
+	})
+	return err
+}
+
+func (net *Network) ListZones() ([]*Zone, error) {
+	cloud := net.Cloud
+	out, err := cloud.ec2.DescribeSubnets(&ec2.DescribeSubnetsInput{
+		Filters: []*ec2.Filter{filter("tag:Network", net.Name)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	lst := make([]*Zone, 0)
+	byName := make(map[string][]*ec2.Subnet)
+	for _, sn := range out.Subnets {
+		name := findTag(sn.Tags, "Name")
+		if byName[name] == nil {
+			lst = append(lst, &Zone{Name: name})
+		}
+		byName[name] = append(byName[name], sn)
+	}
+	for i, zone := range lst {
+		lst[i] = net.newZone(byName[zone.Name])
+	}
+	return lst, nil
+}
+
+// tags are the tags every resource in the network gets.
+func (net *Network) tags(name string) []*ec2.Tag {
+	return []*ec2.Tag{
+		&ec2.Tag{Key: aws.String("Name"), Value: aws.String(name)},
+		&ec2.Tag{Key: aws.String("Network"), Value: aws.String(net.Name)},
+		&ec2.Tag{Key: aws.String("Env"), Value: aws.String(net.Cloud.Name)},
+	}
+}
+
+func (net *Network) createSubnet(name string, cidr string, availabilityZone string) (*ec2.Subnet, error) {
+	subnetName := net.Name + "." + name
+	cloud := net.Cloud
+	req := &ec2.CreateSubnetInput{
+		VpcId:     net.vpc.VpcId,
+		CidrBlock: aws.String(cidr),
+	}
+	if availabilityZone != "" {
+		req.AvailabilityZone = aws.String(availabilityZone)
+	}
+	subnet, err := cloud.ec2.CreateSubnet(req)
+	if err != nil {
+		return nil, err
+	}
+	cloud.record("subnet", *subnet.Subnet.SubnetId, "", subnetName)
+	tags := net.tags(subnetName)
+	_, err = cloud.ec2.CreateTags(&ec2.CreateTagsInput{Resources: []*string{subnet.Subnet.SubnetId}, Tags: tags})
+	if err != nil {
+		return nil, err
+	}
+	subnet.Subnet.Tags = tags //the zone is named by them
+	return subnet.Subnet, nil
+}
+
+func filter(key string, value string) *ec2.Filter {
+	return &ec2.Filter{Name: aws.String(key), Values: []*string{aws.String(value)}}
+}
+
+// destroyVpc deletes the VPC and everything in it but its instances, in the order AWS requires: NAT gateways (and
+// then their EIPs, once they let go of them), the route tables of zones, subnets, security groups, the internet
+// gateway, and finally the VPC itself.
+func (cloud *Cloud) destroyVpc(vpc *ec2.Vpc, name string) error {
+	//to do: terminate all instances, or abort if any exist, or something
+	vpcFilter := filter("vpc-id", *vpc.VpcId)
+	nats, err := cloud.ec2.DescribeNatGateways(&ec2.DescribeNatGatewaysInput{Filter: []*ec2.Filter{vpcFilter}})
+	if err == nil {
+		for _, nat := range nats.NatGateways {
+			id := *nat.NatGatewayId
+			state := aws.StringValue(nat.State)
+			if state == "deleted" || state == "failed" {
+				continue
+			}
+			if cloud.DryRun {
+				cloud.wouldRemove("nat-gateway", id, findTag(nat.Tags, "Name"))
+				for _, addr := range nat.NatGatewayAddresses {
+					cloud.wouldRemove("address", aws.StringValue(addr.AllocationId), aws.StringValue(addr.PublicIp))
+				}
+				continue
+			}
+			if state != "deleting" {
+				_, err := cloud.ec2.DeleteNatGateway(&ec2.DeleteNatGatewayInput{NatGatewayId: nat.NatGatewayId})
+				if err != nil {
+					fmt.Printf("Cannot delete NAT gateway '%s': %s\n", id, err.Error())
+					continue
+				}
+			}
+			//its subnet cannot be deleted, nor its EIP released, until it is gone
+			_, err = cloud.waitForNatGateway(id, "deleted")
+			if err != nil {
+				fmt.Printf("Cannot delete NAT gateway '%s': %s\n", id, err.Error())
+				continue
+			}
+			if !Quiet {
+				fmt.Printf("Deleted NAT gateway '%s'\n", id)
+			}
+			for _, addr := range nat.NatGatewayAddresses {
+				_, err = cloud.ec2.ReleaseAddress(&ec2.ReleaseAddressInput{AllocationId: addr.AllocationId})
+				if err != nil {
+					fmt.Printf("Cannot release NAT gateway address %s: %s\n", aws.StringValue(addr.PublicIp), err.Error())
+				} else if !Quiet {
+					fmt.Println("Released Address ", aws.StringValue(addr.PublicIp))
+				}
+			}
+		}
+	}
+	rts, err := cloud.ec2.DescribeRouteTables(&ec2.DescribeRouteTablesInput{Filters: []*ec2.Filter{vpcFilter}})
+	if err == nil {
+		for _, rt := range rts.RouteTables {
+			if isMainRouteTable(rt) {
+				continue //goes with the vpc
+			}
+			id := *rt.RouteTableId
+			if cloud.DryRun {
+				cloud.wouldRemove("route-table", id, findTag(rt.Tags, "Name"))
+				continue
+			}
+			for _, assoc := range rt.Associations {
+				_, err := cloud.ec2.DisassociateRouteTable(&ec2.DisassociateRouteTableInput{AssociationId: assoc.RouteTableAssociationId})
+				if err != nil {
+					fmt.Printf("Cannot disassociate route table '%s': %s\n", id, err.Error())
+				}
+			}
+			_, err := cloud.ec2.DeleteRouteTable(&ec2.DeleteRouteTableInput{RouteTableId: rt.RouteTableId})
+			if err != nil {
+				fmt.Printf("Cannot delete route table '%s': %s\n", id, err.Error())
+			} else if !Quiet {
+				fmt.Printf("Deleted route table '%s'\n", id)
+			}
+		}
+	}
+	subnetRes, err := cloud.ec2.DescribeSubnets(&ec2.DescribeSubnetsInput{Filters: []*ec2.Filter{vpcFilter}})
+	if err == nil {
+		for _, subnet := range subnetRes.Subnets {
+			id := *subnet.SubnetId
+			if cloud.DryRun {
+				cloud.wouldRemove("subnet", id, findTag(subnet.Tags, "Name"))
+				continue
+			}
+			_, err := cloud.ec2.DeleteSubnet(&ec2.DeleteSubnetInput{SubnetId: subnet.SubnetId})
+			if err != nil {
+				fmt.Printf("Cannot delete subnet '%s': %s\n", id, err.Error())
+			} else if !Quiet {
+				fmt.Printf("Deleted subnet '%s'\n", id)
+			}
+		}
+	}
+	tmp, err := cloud.ec2.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{Filters: []*ec2.Filter{vpcFilter}})
+	if err == nil {
+		for _, grp := range tmp.SecurityGroups {
+			s := *grp.GroupName
+			if s != "default" {
+				id := *grp.GroupId
+				if cloud.DryRun {
+					cloud.wouldRemove("security-group", id, s)
+					continue
+				}
+				_, err = cloud.ec2.DeleteSecurityGroup(&ec2.DeleteSecurityGroupInput{GroupId: grp.GroupId})
+				if err != nil {
+					fmt.Printf("Cannot delete security group '%s': %s\n", *grp.GroupName, err.Error())
+				} else if !Quiet {
+					fmt.Printf("Deleted security group '%s'\n", id)
+				}
+			}
+		}
+	}
+	gws, err := cloud.ec2.DescribeInternetGateways(&ec2.DescribeInternetGatewaysInput{Filters: []*ec2.Filter{filter("attachment.vpc-id", *vpc.VpcId)}})
+	if err == nil {
+		for _, gw := range gws.InternetGateways {
+			id := *gw.InternetGatewayId
+			if cloud.DryRun {
+				cloud.wouldRemove("internet-gateway", id, findTag(gw.Tags, "Name"))
+				continue
+			}
+			_, err := cloud.ec2.DetachInternetGateway(&ec2.DetachInternetGatewayInput{
+				VpcId:             vpc.VpcId,
+				InternetGatewayId: gw.InternetGatewayId,
+			})
+			if err != nil {
+				fmt.Printf("Cannot detach internet gateway '%s': %s\n", findTag(gw.Tags, "Name"), err.Error())
+			} else if !Quiet {
+				fmt.Printf("Detached internet gateway '%s' from %s\n", findTag(gw.Tags, "Name"), *vpc.VpcId)
+			}
+			_, err = cloud.ec2.DeleteInternetGateway(&ec2.DeleteInternetGatewayInput{InternetGatewayId: gw.InternetGatewayId})
+			if err != nil {
+				fmt.Printf("Cannot delete internet gateway '%s': %s\n", findTag(gw.Tags, "Name"), err.Error())
+			} else if !Quiet {
+				fmt.Printf("Deleted internet gateway '%s'\n", id)
+			}
+		}
+	}
+
+	if cloud.DryRun {
+		cloud.wouldRemove("vpc", *vpc.VpcId, findTag(vpc.Tags, "Name"))
+		return nil
+	}
+	_, err = cloud.ec2.DeleteVpc(&ec2.DeleteVpcInput{VpcId: vpc.VpcId})
+	return err
+}
+
+func (net *Network) listInstances() ([]*ec2.Instance, error) {
+	//treat "stopping", "stopped", "terminating", and "terminated" as nonexistent
+	return net.listInstancesIn("pending", "running")
+}
+
+func (net *Network) listInstancesIn(states ...string) ([]*ec2.Instance, error) {
+	req := &ec2.DescribeInstancesInput{Filters: []*ec2.Filter{filter("tag:Network", net.Name)}}
+	res, err := net.Cloud.ec2.DescribeInstances(req)
+	if err != nil {
+		return nil, err
+	}
+	lst := make([]*ec2.Instance, 0)
+	for _, rez := range res.Reservations {
+		for _, inst := range rez.Instances {
+			for _, state := range states {
+				if *inst.State.Name == state {
+					lst = append(lst, inst)
+				}
+			}
+		}
+	}
+	return lst, nil
+}
+
+// ListMachines returns the running (or pending) machines in the network.
+func (net *Network) ListMachines() ([]*Machine, error) {
+	lst, err := net.listInstances()
+	if err != nil {
+		return nil, err
+	}
+	machines := make([]*Machine, 0, len(lst))
+	for _, inst := range lst {
+		machines = append(machines, net.Cloud.newMachine(inst))
+	}
+	return machines, nil
+}
+
+// Start any stopped machines in the network, and wait for them to be running.
+func (net *Network) Start() error {
+	lst, err := net.listInstancesIn("stopped")
+	if err != nil || len(lst) == 0 {
+		return err
+	}
+	ids := make([]*string, 0, len(lst))
+	for _, inst := range lst {
+		ids = append(ids, inst.InstanceId)
+	}
+	_, err = net.Cloud.ec2.StartInstances(&ec2.StartInstancesInput{InstanceIds: ids})
+	if err != nil {
+		return err
+	}
+	for _, inst := range lst {
+		err = net.Cloud.waitForInstanceState(inst, "running")
+		if err != nil {
+			return err
+		}
+		if !Quiet {
+			fmt.Printf("Started instance %s (%s)\n", findTag(inst.Tags, "Name"), *inst.InstanceId)
+		}
+	}
+	return nil
+}
+
+// Stop the running machines in the network, and wait for them to be stopped. Force skips the orderly shutdown.
+func (net *Network) Stop(force bool) error {
+	lst, err := net.listInstances()
+	if err != nil || len(lst) == 0 {
+		return err
+	}
+	ids := make([]*string, 0, len(lst))
+	for _, inst := range lst {
+		ids = append(ids, inst.InstanceId)
+	}
+	_, err = net.Cloud.ec2.StopInstances(&ec2.StopInstancesInput{InstanceIds: ids, Force: aws.Bool(force)})
+	if err != nil {
+		return err
+	}
+	for _, inst := range lst {
+		err = net.Cloud.waitForInstanceState(inst, "stopped")
+		if err != nil {
+			return err
+		}
+		if !Quiet {
+			fmt.Printf("Stopped instance %s (%s)\n", findTag(inst.Tags, "Name"), *inst.InstanceId)
+		}
+	}
+	return nil
+}
+
+func (net *Network) killAllInstances() error {
+	lst, err := net.listInstances()
+	if err != nil {
+		return err
+	}
+	for _, inst := range lst {
+		id := *inst.InstanceId
+		if net.Cloud.DryRun {
+			net.Cloud.wouldRemove("instance", id, findTag(inst.Tags, "Name"))
+			continue
+		}
+		if !Quiet {
+			fmt.Println("killing instance", id, "...")
+		}
+		err := net.Cloud.terminateInstance(inst)
+		if err != nil {
+			return err
+		}
+		if !Quiet {
+			fmt.Printf("\nTerminated instance '%s'\n", id)
+		}
+	}
+	return nil
+}
+
+// Cleanup terminates every machine and deletes every network in the environment, then releases the environment's
+// unassociated EIPs. With SweepOrphans set, unassociated EIPs not tagged for any environment are released, too. With
+// DryRun set, nothing is touched, and Removals lists what would have been.
+func (cloud *Cloud) Cleanup() error {
+	//destroy any peering between vpcs
+	lstPeers, err := cloud.ec2.DescribeVpcPeeringConnections(&ec2.DescribeVpcPeeringConnectionsInput{
+		Filters: []*ec2.Filter{filter("tag:Env", cloud.Name)},
+	})
+	if err == nil {
+		for _, peering := range lstPeers.VpcPeeringConnections {
+			switch aws.StringValue(peering.Status.Code) {
+			case "deleted", "deleting", "rejected", "failed", "expired":
+				continue //still listed for a while after it is gone
+			}
+			if cloud.DryRun {
+				cloud.wouldRemove("peering", *peering.VpcPeeringConnectionId, findTag(peering.Tags, "Name"))
+				continue
+			}
+			_, err := cloud.ec2.DeleteVpcPeeringConnection(&ec2.DeleteVpcPeeringConnectionInput{VpcPeeringConnectionId: peering.VpcPeeringConnectionId})
+			name := findTag(peering.Tags, "Name")
+			if err != nil {
+				fmt.Printf("Failed to delete VPC peering (%s): %s\n", name, err.Error())
+			} else if !Quiet {
+				fmt.Printf("Deleted VPC peering connection (%s)\n", name)
+			}
+		}
+	}
+	//an environment with no networks left still gets its EIPs released, i.e. when rerunning after a failed cleanup
+	res, err := cloud.ec2.DescribeVpcs(&ec2.DescribeVpcsInput{Filters: []*ec2.Filter{filter("tag:Env", cloud.Name)}})
+	if err != nil {
+		return err
+	}
+	for _, vpc := range res.Vpcs {
+		net := cloud.newNetwork(vpc)
+		err := net.killAllInstances()
+		if err != nil {
+			fmt.Printf("Failed to terminate instances in network %s: %v\n", net.Name, err)
+		}
+		err = cloud.destroyVpc(net.vpc, cloud.Name)
+		if err != nil {
+			fmt.Printf("Failed to destroy network: %v\n", err)
+		}
+	}
+	//release the environment's EIPs that are no longer associated with anything
+	eips, err := cloud.releasableAddresses()
+	if err != nil {
+		return err
+	}
+	for _, addr := range eips {
+		if addr.PrivateIpAddress == nil || cloud.wouldTerminate(aws.StringValue(addr.InstanceId)) {
+			ip := *addr.PublicIp
+			if cloud.DryRun {
+				cloud.wouldRemove("address", aws.StringValue(addr.AllocationId), ip)
+				continue
+			}
+			_, err = cloud.ec2.ReleaseAddress(&ec2.ReleaseAddressInput{AllocationId: addr.AllocationId})
+			if err != nil {
+				fmt.Println("warning: failed to release EIP: ", pretty(addr))
+			} else if !Quiet {
+				fmt.Println("Released Address ", ip)
+			}
+		}
+	}
+	return nil
+}
+
+// releasableAddresses returns the EIPs tagged for this environment, plus the untagged ones when sweeping orphans. Other
+// environments' (and other teams') addresses are never touched.
+func (cloud *Cloud) releasableAddresses() ([]*ec2.Address, error) {
+	res, err := cloud.ec2.DescribeAddresses(&ec2.DescribeAddressesInput{
+		Filters: []*ec2.Filter{filter("tag:Env", cloud.Name)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	lst := res.Addresses
+	if cloud.SweepOrphans {
+		res, err = cloud.ec2.DescribeAddresses(&ec2.DescribeAddressesInput{})
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range res.Addresses {
+			if findTag(addr.Tags, "Env") == "" {
+				lst = append(lst, addr)
+			}
+		}
+	}
+	return lst, nil
+}
+
+func (cloud *Cloud) newMachine(ec2Instance *ec2.Instance) *Machine {
+	inst := &Machine{Cloud: cloud, ec2Instance: ec2Instance, User: cloud.loginUser(ec2Instance)}
+	for _, tag := range ec2Instance.Tags {
+		if *tag.Key == "Name" {
+			inst.Name = *tag.Value
+		} else if *tag.Key == "Network" {
+			inst.Network = *tag.Value
+		}
+	}
+	return inst
+}
+
+func (cloud *Cloud) FindSecurityGroup(name string) (string, error) {
+	tmp, err := cloud.ec2.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{Filters: []*ec2.Filter{filter("tag:Name", name)}})
+	if err != nil {
+		return "", err
+	}
+	if len(tmp.SecurityGroups) != 1 {
+		return "", fmt.Errorf("Security group not found: " + name)
+	}
+	return *tmp.SecurityGroups[0].GroupId, nil
+}
+
+// instance names are in a single global namespace for the network, not scoped by subnet.
+func (cloud *Cloud) FindMachine(name string) (*Machine, error) {
+	instName := cloud.Name + "." + name
+	req := &ec2.DescribeInstancesInput{Filters: []*ec2.Filter{filter("tag:Name", instName)}}
+	res, err := cloud.ec2.DescribeInstances(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, rez := range res.Reservations {
+		for _, inst := range rez.Instances {
+			state := *inst.State.Name
+			if state == "pending" || state == "running" {
+				return cloud.newMachine(inst), nil
+			} //treat "stopping", "stopped", "terminating", and "terminated" as nonexistent
+		}
+	}
+	return nil, nil
+}
+
+// fix: only one interface in this API.
+func (cloud *Cloud) launchInstance(zone *Zone, name string, keyname string, securityGroupId *string, instanceImage string, instanceType string) (*ec2.Instance, error) {
+	netName := zone.Network.Name
+	instName := netName + "." + name
+	net := zone.Network
+	if keyname == "" {
+		keyname = DefaultKeyName
+	}
+
+	//launch, tag, and wait for it to be running
+	//if already pending, just wait
+	subnetId, err := zone.placeMachine()
+	if err != nil {
+		return nil, err
+	}
+	req := &ec2.RunInstancesInput{
+		SubnetId:     aws.String(subnetId),
+		ImageId:      aws.String(instanceImage),
+		InstanceType: aws.String(instanceType),
+		KeyName:      aws.String(keyname),
+		MinCount:     aws.Int64(1),
+		MaxCount:     aws.Int64(1),
+	}
+	if securityGroupId != nil { //otherwise the VPC's default security group applies
+		req.SecurityGroupIds = []*string{securityGroupId}
+	}
+	runResult, err := cloud.ec2.RunInstances(req)
+	if err != nil {
+		return nil, err
+	}
+	inst := runResult.Instances[0]
+	instanceId := inst.InstanceId
+	cloud.record("instance", *instanceId, "", instName)
+	_, err = cloud.ec2.CreateTags(&ec2.CreateTagsInput{
+		Resources: []*string{instanceId},
+		Tags: []*ec2.Tag{
+			&ec2.Tag{Key: aws.String("Name"), Value: aws.String(instName)},
+			&ec2.Tag{Key: aws.String("Network"), Value: aws.String(net.Name)},
+			&ec2.Tag{Key: aws.String("Env"), Value: aws.String(cloud.Name)},
+			&ec2.Tag{Key: aws.String("User"), Value: aws.String(cloud.imageUser(instanceImage))},
+			&ec2.Tag{Key: aws.String("Key"), Value: aws.String(keyname)},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = cloud.waitForInstanceState(inst, "running")
+	if err != nil {
+		return nil, err
+	}
+	return inst, nil
+}
+
+func (cloud *Cloud) waitForInstanceState(inst *ec2.Instance, finalState string) error {
+	transitionState := "pending"
+	if finalState == "terminated" {
+		transitionState = "shutting-down"
+	} else if finalState == "stopped" {
+		transitionState = "stopping"
+	}
+	instId := *inst.InstanceId
+	inst, err := cloud.getInstance(instId)
+	if err == nil && inst != nil {
+		if *inst.State.Name != finalState {
+			if *inst.State.Name != transitionState {
+				return fmt.Errorf("Cannot wait, instance status is: %s", *inst.State.Name)
+			}
+			for inst != nil && *inst.State.Name == transitionState {
+				cloud.pause(3.0)
+				inst, err = cloud.getInstance(instId)
+				if err != nil {
+					return err
+				}
+				if inst == nil {
+					return fmt.Errorf("Cannot wait: instance '%s' disappeared", instId)
+				}
+				if !Quiet {
+					fmt.Print(".")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (cloud *Cloud) waitForInstance(inst *ec2.Instance, keyname string) error {
+	if cloud.Offline {
+		return nil
+	}
+	instId := *inst.InstanceId
+	for {
+		cloud.pause(5.0)
+		inst, err := cloud.getInstance(instId)
+		if err != nil {
+			return err
+		}
+		conn, err := cloud.dial(inst, keyname, os.Stdout)
+		if err == nil {
+			_, err = conn.Output("hostname")
+			conn.Close()
+			if err == nil {
+				return nil
+			}
+		}
+	}
+}
+
+//func (cloud *Cloud) LaunchMachine(zone *Zone, name string, keyname string, instanceImage string, instanceType string) (*ec2.Instance, error) {
+
+func (cloud *Cloud) terminateInstance(inst *ec2.Instance) error {
+	_, err := cloud.ec2.TerminateInstances(&ec2.TerminateInstancesInput{InstanceIds: []*string{inst.InstanceId}})
+	if err != nil {
+		return err
+	}
+	err = cloud.forgetHost(*inst.InstanceId)
+	if err != nil {
+		fmt.Println("warning: cannot remove the known host key:", err)
+	}
+	return cloud.waitForInstanceState(inst, "terminated")
+}
+
+func (cloud *Cloud) GetMachineById(instId string) (*Machine, error) {
+	inst, err := cloud.getInstance(instId)
+	if err != nil {
+		return nil, err
+	}
+	if inst == nil {
+		return nil, fmt.Errorf("Machine not found with id %s", instId)
+	}
+	return cloud.newMachine(inst), nil
+}
+
+func (cloud *Cloud) getInstance(instId string) (*ec2.Instance, error) {
+	req := &ec2.DescribeInstancesInput{Filters: []*ec2.Filter{filter("instance-id", instId)}}
+	res, err := cloud.ec2.DescribeInstances(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, rez := range res.Reservations {
+		for _, inst := range rez.Instances {
+			return inst, nil
+		}
+	}
+	return nil, nil
+}
+
+func (cloud *Cloud) listInstances() ([]*ec2.Instance, error) {
+	req := &ec2.DescribeInstancesInput{Filters: []*ec2.Filter{filter("tag:Env", cloud.Name)}}
+	res, err := cloud.ec2.DescribeInstances(req)
+	if err != nil {
+		return nil, err
+	}
+	lst := make([]*ec2.Instance, 0)
+	for _, rez := range res.Reservations {
+		for _, inst := range rez.Instances {
+			state := *inst.State.Name
+			if state == "pending" || state == "running" {
+				lst = append(lst, inst)
+			} //treat "stopping", "stopped", "terminating", and "terminated" as nonexistent
+		}
+	}
+	return lst, nil
+}
+
+func (cloud *Cloud) ListMachines() ([]*Machine, error) {
+	lst, err := cloud.listInstances()
+	if err != nil {
+		return nil, err
+	}
+	machines := make([]*Machine, 0, len(lst))
+	for _, inst := range lst {
+		machines = append(machines, cloud.newMachine(inst))
+	}
+	return machines, nil
+}
@@ -0,0 +1,198 @@
+package awsnet
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"os"
+	"strings"
+	"testing"
+)
+
+// newTestCloud returns a Cloud on a FakeEC2, with its config, journal and known hosts in a temporary directory.
+func newTestCloud(t *testing.T) (*Cloud, *FakeEC2) {
+	dir := t.TempDir()
+	for name, value := range map[string]string{"HACKS_CONFIG": dir + "/config.yaml", "HOME": dir} {
+		old, found := os.LookupEnv(name)
+		os.Setenv(name, value)
+		t.Cleanup(func() {
+			if found {
+				os.Setenv(name, old)
+			} else {
+				os.Unsetenv(name)
+			}
+		})
+	}
+	Quiet = true
+	return FakeCloud("dev")
+}
+
+// live counts what exists in the fake, leaving out what is gone but still listed, like terminated instances.
+func live(fake *FakeEC2) string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	instances := 0
+	for _, inst := range fake.instances {
+		if *inst.State.Name != "terminated" {
+			instances++
+		}
+	}
+	nats := 0
+	for _, nat := range fake.natGateways {
+		if *nat.State != "deleted" {
+			nats++
+		}
+	}
+	peerings := 0
+	for _, p := range fake.peerings {
+		switch *p.Status.Code {
+		case "deleted", "rejected":
+		default:
+			peerings++
+		}
+	}
+	return fmt.Sprintf("vpcs=%d subnets=%d groups=%d gateways=%d tables=%d addresses=%d peerings=%d instances=%d nats=%d",
+		len(fake.vpcs), len(fake.subnets), len(fake.groups), len(fake.gateways), len(fake.routeTables), len(fake.addresses), peerings, instances, nats)
+}
+
+func TestLifecycle(t *testing.T) {
+	cloud, fake := newTestCloud(t)
+	empty := live(fake)
+	err := cloud.Setup("0.0.0.0/0", AdminNetBlock, BastionNetBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	net, err := cloud.CreateNetwork("myapp", "10.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerings, err := net.Peerings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peerings) != 1 || peerings[0].Status != "active" || peerings[0].PeerBlock != AdminNetBlock {
+		t.Fatalf("Expected an active peering with the admin network, got %v", peerings)
+	}
+	zone, err := net.CreateZone("fe", "10.0.0.0/28")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := cloud.GetZone("dev.myapp.fe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found == nil || found.Id != zone.Id || found.AddressBlock != "10.0.0.0/28" {
+		t.Fatalf("Expected to find zone %s, got %v", zone.Id, found)
+	}
+	machine, err := cloud.LaunchMachine(zone, "web", "k", "ami-1", "t1.micro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	machines, err := net.ListMachines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(machines) != 1 || machines[0].Id() != machine.Id() {
+		t.Fatalf("Expected just %s in myapp, got %v", machine.Id(), machines)
+	}
+	err = cloud.DestroyNetwork("myapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	net, err = cloud.FindNetwork("myapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if net != nil {
+		t.Fatal("The network is still there after DestroyNetwork")
+	}
+	err = cloud.Cleanup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live(fake) != empty {
+		t.Fatalf("Expected nothing left after Cleanup, got %s", live(fake))
+	}
+}
+
+func TestSetupConverges(t *testing.T) {
+	cloud, fake := newTestCloud(t)
+	err := cloud.Setup("0.0.0.0/0", AdminNetBlock, BastionNetBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, created := live(fake), fake.nextId
+	err = cloud.Setup("0.0.0.0/0", AdminNetBlock, BastionNetBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live(fake) != before || fake.nextId != created {
+		t.Fatalf("Expected setting up again to create nothing, got %s (%d new ids)", live(fake), fake.nextId-created)
+	}
+}
+
+func TestDestroyNetworkDryRun(t *testing.T) {
+	cloud, fake := newTestCloud(t)
+	err := cloud.Setup("0.0.0.0/0", AdminNetBlock, BastionNetBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	net, err := cloud.CreateNetwork("myapp", "10.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone, err := net.CreateZone("fe", "10.0.0.0/28")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cloud.LaunchMachine(zone, "web", "k", "ami-1", "t1.micro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := live(fake)
+	cloud.DryRun = true
+	err = cloud.DestroyNetwork("myapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live(fake) != before {
+		t.Fatalf("A dry run changed %s to %s", before, live(fake))
+	}
+	kinds := make(map[string]bool)
+	for _, r := range cloud.Removals {
+		kinds[r.Kind] = true
+	}
+	for _, kind := range []string{"instance", "peering", "route", "subnet", "vpc"} {
+		if !kinds[kind] {
+			t.Errorf("Expected the dry run to list a %s, got %v", kind, cloud.Removals)
+		}
+	}
+}
+
+func TestSetupKeepsBastionBlock(t *testing.T) {
+	cloud, fake := newTestCloud(t)
+	err := cloud.Setup("0.0.0.0/0", AdminNetBlock, "10.255.255.192/28")
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := cloud.FindNetwork(AdminNetName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//as set up before the blocks were recorded on the admin VPC
+	tags := fake.tagsOf(admin.Id)
+	kept := make([]*ec2.Tag, 0)
+	for _, tag := range *tags {
+		if *tag.Key != "AdminNetBlock" && *tag.Key != "BastionNetBlock" {
+			kept = append(kept, tag)
+		}
+	}
+	*tags = kept
+	err = cloud.Setup("0.0.0.0/0", AdminNetBlock, BastionNetBlock)
+	if err == nil || !strings.Contains(err.Error(), "already set up with 10.255.255.192/28") {
+		t.Fatalf("Expected setup to refuse to move the bastion zone, got %v", err)
+	}
+	err = cloud.Setup("0.0.0.0/0", AdminNetBlock, "10.255.255.192/28")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,251 @@
+package awsnet
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// The defaults of all the commands can be set in ~/.config/hacks/config.yaml (or wherever HACKS_CONFIG points),
+// globally and per environment:
+//
+//    env: dev
+//    region: us-west-2
+//    image: ami-81f7e8b1
+//    image-users:
+//      ami-0abcdef1234567890: ubuntu
+//    envs:
+//      prod:
+//        region: us-east-1
+//        type: m4.large
+//        control: 203.0.113.0/24
+//        admin-net: 172.31.255.0/24
+//        bastion-net: 172.31.255.0/28
+//      team:
+//        admin-account: "210987654321"
+//        admin-vpc: vpc-0a1b2c3d
+//        admin-net: 10.254.0.0/24
+//        bastion-net: 10.254.0.0/28
+//
+// An environment whose admin network is in another AWS account (admin-account) names it by its VPC id (admin-vpc),
+// and gives its net blocks (admin-net and bastion-net), since they cannot be looked up from this account.
+//
+// A flag beats an environment variable, which beats the environment's section of the file, which beats the global
+// section, which beats the built in default.
+
+// Settings are the defaults the commands work from, for one environment.
+type Settings struct {
+	Env          string            `yaml:"env,omitempty"`           //only meaningful in the global section
+	Region       string            `yaml:"region,omitempty"`        //empty leaves it to the AWS SDK
+	Image        string            `yaml:"image,omitempty"`         //to launch machines with
+	Type         string            `yaml:"type,omitempty"`          //to launch machines with
+	Key          string            `yaml:"key,omitempty"`           //the keypair to launch and connect with, empty for the machine's own
+	User         string            `yaml:"user,omitempty"`          //the SSH login user, empty to resolve it per machine
+	Control      string            `yaml:"control,omitempty"`       //the net block SSH to the jumphost is allowed from
+	AdminNet     string            `yaml:"admin-net,omitempty"`     //the net block of the admin network, for setup or when it is in another account
+	BastionNet   string            `yaml:"bastion-net,omitempty"`   //the net block of the admin network's bastion zone, likewise
+	AdminAccount string            `yaml:"admin-account,omitempty"` //the AWS account the admin network is in, when it is another one
+	AdminVpc     string            `yaml:"admin-vpc,omitempty"`     //the admin network's VPC id, when it is in another account
+	ImageUsers   map[string]string `yaml:"image-users,omitempty"`
+	Sources      map[string]string `yaml:"-"` //where each setting came from, by name
+}
+
+// Config is the contents of the config file.
+type Config struct {
+	Settings `yaml:",inline"`
+	Envs     map[string]*Settings `yaml:"envs,omitempty"`
+	Path     string               `yaml:"-"`
+	Found    bool                 `yaml:"-"`
+}
+
+// BuiltinSettings are used when nothing else gives a setting.
+var BuiltinSettings = Settings{
+	Env:        "dev",
+	Image:      "ami-81f7e8b1",
+	Type:       "t1.micro",
+	Control:    "0.0.0.0/0",
+	AdminNet:   AdminNetBlock,
+	BastionNet: BastionNetBlock,
+}
+
+type setting struct {
+	name   string
+	envVar string
+	field  func(s *Settings) *string
+}
+
+var settingList = []setting{
+	{"env", "VPC_ENV", func(s *Settings) *string { return &s.Env }},
+	{"region", "AWS_REGION", func(s *Settings) *string { return &s.Region }},
+	{"image", "HACKS_IMAGE", func(s *Settings) *string { return &s.Image }},
+	{"type", "HACKS_TYPE", func(s *Settings) *string { return &s.Type }},
+	{"key", "HACKS_KEY", func(s *Settings) *string { return &s.Key }},
+	{"user", "HACKS_USER", func(s *Settings) *string { return &s.User }},
+	{"control", "VPC_CTRL", func(s *Settings) *string { return &s.Control }},
+	{"admin-net", "VPC_ADMIN", func(s *Settings) *string { return &s.AdminNet }},
+	{"bastion-net", "VPC_BASTION", func(s *Settings) *string { return &s.BastionNet }},
+	{"admin-account", "VPC_ADMIN_ACCOUNT", func(s *Settings) *string { return &s.AdminAccount }},
+	{"admin-vpc", "VPC_ADMIN_VPC", func(s *Settings) *string { return &s.AdminVpc }},
+}
+
+// ConfigPath returns where the config file is read from.
+func ConfigPath() string {
+	if path := os.Getenv("HACKS_CONFIG"); path != "" {
+		return path
+	}
+	return filepath.Join(os.Getenv("HOME"), ".config", "hacks", "config.yaml")
+}
+
+// LoadConfig reads the config file. A missing file is fine, and the same as an empty one.
+func LoadConfig() (*Config, error) {
+	config := &Config{Path: ConfigPath()}
+	data, err := ioutil.ReadFile(config.Path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = yaml.UnmarshalStrict(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse config %s: %v", config.Path, err)
+	}
+	for name, s := range config.Envs {
+		if s == nil {
+			config.Envs[name] = &Settings{}
+		} else if s.Env != "" {
+			return nil, fmt.Errorf("Cannot set env within the section for %s in %s", name, config.Path)
+		}
+	}
+	config.Found = true
+	return config, nil
+}
+
+// EnvName returns the environment to use when no flag names one.
+func (config *Config) EnvName() string {
+	if env := os.Getenv("VPC_ENV"); env != "" {
+		return env
+	}
+	if config.Env != "" {
+		return config.Env
+	}
+	return BuiltinSettings.Env
+}
+
+// Effective returns the settings for the environment, from everything but the flags, which the caller then applies
+// with Override. An empty env is for standalone machines, and only uses the global section.
+func (config *Config) Effective(env string) *Settings {
+	result := &Settings{Env: env, ImageUsers: make(map[string]string), Sources: make(map[string]string)}
+	section := config.Envs[env]
+	for _, s := range settingList {
+		if s.name == "env" {
+			continue
+		}
+		value, source := *s.field(&BuiltinSettings), "default"
+		if v := *s.field(&config.Settings); v != "" {
+			value, source = v, "config"
+		}
+		if section != nil {
+			if v := *s.field(section); v != "" {
+				value, source = v, "config envs."+env
+			}
+		}
+		if v := os.Getenv(s.envVar); v != "" {
+			value, source = v, "$"+s.envVar
+		}
+		*s.field(result) = value
+		result.Sources[s.name] = source
+	}
+	switch {
+	case env == "":
+		result.Sources["env"] = "standalone machines"
+	case os.Getenv("VPC_ENV") != "":
+		result.Sources["env"] = "$VPC_ENV"
+	case config.Env != "":
+		result.Sources["env"] = "config"
+	default:
+		result.Sources["env"] = "default"
+	}
+	for image, user := range config.ImageUsers {
+		result.ImageUsers[image] = user
+	}
+	if section != nil {
+		for image, user := range section.ImageUsers {
+			result.ImageUsers[image] = user
+		}
+	}
+	return result
+}
+
+// Override sets the named setting from a flag.
+func (settings *Settings) Override(name string, value string, source string) {
+	for _, s := range settingList {
+		if s.name == name {
+			*s.field(settings) = value
+			settings.Sources[name] = source
+			return
+		}
+	}
+}
+
+// Show prints the settings, and where each of them came from.
+func (settings *Settings) Show(config *Config) {
+	found := ""
+	if !config.Found {
+		found = " (not found)"
+	}
+	fmt.Printf("config: %s%s\n", config.Path, found)
+	for _, s := range settingList {
+		value := *s.field(settings)
+		if value == "" {
+			value = "-"
+		}
+		fmt.Printf("%-13s %-24s (%s)\n", s.name, value, settings.Sources[s.name])
+	}
+	images := make([]string, 0, len(settings.ImageUsers))
+	for image := range settings.ImageUsers {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	for _, image := range images {
+		fmt.Printf("image-user %s: %s\n", image, settings.ImageUsers[image])
+	}
+}
+
+// ConfiguredCloud creates a wrapper for the settings' environment in their region, with their SSH and jumphost
+// defaults, and their admin network when it is in another account. The net blocks of that one must be set, the
+// built in ones are for an admin network setup creates, and would only match another account's by chance.
+func ConfiguredCloud(settings *Settings) (*Cloud, error) {
+	cfg := &aws.Config{}
+	if settings.Region != "" {
+		cfg.Region = aws.String(settings.Region)
+	}
+	cloud := NewCloud(settings.Env, ec2.New(session.New(cfg)))
+	cloud.User = settings.User
+	cloud.Image = settings.Image
+	cloud.Type = settings.Type
+	cloud.Key = settings.Key
+	if settings.AdminAccount != "" {
+		for _, name := range []string{"admin-net", "bastion-net"} {
+			if settings.Sources[name] == "default" {
+				return nil, fmt.Errorf("The admin network of %s is in account %s, so %s must be set to its block", settings.Env, settings.AdminAccount, name)
+			}
+		}
+		cloud.RemoteAdmin = &RemoteAdmin{
+			Account:      settings.AdminAccount,
+			VpcId:        settings.AdminVpc,
+			NetBlock:     settings.AdminNet,
+			BastionBlock: settings.BastionNet,
+		}
+	}
+	for image, user := range settings.ImageUsers {
+		ImageUsers[image] = user
+	}
+	return cloud, nil
+}
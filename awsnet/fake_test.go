@@ -0,0 +1,1693 @@
+package awsnet
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const fakeOwnerId = "123456789012"
+
+// FakeEC2 is an in-memory model of the parts of EC2 that a Cloud uses: VPCs (with their default security group and
+// main route table), subnets (in three availability zones), security groups, internet gateways, route tables, NAT
+// gateways, elastic IPs, peering connections, instances, key pairs and tags. Instances move through pending -> running,
+// stopping -> stopped and shutting-down -> terminated, one step per DescribeInstances call, NAT gateways likewise
+// through pending -> available and deleting -> deleted, and deletes fail with DependencyViolation the way AWS does
+// when something still uses the resource.
+type FakeEC2 struct {
+	mu          sync.Mutex
+	nextId      int
+	vpcs        map[string]*ec2.Vpc
+	subnets     map[string]*ec2.Subnet
+	groups      map[string]*ec2.SecurityGroup
+	gateways    map[string]*ec2.InternetGateway
+	routeTables map[string]*ec2.RouteTable
+	addresses   map[string]*ec2.Address
+	peerings    map[string]*ec2.VpcPeeringConnection
+	instances   map[string]*ec2.Instance
+	keyPairs    map[string]*ec2.KeyPairInfo
+	natGateways map[string]*ec2.NatGateway
+	nextIp      map[string]uint32
+}
+
+func NewFakeEC2() *FakeEC2 {
+	return &FakeEC2{
+		vpcs:        make(map[string]*ec2.Vpc),
+		subnets:     make(map[string]*ec2.Subnet),
+		groups:      make(map[string]*ec2.SecurityGroup),
+		gateways:    make(map[string]*ec2.InternetGateway),
+		routeTables: make(map[string]*ec2.RouteTable),
+		addresses:   make(map[string]*ec2.Address),
+		peerings:    make(map[string]*ec2.VpcPeeringConnection),
+		instances:   make(map[string]*ec2.Instance),
+		keyPairs:    make(map[string]*ec2.KeyPairInfo),
+		natGateways: make(map[string]*ec2.NatGateway),
+		nextIp:      make(map[string]uint32),
+	}
+}
+
+// create a Cloud for the named environment that runs entirely against a fresh FakeEC2.
+func FakeCloud(name string) (*Cloud, *FakeEC2) {
+	fake := NewFakeEC2()
+	cloud := NewCloud(name, fake)
+	cloud.Offline = true
+	return cloud, fake
+}
+
+func (fake *FakeEC2) newId(prefix string) string {
+	fake.nextId++
+	return fmt.Sprintf("%s-%08x", prefix, fake.nextId)
+}
+
+func fakeError(code string, format string, args ...interface{}) error {
+	return fmt.Errorf("%s: %s", code, fmt.Sprintf(format, args...))
+}
+
+// clone deep-copies src into dst, so callers never share state with the fake, just as with real API responses.
+func clone(src interface{}, dst interface{}) {
+	b, _ := json.Marshal(src)
+	json.Unmarshal(b, dst)
+}
+
+// attrs holds the filterable attributes of a resource, keyed by EC2 filter name.
+type attrs map[string][]string
+
+func (a attrs) add(key string, values ...*string) {
+	for _, v := range values {
+		if v != nil {
+			a[key] = append(a[key], *v)
+		}
+	}
+}
+
+func tagAttrs(a attrs, tags []*ec2.Tag) attrs {
+	for _, tag := range tags {
+		a.add("tag:"+*tag.Key, tag.Value)
+		a.add("tag-key", tag.Key)
+	}
+	return a
+}
+
+// matches reports whether the attributes satisfy every filter. Filter names that are not in known (and are not
+// tag filters) are rejected, as AWS rejects them, so that typos in filter names surface in tests.
+func matches(filters []*ec2.Filter, a attrs, known ...string) (bool, error) {
+	for _, f := range filters {
+		name := *f.Name
+		if !strings.HasPrefix(name, "tag:") && name != "tag-key" {
+			ok := false
+			for _, k := range known {
+				if k == name {
+					ok = true
+					break
+				}
+			}
+			if !ok {
+				return false, fakeError("InvalidParameterValue", "The filter '%s' is invalid", name)
+			}
+		}
+		found := false
+		for _, want := range f.Values {
+			for _, have := range a[name] {
+				if *want == have {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func wanted(id string, ids []*string) bool {
+	if len(ids) == 0 {
+		return true
+	}
+	for _, s := range ids {
+		if *s == id {
+			return true
+		}
+	}
+	return false
+}
+
+// --- VPCs
+
+func (fake *FakeEC2) DescribeVpcs(in *ec2.DescribeVpcsInput) (*ec2.DescribeVpcsOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	out := &ec2.DescribeVpcsOutput{Vpcs: []*ec2.Vpc{}}
+	for _, id := range sortedKeys(fake.vpcs) {
+		vpc := fake.vpcs[id]
+		a := tagAttrs(attrs{}, vpc.Tags)
+		a.add("vpc-id", vpc.VpcId)
+		a.add("cidr", vpc.CidrBlock)
+		a.add("state", vpc.State)
+		a.add("owner-id", vpc.OwnerId)
+		ok, err := matches(in.Filters, a, "vpc-id", "cidr", "state", "owner-id")
+		if err != nil {
+			return nil, err
+		}
+		if ok && wanted(id, in.VpcIds) {
+			var v ec2.Vpc
+			clone(vpc, &v)
+			out.Vpcs = append(out.Vpcs, &v)
+		}
+		//a new VPC is reported as pending once, then becomes available
+		vpc.State = aws.String("available")
+	}
+	return out, nil
+}
+
+func (fake *FakeEC2) CreateVpc(in *ec2.CreateVpcInput) (*ec2.CreateVpcOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return fake.createVpc(in)
+}
+
+func (fake *FakeEC2) createVpc(in *ec2.CreateVpcInput) (*ec2.CreateVpcOutput, error) {
+	if _, _, err := net.ParseCIDR(aws.StringValue(in.CidrBlock)); err != nil {
+		return nil, fakeError("InvalidVpc.Range", "The CIDR '%s' is invalid", aws.StringValue(in.CidrBlock))
+	}
+	id := fake.newId("vpc")
+	vpc := &ec2.Vpc{
+		VpcId:           aws.String(id),
+		CidrBlock:       in.CidrBlock,
+		InstanceTenancy: in.InstanceTenancy,
+		OwnerId:         aws.String(fakeOwnerId),
+		State:           aws.String("pending"),
+		IsDefault:       aws.Bool(false),
+	}
+	fake.vpcs[id] = vpc
+	sgId := fake.newId("sg")
+	fake.groups[sgId] = &ec2.SecurityGroup{
+		GroupId:     aws.String(sgId),
+		GroupName:   aws.String("default"),
+		Description: aws.String("default VPC security group"),
+		VpcId:       vpc.VpcId,
+		OwnerId:     aws.String(fakeOwnerId),
+		IpPermissions: []*ec2.IpPermission{&ec2.IpPermission{
+			IpProtocol:       aws.String("-1"),
+			UserIdGroupPairs: []*ec2.UserIdGroupPair{&ec2.UserIdGroupPair{GroupId: aws.String(sgId), UserId: aws.String(fakeOwnerId)}},
+		}},
+		IpPermissionsEgress: []*ec2.IpPermission{&ec2.IpPermission{
+			IpProtocol: aws.String("-1"),
+			IpRanges:   []*ec2.IpRange{&ec2.IpRange{CidrIp: aws.String("0.0.0.0/0")}},
+		}},
+	}
+	rtId := fake.newId("rtb")
+	fake.routeTables[rtId] = &ec2.RouteTable{
+		RouteTableId: aws.String(rtId),
+		VpcId:        vpc.VpcId,
+		Routes: []*ec2.Route{&ec2.Route{
+			DestinationCidrBlock: in.CidrBlock,
+			GatewayId:            aws.String("local"),
+			State:                aws.String("active"),
+			Origin:               aws.String("CreateRouteTable"),
+		}},
+		Associations: []*ec2.RouteTableAssociation{&ec2.RouteTableAssociation{
+			RouteTableAssociationId: aws.String(fake.newId("rtbassoc")),
+			RouteTableId:            aws.String(rtId),
+			Main:                    aws.Bool(true),
+		}},
+	}
+	var v ec2.Vpc
+	clone(vpc, &v)
+	return &ec2.CreateVpcOutput{Vpc: &v}, nil
+}
+
+func (fake *FakeEC2) DeleteVpc(in *ec2.DeleteVpcInput) (*ec2.DeleteVpcOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	id := aws.StringValue(in.VpcId)
+	if _, ok := fake.vpcs[id]; !ok {
+		return nil, fakeError("InvalidVpcID.NotFound", "The vpc ID '%s' does not exist", id)
+	}
+	for _, subnet := range fake.subnets {
+		if *subnet.VpcId == id {
+			return nil, fakeError("DependencyViolation", "The vpc '%s' has dependencies and cannot be deleted", id)
+		}
+	}
+	for _, sg := range fake.groups {
+		if *sg.VpcId == id && *sg.GroupName != "default" {
+			return nil, fakeError("DependencyViolation", "The vpc '%s' has dependencies and cannot be deleted", id)
+		}
+	}
+	for _, gw := range fake.gateways {
+		for _, att := range gw.Attachments {
+			if *att.VpcId == id {
+				return nil, fakeError("DependencyViolation", "The vpc '%s' has dependencies and cannot be deleted", id)
+			}
+		}
+	}
+	for _, rt := range fake.routeTables {
+		if *rt.VpcId == id && !isMainRouteTable(rt) {
+			return nil, fakeError("DependencyViolation", "The vpc '%s' has dependencies and cannot be deleted", id)
+		}
+	}
+	for _, nat := range fake.natGateways {
+		if *nat.VpcId == id && *nat.State != "deleted" {
+			return nil, fakeError("DependencyViolation", "The vpc '%s' has dependencies and cannot be deleted", id)
+		}
+	}
+	for sgId, sg := range fake.groups {
+		if *sg.VpcId == id {
+			delete(fake.groups, sgId)
+		}
+	}
+	for rtId, rt := range fake.routeTables {
+		if *rt.VpcId == id {
+			delete(fake.routeTables, rtId)
+		}
+	}
+	for _, peering := range fake.peerings {
+		if *peering.RequesterVpcInfo.VpcId == id || *peering.AccepterVpcInfo.VpcId == id {
+			peering.Status = &ec2.VpcPeeringConnectionStateReason{Code: aws.String("deleted"), Message: aws.String("Deleted by " + fakeOwnerId)}
+		}
+	}
+	delete(fake.vpcs, id)
+	return &ec2.DeleteVpcOutput{}, nil
+}
+
+// --- tags
+
+func (fake *FakeEC2) tagsOf(id string) *[]*ec2.Tag {
+	if r, ok := fake.vpcs[id]; ok {
+		return &r.Tags
+	}
+	if r, ok := fake.subnets[id]; ok {
+		return &r.Tags
+	}
+	if r, ok := fake.groups[id]; ok {
+		return &r.Tags
+	}
+	if r, ok := fake.gateways[id]; ok {
+		return &r.Tags
+	}
+	if r, ok := fake.routeTables[id]; ok {
+		return &r.Tags
+	}
+	if r, ok := fake.addresses[id]; ok {
+		return &r.Tags
+	}
+	if r, ok := fake.peerings[id]; ok {
+		return &r.Tags
+	}
+	if r, ok := fake.instances[id]; ok {
+		return &r.Tags
+	}
+	if r, ok := fake.natGateways[id]; ok {
+		return &r.Tags
+	}
+	return nil
+}
+
+func (fake *FakeEC2) CreateTags(in *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for _, id := range in.Resources {
+		if fake.tagsOf(*id) == nil {
+			return nil, fakeError("InvalidID", "The ID '%s' is not valid", *id)
+		}
+	}
+	for _, id := range in.Resources {
+		tags := fake.tagsOf(*id)
+		for _, tag := range in.Tags {
+			replaced := false
+			for _, t := range *tags {
+				if *t.Key == *tag.Key {
+					t.Value = aws.String(aws.StringValue(tag.Value))
+					replaced = true
+				}
+			}
+			if !replaced {
+				*tags = append(*tags, &ec2.Tag{Key: aws.String(*tag.Key), Value: aws.String(aws.StringValue(tag.Value))})
+			}
+		}
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+// --- subnets
+
+func cidrRange(cidr string) (uint32, uint32, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return 0, 0, err
+	}
+	ones, bits := ipnet.Mask.Size()
+	first := binary.BigEndian.Uint32(ipnet.IP.To4())
+	return first, first + uint32(1)<<uint(bits-ones) - 1, nil
+}
+
+// the availability zones of the fake's region, where subnets can be created.
+var fakeAvailabilityZones = []string{"us-west-2a", "us-west-2b", "us-west-2c"}
+
+func (fake *FakeEC2) DescribeAvailabilityZones(in *ec2.DescribeAvailabilityZonesInput) (*ec2.DescribeAvailabilityZonesOutput, error) {
+	out := &ec2.DescribeAvailabilityZonesOutput{AvailabilityZones: []*ec2.AvailabilityZone{}}
+	for _, name := range fakeAvailabilityZones {
+		az := &ec2.AvailabilityZone{ZoneName: aws.String(name), State: aws.String("available"), RegionName: aws.String("us-west-2")}
+		a := attrs{}
+		a.add("zone-name", az.ZoneName)
+		a.add("state", az.State)
+		a.add("region-name", az.RegionName)
+		ok, err := matches(in.Filters, a, "zone-name", "state", "region-name")
+		if err != nil {
+			return nil, err
+		}
+		if ok && wanted(name, in.ZoneNames) {
+			out.AvailabilityZones = append(out.AvailabilityZones, az)
+		}
+	}
+	return out, nil
+}
+
+func (fake *FakeEC2) DescribeSubnets(in *ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	out := &ec2.DescribeSubnetsOutput{Subnets: []*ec2.Subnet{}}
+	for _, id := range sortedKeys(fake.subnets) {
+		subnet := fake.subnets[id]
+		a := tagAttrs(attrs{}, subnet.Tags)
+		a.add("subnet-id", subnet.SubnetId)
+		a.add("vpc-id", subnet.VpcId)
+		a.add("cidr-block", subnet.CidrBlock)
+		a.add("availability-zone", subnet.AvailabilityZone)
+		a.add("state", subnet.State)
+		ok, err := matches(in.Filters, a, "subnet-id", "vpc-id", "cidr-block", "availability-zone", "state")
+		if err != nil {
+			return nil, err
+		}
+		if ok && wanted(id, in.SubnetIds) {
+			var s ec2.Subnet
+			clone(subnet, &s)
+			out.Subnets = append(out.Subnets, &s)
+		}
+	}
+	return out, nil
+}
+
+func (fake *FakeEC2) CreateSubnet(in *ec2.CreateSubnetInput) (*ec2.CreateSubnetOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return fake.createSubnet(in)
+}
+
+func (fake *FakeEC2) createSubnet(in *ec2.CreateSubnetInput) (*ec2.CreateSubnetOutput, error) {
+	vpcId := aws.StringValue(in.VpcId)
+	vpc, ok := fake.vpcs[vpcId]
+	if !ok {
+		return nil, fakeError("InvalidVpcID.NotFound", "The vpc ID '%s' does not exist", vpcId)
+	}
+	cidr := aws.StringValue(in.CidrBlock)
+	lo, hi, err := cidrRange(cidr)
+	if err != nil {
+		return nil, fakeError("InvalidParameterValue", "Value (%s) for parameter cidrBlock is invalid", cidr)
+	}
+	vlo, vhi, _ := cidrRange(*vpc.CidrBlock)
+	if lo < vlo || hi > vhi {
+		return nil, fakeError("InvalidSubnet.Range", "The CIDR '%s' is invalid", cidr)
+	}
+	for _, other := range fake.subnets {
+		if *other.VpcId == vpcId {
+			olo, ohi, _ := cidrRange(*other.CidrBlock)
+			if lo <= ohi && olo <= hi {
+				return nil, fakeError("InvalidSubnet.Conflict", "The CIDR '%s' conflicts with another subnet", cidr)
+			}
+		}
+	}
+	az := aws.StringValue(in.AvailabilityZone)
+	if az == "" {
+		az = fakeAvailabilityZones[0]
+	} else if !wanted(az, aws.StringSlice(fakeAvailabilityZones)) {
+		return nil, fakeError("InvalidParameterValue", "Value (%s) for parameter availabilityZone is invalid", az)
+	}
+	id := fake.newId("subnet")
+	subnet := &ec2.Subnet{
+		SubnetId:                aws.String(id),
+		VpcId:                   in.VpcId,
+		CidrBlock:               aws.String(cidr),
+		AvailabilityZone:        aws.String(az),
+		AvailableIpAddressCount: aws.Int64(int64(hi-lo) - 4),
+		State:                   aws.String("available"),
+	}
+	fake.subnets[id] = subnet
+	fake.nextIp[id] = lo + 4 //AWS reserves the first four addresses in every subnet
+	var s ec2.Subnet
+	clone(subnet, &s)
+	return &ec2.CreateSubnetOutput{Subnet: &s}, nil
+}
+
+func (fake *FakeEC2) DeleteSubnet(in *ec2.DeleteSubnetInput) (*ec2.DeleteSubnetOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	id := aws.StringValue(in.SubnetId)
+	if _, ok := fake.subnets[id]; !ok {
+		return nil, fakeError("InvalidSubnetID.NotFound", "The subnet ID '%s' does not exist", id)
+	}
+	for _, inst := range fake.instances {
+		if aws.StringValue(inst.SubnetId) == id && *inst.State.Name != "terminated" {
+			return nil, fakeError("DependencyViolation", "The subnet '%s' has dependencies and cannot be deleted", id)
+		}
+	}
+	for _, nat := range fake.natGateways {
+		if *nat.SubnetId == id && *nat.State != "deleted" {
+			return nil, fakeError("DependencyViolation", "The subnet '%s' has dependencies and cannot be deleted", id)
+		}
+	}
+	for _, rt := range fake.routeTables {
+		assocs := make([]*ec2.RouteTableAssociation, 0)
+		for _, assoc := range rt.Associations {
+			if aws.StringValue(assoc.SubnetId) != id {
+				assocs = append(assocs, assoc)
+			}
+		}
+		rt.Associations = assocs
+	}
+	delete(fake.subnets, id)
+	delete(fake.nextIp, id)
+	return &ec2.DeleteSubnetOutput{}, nil
+}
+
+// --- security groups
+
+func (fake *FakeEC2) DescribeSecurityGroups(in *ec2.DescribeSecurityGroupsInput) (*ec2.DescribeSecurityGroupsOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	out := &ec2.DescribeSecurityGroupsOutput{SecurityGroups: []*ec2.SecurityGroup{}}
+	for _, id := range sortedKeys(fake.groups) {
+		sg := fake.groups[id]
+		a := tagAttrs(attrs{}, sg.Tags)
+		a.add("group-id", sg.GroupId)
+		a.add("group-name", sg.GroupName)
+		a.add("vpc-id", sg.VpcId)
+		a.add("owner-id", sg.OwnerId)
+		ok, err := matches(in.Filters, a, "group-id", "group-name", "vpc-id", "owner-id")
+		if err != nil {
+			return nil, err
+		}
+		if ok && wanted(id, in.GroupIds) {
+			var g ec2.SecurityGroup
+			clone(sg, &g)
+			out.SecurityGroups = append(out.SecurityGroups, &g)
+		}
+	}
+	return out, nil
+}
+
+func (fake *FakeEC2) CreateSecurityGroup(in *ec2.CreateSecurityGroupInput) (*ec2.CreateSecurityGroupOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	vpcId := aws.StringValue(in.VpcId)
+	if _, ok := fake.vpcs[vpcId]; !ok {
+		return nil, fakeError("InvalidVpcID.NotFound", "The vpc ID '%s' does not exist", vpcId)
+	}
+	for _, sg := range fake.groups {
+		if *sg.VpcId == vpcId && *sg.GroupName == aws.StringValue(in.GroupName) {
+			return nil, fakeError("InvalidGroup.Duplicate", "The security group '%s' already exists for VPC '%s'", *sg.GroupName, vpcId)
+		}
+	}
+	id := fake.newId("sg")
+	fake.groups[id] = &ec2.SecurityGroup{
+		GroupId:     aws.String(id),
+		GroupName:   in.GroupName,
+		Description: in.Description,
+		VpcId:       in.VpcId,
+		OwnerId:     aws.String(fakeOwnerId),
+		IpPermissionsEgress: []*ec2.IpPermission{&ec2.IpPermission{
+			IpProtocol: aws.String("-1"),
+			IpRanges:   []*ec2.IpRange{&ec2.IpRange{CidrIp: aws.String("0.0.0.0/0")}},
+		}},
+	}
+	return &ec2.CreateSecurityGroupOutput{GroupId: aws.String(id)}, nil
+}
+
+func (fake *FakeEC2) DeleteSecurityGroup(in *ec2.DeleteSecurityGroupInput) (*ec2.DeleteSecurityGroupOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	id := aws.StringValue(in.GroupId)
+	sg, ok := fake.groups[id]
+	if !ok {
+		return nil, fakeError("InvalidGroup.NotFound", "The security group '%s' does not exist", id)
+	}
+	if *sg.GroupName == "default" {
+		return nil, fakeError("CannotDelete", "the specified group: \"%s\" name: \"default\" cannot be deleted by a user", id)
+	}
+	for _, inst := range fake.instances {
+		if *inst.State.Name != "terminated" {
+			for _, g := range inst.SecurityGroups {
+				if *g.GroupId == id {
+					return nil, fakeError("DependencyViolation", "resource %s has a dependent object", id)
+				}
+			}
+		}
+	}
+	delete(fake.groups, id)
+	return &ec2.DeleteSecurityGroupOutput{}, nil
+}
+
+// samePermission compares two rules the way AWS does: ports are irrelevant when the protocol is "-1" (all traffic).
+func samePermission(p1 *ec2.IpPermission, p2 *ec2.IpPermission) bool {
+	proto := aws.StringValue(p1.IpProtocol)
+	if proto != aws.StringValue(p2.IpProtocol) {
+		return false
+	}
+	if proto != "-1" && (aws.Int64Value(p1.FromPort) != aws.Int64Value(p2.FromPort) || aws.Int64Value(p1.ToPort) != aws.Int64Value(p2.ToPort)) {
+		return false
+	}
+	if len(p1.IpRanges) != len(p2.IpRanges) || len(p1.UserIdGroupPairs) != len(p2.UserIdGroupPairs) {
+		return false
+	}
+	for i, r := range p1.IpRanges {
+		if aws.StringValue(r.CidrIp) != aws.StringValue(p2.IpRanges[i].CidrIp) {
+			return false
+		}
+	}
+	for i, g := range p1.UserIdGroupPairs {
+		if aws.StringValue(g.GroupId) != aws.StringValue(p2.UserIdGroupPairs[i].GroupId) {
+			return false
+		}
+	}
+	return true
+}
+
+func permissions(cidr *string, protocol *string, from *int64, to *int64, perms []*ec2.IpPermission) []*ec2.IpPermission {
+	if cidr == nil {
+		return perms
+	}
+	return []*ec2.IpPermission{&ec2.IpPermission{
+		IpProtocol: protocol,
+		FromPort:   from,
+		ToPort:     to,
+		IpRanges:   []*ec2.IpRange{&ec2.IpRange{CidrIp: cidr}},
+	}}
+}
+
+func (fake *FakeEC2) authorize(groupId *string, egress bool, perms []*ec2.IpPermission) error {
+	id := aws.StringValue(groupId)
+	sg, ok := fake.groups[id]
+	if !ok {
+		return fakeError("InvalidGroup.NotFound", "The security group '%s' does not exist", id)
+	}
+	existing := &sg.IpPermissions
+	if egress {
+		existing = &sg.IpPermissionsEgress
+	}
+	for _, p := range perms {
+		for _, e := range *existing {
+			if samePermission(p, e) {
+				return fakeError("InvalidPermission.Duplicate", "the specified rule already exists")
+			}
+		}
+	}
+	for _, p := range perms {
+		var c ec2.IpPermission
+		clone(p, &c)
+		*existing = append(*existing, &c)
+	}
+	return nil
+}
+
+func (fake *FakeEC2) revoke(groupId *string, egress bool, perms []*ec2.IpPermission) error {
+	id := aws.StringValue(groupId)
+	sg, ok := fake.groups[id]
+	if !ok {
+		return fakeError("InvalidGroup.NotFound", "The security group '%s' does not exist", id)
+	}
+	existing := &sg.IpPermissions
+	if egress {
+		existing = &sg.IpPermissionsEgress
+	}
+	for _, p := range perms {
+		kept := make([]*ec2.IpPermission, 0)
+		found := false
+		for _, e := range *existing {
+			if samePermission(p, e) {
+				found = true
+			} else {
+				kept = append(kept, e)
+			}
+		}
+		if !found {
+			return fakeError("InvalidPermission.NotFound", "The specified rule does not exist in this security group")
+		}
+		*existing = kept
+	}
+	return nil
+}
+
+func (fake *FakeEC2) AuthorizeSecurityGroupIngress(in *ec2.AuthorizeSecurityGroupIngressInput) (*ec2.AuthorizeSecurityGroupIngressOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	err := fake.authorize(in.GroupId, false, permissions(in.CidrIp, in.IpProtocol, in.FromPort, in.ToPort, in.IpPermissions))
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.AuthorizeSecurityGroupIngressOutput{}, nil
+}
+
+func (fake *FakeEC2) AuthorizeSecurityGroupEgress(in *ec2.AuthorizeSecurityGroupEgressInput) (*ec2.AuthorizeSecurityGroupEgressOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	err := fake.authorize(in.GroupId, true, permissions(in.CidrIp, in.IpProtocol, in.FromPort, in.ToPort, in.IpPermissions))
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.AuthorizeSecurityGroupEgressOutput{}, nil
+}
+
+func (fake *FakeEC2) RevokeSecurityGroupEgress(in *ec2.RevokeSecurityGroupEgressInput) (*ec2.RevokeSecurityGroupEgressOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	err := fake.revoke(in.GroupId, true, permissions(in.CidrIp, in.IpProtocol, in.FromPort, in.ToPort, in.IpPermissions))
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.RevokeSecurityGroupEgressOutput{}, nil
+}
+
+// --- internet gateways
+
+func (fake *FakeEC2) DescribeInternetGateways(in *ec2.DescribeInternetGatewaysInput) (*ec2.DescribeInternetGatewaysOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	out := &ec2.DescribeInternetGatewaysOutput{InternetGateways: []*ec2.InternetGateway{}}
+	for _, id := range sortedKeys(fake.gateways) {
+		gw := fake.gateways[id]
+		a := tagAttrs(attrs{}, gw.Tags)
+		a.add("internet-gateway-id", gw.InternetGatewayId)
+		for _, att := range gw.Attachments {
+			a.add("attachment.vpc-id", att.VpcId)
+			a.add("attachment.state", att.State)
+		}
+		ok, err := matches(in.Filters, a, "internet-gateway-id", "attachment.vpc-id", "attachment.state")
+		if err != nil {
+			return nil, err
+		}
+		if ok && wanted(id, in.InternetGatewayIds) {
+			var g ec2.InternetGateway
+			clone(gw, &g)
+			out.InternetGateways = append(out.InternetGateways, &g)
+		}
+	}
+	return out, nil
+}
+
+func (fake *FakeEC2) CreateInternetGateway(in *ec2.CreateInternetGatewayInput) (*ec2.CreateInternetGatewayOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	id := fake.newId("igw")
+	gw := &ec2.InternetGateway{InternetGatewayId: aws.String(id), Attachments: []*ec2.InternetGatewayAttachment{}}
+	fake.gateways[id] = gw
+	var g ec2.InternetGateway
+	clone(gw, &g)
+	return &ec2.CreateInternetGatewayOutput{InternetGateway: &g}, nil
+}
+
+func (fake *FakeEC2) AttachInternetGateway(in *ec2.AttachInternetGatewayInput) (*ec2.AttachInternetGatewayOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	id := aws.StringValue(in.InternetGatewayId)
+	gw, ok := fake.gateways[id]
+	if !ok {
+		return nil, fakeError("InvalidInternetGatewayID.NotFound", "The internetGateway ID '%s' does not exist", id)
+	}
+	if _, ok := fake.vpcs[aws.StringValue(in.VpcId)]; !ok {
+		return nil, fakeError("InvalidVpcID.NotFound", "The vpc ID '%s' does not exist", aws.StringValue(in.VpcId))
+	}
+	if len(gw.Attachments) > 0 {
+		return nil, fakeError("Resource.AlreadyAssociated", "resource %s is already attached to network %s", id, *gw.Attachments[0].VpcId)
+	}
+	gw.Attachments = append(gw.Attachments, &ec2.InternetGatewayAttachment{VpcId: in.VpcId, State: aws.String("available")})
+	return &ec2.AttachInternetGatewayOutput{}, nil
+}
+
+func (fake *FakeEC2) DetachInternetGateway(in *ec2.DetachInternetGatewayInput) (*ec2.DetachInternetGatewayOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	id := aws.StringValue(in.InternetGatewayId)
+	gw, ok := fake.gateways[id]
+	if !ok {
+		return nil, fakeError("InvalidInternetGatewayID.NotFound", "The internetGateway ID '%s' does not exist", id)
+	}
+	if len(gw.Attachments) == 0 || *gw.Attachments[0].VpcId != aws.StringValue(in.VpcId) {
+		return nil, fakeError("Gateway.NotAttached", "resource %s is not attached to network %s", id, aws.StringValue(in.VpcId))
+	}
+	gw.Attachments = []*ec2.InternetGatewayAttachment{}
+	return &ec2.DetachInternetGatewayOutput{}, nil
+}
+
+func (fake *FakeEC2) DeleteInternetGateway(in *ec2.DeleteInternetGatewayInput) (*ec2.DeleteInternetGatewayOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	id := aws.StringValue(in.InternetGatewayId)
+	gw, ok := fake.gateways[id]
+	if !ok {
+		return nil, fakeError("InvalidInternetGatewayID.NotFound", "The internetGateway ID '%s' does not exist", id)
+	}
+	if len(gw.Attachments) > 0 {
+		return nil, fakeError("DependencyViolation", "The internetGateway '%s' has dependencies and cannot be deleted", id)
+	}
+	delete(fake.gateways, id)
+	return &ec2.DeleteInternetGatewayOutput{}, nil
+}
+
+// --- route tables
+
+func (fake *FakeEC2) DescribeRouteTables(in *ec2.DescribeRouteTablesInput) (*ec2.DescribeRouteTablesOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	out := &ec2.DescribeRouteTablesOutput{RouteTables: []*ec2.RouteTable{}}
+	for _, id := range sortedKeys(fake.routeTables) {
+		rt := fake.routeTables[id]
+		a := tagAttrs(attrs{}, rt.Tags)
+		a.add("route-table-id", rt.RouteTableId)
+		a.add("vpc-id", rt.VpcId)
+		for _, assoc := range rt.Associations {
+			a.add("association.subnet-id", assoc.SubnetId)
+			a.add("association.route-table-association-id", assoc.RouteTableAssociationId)
+			if aws.BoolValue(assoc.Main) {
+				a.add("association.main", aws.String("true"))
+			}
+		}
+		if !isMainRouteTable(rt) {
+			a.add("association.main", aws.String("false"))
+		}
+		for _, route := range rt.Routes {
+			a.add("route.destination-cidr-block", route.DestinationCidrBlock)
+			a.add("route.vpc-peering-connection-id", route.VpcPeeringConnectionId)
+			a.add("route.gateway-id", route.GatewayId)
+			a.add("route.nat-gateway-id", route.NatGatewayId)
+		}
+		ok, err := matches(in.Filters, a, "route-table-id", "vpc-id", "association.subnet-id", "association.route-table-association-id",
+			"association.main", "route.destination-cidr-block", "route.vpc-peering-connection-id", "route.gateway-id", "route.nat-gateway-id")
+		if err != nil {
+			return nil, err
+		}
+		if ok && wanted(id, in.RouteTableIds) {
+			var r ec2.RouteTable
+			clone(rt, &r)
+			out.RouteTables = append(out.RouteTables, &r)
+		}
+	}
+	return out, nil
+}
+
+func (fake *FakeEC2) CreateRoute(in *ec2.CreateRouteInput) (*ec2.CreateRouteOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	id := aws.StringValue(in.RouteTableId)
+	rt, ok := fake.routeTables[id]
+	if !ok {
+		return nil, fakeError("InvalidRouteTableID.NotFound", "The routeTable ID '%s' does not exist", id)
+	}
+	dest := aws.StringValue(in.DestinationCidrBlock)
+	if _, _, err := net.ParseCIDR(dest); err != nil {
+		return nil, fakeError("InvalidParameterValue", "Value (%s) for parameter destinationCidrBlock is invalid", dest)
+	}
+	for _, route := range rt.Routes {
+		if *route.DestinationCidrBlock == dest {
+			return nil, fakeError("RouteAlreadyExists", "The route identified by %s already exists", dest)
+		}
+	}
+	err := fake.checkRouteTarget(rt, in.GatewayId, in.InstanceId, in.NatGatewayId, in.VpcPeeringConnectionId)
+	if err != nil {
+		return nil, err
+	}
+	rt.Routes = append(rt.Routes, &ec2.Route{
+		DestinationCidrBlock:   aws.String(dest),
+		GatewayId:              in.GatewayId,
+		InstanceId:             in.InstanceId,
+		NatGatewayId:           in.NatGatewayId,
+		VpcPeeringConnectionId: in.VpcPeeringConnectionId,
+		State:                  fake.routeState(in.VpcPeeringConnectionId),
+		Origin:                 aws.String("CreateRoute"),
+	})
+	return &ec2.CreateRouteOutput{Return: aws.Bool(true)}, nil
+}
+
+// checkRouteTarget makes sure what a route in the table goes to exists, and can be routed to from the table's VPC.
+func (fake *FakeEC2) checkRouteTarget(rt *ec2.RouteTable, gatewayId *string, instanceId *string, natGatewayId *string, peeringId *string) error {
+	n := 0
+	for _, target := range []*string{gatewayId, instanceId, natGatewayId, peeringId} {
+		if target != nil {
+			n++
+		}
+	}
+	if n != 1 {
+		return fakeError("InvalidParameterCombination", "The route must have exactly one target")
+	}
+	if gatewayId != nil {
+		gw, ok := fake.gateways[*gatewayId]
+		if !ok {
+			return fakeError("InvalidGatewayID.NotFound", "The gateway ID '%s' does not exist", *gatewayId)
+		}
+		if len(gw.Attachments) == 0 || *gw.Attachments[0].VpcId != *rt.VpcId {
+			return fakeError("InvalidParameterValue", "route table %s and network gateway %s belong to different networks", *rt.RouteTableId, *gatewayId)
+		}
+	}
+	if natGatewayId != nil {
+		nat, ok := fake.natGateways[*natGatewayId]
+		if !ok || *nat.State == "deleted" {
+			return fakeError("InvalidNatGatewayID.NotFound", "The nat gateway ID '%s' does not exist", *natGatewayId)
+		}
+		if *nat.VpcId != *rt.VpcId {
+			return fakeError("InvalidParameterValue", "route table %s and nat gateway %s belong to different networks", *rt.RouteTableId, *natGatewayId)
+		}
+	}
+	if peeringId != nil {
+		peering, ok := fake.peerings[*peeringId]
+		if !ok {
+			return fakeError("InvalidVpcPeeringConnectionID.NotFound", "The vpcPeeringConnection ID '%s' does not exist", *peeringId)
+		}
+		switch *peering.Status.Code {
+		case "active", "pending-acceptance":
+		default:
+			return fakeError("InvalidParameterValue", "The vpc peering connection %s is not active", *peeringId)
+		}
+	}
+	if instanceId != nil {
+		inst, ok := fake.instances[*instanceId]
+		if !ok {
+			return fakeError("InvalidInstanceID.NotFound", "The instance ID '%s' does not exist", *instanceId)
+		}
+		if aws.StringValue(inst.VpcId) != *rt.VpcId {
+			return fakeError("InvalidParameterValue", "route table %s and instance %s belong to different networks", *rt.RouteTableId, *instanceId)
+		}
+	}
+	return nil
+}
+
+// routeState is the state of a route to the target: a route to a peering that is not accepted yet goes nowhere.
+func (fake *FakeEC2) routeState(peeringId *string) *string {
+	if peeringId != nil && *fake.peerings[*peeringId].Status.Code != "active" {
+		return aws.String("blackhole")
+	}
+	return aws.String("active")
+}
+
+func (fake *FakeEC2) ReplaceRoute(in *ec2.ReplaceRouteInput) (*ec2.ReplaceRouteOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	id := aws.StringValue(in.RouteTableId)
+	rt, ok := fake.routeTables[id]
+	if !ok {
+		return nil, fakeError("InvalidRouteTableID.NotFound", "The routeTable ID '%s' does not exist", id)
+	}
+	dest := aws.StringValue(in.DestinationCidrBlock)
+	for _, route := range rt.Routes {
+		if *route.DestinationCidrBlock == dest {
+			if aws.StringValue(route.GatewayId) == "local" {
+				return nil, fakeError("InvalidParameterValue", "cannot replace local route %s in route table %s", dest, id)
+			}
+			err := fake.checkRouteTarget(rt, in.GatewayId, in.InstanceId, in.NatGatewayId, in.VpcPeeringConnectionId)
+			if err != nil {
+				return nil, err
+			}
+			route.GatewayId = in.GatewayId
+			route.InstanceId = in.InstanceId
+			route.NatGatewayId = in.NatGatewayId
+			route.VpcPeeringConnectionId = in.VpcPeeringConnectionId
+			route.State = fake.routeState(in.VpcPeeringConnectionId)
+			route.Origin = aws.String("CreateRoute")
+			return &ec2.ReplaceRouteOutput{}, nil
+		}
+	}
+	return nil, fakeError("InvalidRoute.NotFound", "no route with destination-cidr-block %s in route table %s", dest, id)
+}
+
+func (fake *FakeEC2) DeleteRoute(in *ec2.DeleteRouteInput) (*ec2.DeleteRouteOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	id := aws.StringValue(in.RouteTableId)
+	rt, ok := fake.routeTables[id]
+	if !ok {
+		return nil, fakeError("InvalidRouteTableID.NotFound", "The routeTable ID '%s' does not exist", id)
+	}
+	dest := aws.StringValue(in.DestinationCidrBlock)
+	for i, route := range rt.Routes {
+		if *route.DestinationCidrBlock == dest {
+			if aws.StringValue(route.GatewayId) == "local" {
+				return nil, fakeError("InvalidParameterValue", "cannot remove local route %s in route table %s", dest, id)
+			}
+			rt.Routes = append(rt.Routes[:i], rt.Routes[i+1:]...)
+			return &ec2.DeleteRouteOutput{}, nil
+		}
+	}
+	return nil, fakeError("InvalidRoute.NotFound", "no route with destination-cidr-block %s in route table %s", dest, id)
+}
+
+func (fake *FakeEC2) CreateRouteTable(in *ec2.CreateRouteTableInput) (*ec2.CreateRouteTableOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	vpc, ok := fake.vpcs[aws.StringValue(in.VpcId)]
+	if !ok {
+		return nil, fakeError("InvalidVpcID.NotFound", "The vpc ID '%s' does not exist", aws.StringValue(in.VpcId))
+	}
+	id := fake.newId("rtb")
+	rt := &ec2.RouteTable{
+		RouteTableId: aws.String(id),
+		VpcId:        vpc.VpcId,
+		Routes: []*ec2.Route{&ec2.Route{
+			DestinationCidrBlock: vpc.CidrBlock,
+			GatewayId:            aws.String("local"),
+			State:                aws.String("active"),
+			Origin:               aws.String("CreateRouteTable"),
+		}},
+		Associations: []*ec2.RouteTableAssociation{},
+	}
+	fake.routeTables[id] = rt
+	var r ec2.RouteTable
+	clone(rt, &r)
+	return &ec2.CreateRouteTableOutput{RouteTable: &r}, nil
+}
+
+func (fake *FakeEC2) DeleteRouteTable(in *ec2.DeleteRouteTableInput) (*ec2.DeleteRouteTableOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	id := aws.StringValue(in.RouteTableId)
+	rt, ok := fake.routeTables[id]
+	if !ok {
+		return nil, fakeError("InvalidRouteTableID.NotFound", "The routeTable ID '%s' does not exist", id)
+	}
+	if len(rt.Associations) > 0 {
+		return nil, fakeError("DependencyViolation", "The routeTable '%s' has dependencies and cannot be deleted", id)
+	}
+	delete(fake.routeTables, id)
+	return &ec2.DeleteRouteTableOutput{}, nil
+}
+
+func (fake *FakeEC2) AssociateRouteTable(in *ec2.AssociateRouteTableInput) (*ec2.AssociateRouteTableOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	id := aws.StringValue(in.RouteTableId)
+	rt, ok := fake.routeTables[id]
+	if !ok {
+		return nil, fakeError("InvalidRouteTableID.NotFound", "The routeTable ID '%s' does not exist", id)
+	}
+	subnetId := aws.StringValue(in.SubnetId)
+	subnet, ok := fake.subnets[subnetId]
+	if !ok {
+		return nil, fakeError("InvalidSubnetID.NotFound", "The subnet ID '%s' does not exist", subnetId)
+	}
+	if *subnet.VpcId != *rt.VpcId {
+		return nil, fakeError("InvalidParameterValue", "route table %s and subnet %s belong to different networks", id, subnetId)
+	}
+	for _, other := range fake.routeTables {
+		for _, assoc := range other.Associations {
+			if aws.StringValue(assoc.SubnetId) == subnetId {
+				return nil, fakeError("Resource.AlreadyAssociated", "the specified association for route table %s conflicts with an existing association", id)
+			}
+		}
+	}
+	assocId := fake.newId("rtbassoc")
+	rt.Associations = append(rt.Associations, &ec2.RouteTableAssociation{
+		RouteTableAssociationId: aws.String(assocId),
+		RouteTableId:            rt.RouteTableId,
+		SubnetId:                subnet.SubnetId,
+		Main:                    aws.Bool(false),
+	})
+	return &ec2.AssociateRouteTableOutput{AssociationId: aws.String(assocId)}, nil
+}
+
+func (fake *FakeEC2) DisassociateRouteTable(in *ec2.DisassociateRouteTableInput) (*ec2.DisassociateRouteTableOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	id := aws.StringValue(in.AssociationId)
+	for _, rt := range fake.routeTables {
+		for i, assoc := range rt.Associations {
+			if *assoc.RouteTableAssociationId == id {
+				if aws.BoolValue(assoc.Main) {
+					return nil, fakeError("InvalidParameterValue", "cannot disassociate the main route table association %s", id)
+				}
+				rt.Associations = append(rt.Associations[:i], rt.Associations[i+1:]...)
+				return &ec2.DisassociateRouteTableOutput{}, nil
+			}
+		}
+	}
+	return nil, fakeError("InvalidAssociationID.NotFound", "The association ID '%s' does not exist", id)
+}
+
+// --- NAT gateways
+
+func (fake *FakeEC2) DescribeNatGateways(in *ec2.DescribeNatGatewaysInput) (*ec2.DescribeNatGatewaysOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	out := &ec2.DescribeNatGatewaysOutput{NatGateways: []*ec2.NatGateway{}}
+	for _, id := range sortedKeys(fake.natGateways) {
+		nat := fake.natGateways[id]
+		a := tagAttrs(attrs{}, nat.Tags)
+		a.add("nat-gateway-id", nat.NatGatewayId)
+		a.add("state", nat.State)
+		a.add("subnet-id", nat.SubnetId)
+		a.add("vpc-id", nat.VpcId)
+		ok, err := matches(in.Filter, a, "nat-gateway-id", "state", "subnet-id", "vpc-id")
+		if err != nil {
+			return nil, err
+		}
+		if ok && wanted(id, in.NatGatewayIds) {
+			var n ec2.NatGateway
+			clone(nat, &n)
+			out.NatGateways = append(out.NatGateways, &n)
+		}
+		fake.advanceNat(nat)
+	}
+	return out, nil
+}
+
+// advanceNat moves a NAT gateway out of a transitional state, like advance does for instances. A deleted one lets go
+// of its elastic IP.
+func (fake *FakeEC2) advanceNat(nat *ec2.NatGateway) {
+	switch *nat.State {
+	case "pending":
+		nat.State = aws.String("available")
+	case "deleting":
+		nat.State = aws.String("deleted")
+		for _, addr := range fake.addresses {
+			if aws.StringValue(addr.NetworkInterfaceId) == aws.StringValue(nat.NatGatewayAddresses[0].NetworkInterfaceId) {
+				fake.disassociate(addr)
+			}
+		}
+	}
+}
+
+func (fake *FakeEC2) CreateNatGateway(in *ec2.CreateNatGatewayInput) (*ec2.CreateNatGatewayOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	subnetId := aws.StringValue(in.SubnetId)
+	subnet, ok := fake.subnets[subnetId]
+	if !ok {
+		return nil, fakeError("InvalidSubnetID.NotFound", "The subnet ID '%s' does not exist", subnetId)
+	}
+	allocId := aws.StringValue(in.AllocationId)
+	addr, ok := fake.addresses[allocId]
+	if !ok {
+		return nil, fakeError("InvalidAllocationID.NotFound", "The allocation ID '%s' does not exist", allocId)
+	}
+	if addr.AssociationId != nil {
+		return nil, fakeError("Resource.AlreadyAssociated", "Elastic IP address [%s] is already associated", allocId)
+	}
+	_, hi, _ := cidrRange(*subnet.CidrBlock)
+	if fake.nextIp[subnetId] >= hi {
+		return nil, fakeError("InsufficientFreeAddressesInSubnet", "Not enough free addresses in subnet '%s'", subnetId)
+	}
+	ipBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(ipBytes, fake.nextIp[subnetId])
+	fake.nextIp[subnetId]++
+	eni := fake.newId("eni")
+	addr.AssociationId = aws.String(fake.newId("eipassoc"))
+	addr.NetworkInterfaceId = aws.String(eni)
+	addr.PrivateIpAddress = aws.String(net.IP(ipBytes).String())
+	id := fake.newId("nat")
+	nat := &ec2.NatGateway{
+		NatGatewayId: aws.String(id),
+		SubnetId:     subnet.SubnetId,
+		VpcId:        subnet.VpcId,
+		State:        aws.String("pending"),
+		NatGatewayAddresses: []*ec2.NatGatewayAddress{&ec2.NatGatewayAddress{
+			AllocationId:       addr.AllocationId,
+			NetworkInterfaceId: aws.String(eni),
+			PrivateIp:          addr.PrivateIpAddress,
+			PublicIp:           addr.PublicIp,
+		}},
+	}
+	fake.natGateways[id] = nat
+	var n ec2.NatGateway
+	clone(nat, &n)
+	return &ec2.CreateNatGatewayOutput{NatGateway: &n}, nil
+}
+
+func (fake *FakeEC2) DeleteNatGateway(in *ec2.DeleteNatGatewayInput) (*ec2.DeleteNatGatewayOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	id := aws.StringValue(in.NatGatewayId)
+	nat, ok := fake.natGateways[id]
+	if !ok || *nat.State == "deleted" {
+		return nil, fakeError("NatGatewayNotFound", "The Nat Gateway %s was not found", id)
+	}
+	nat.State = aws.String("deleting")
+	//routes through it stay, as blackholes
+	for _, rt := range fake.routeTables {
+		for _, route := range rt.Routes {
+			if aws.StringValue(route.NatGatewayId) == id {
+				route.State = aws.String("blackhole")
+			}
+		}
+	}
+	return &ec2.DeleteNatGatewayOutput{NatGatewayId: aws.String(id)}, nil
+}
+
+// --- elastic IPs
+
+func (fake *FakeEC2) DescribeAddresses(in *ec2.DescribeAddressesInput) (*ec2.DescribeAddressesOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	out := &ec2.DescribeAddressesOutput{Addresses: []*ec2.Address{}}
+	for _, id := range sortedKeys(fake.addresses) {
+		addr := fake.addresses[id]
+		a := tagAttrs(attrs{}, addr.Tags)
+		a.add("allocation-id", addr.AllocationId)
+		a.add("association-id", addr.AssociationId)
+		a.add("domain", addr.Domain)
+		a.add("instance-id", addr.InstanceId)
+		a.add("public-ip", addr.PublicIp)
+		a.add("private-ip-address", addr.PrivateIpAddress)
+		ok, err := matches(in.Filters, a, "allocation-id", "association-id", "domain", "instance-id", "public-ip", "private-ip-address")
+		if err != nil {
+			return nil, err
+		}
+		if ok && wanted(id, in.AllocationIds) {
+			var r ec2.Address
+			clone(addr, &r)
+			out.Addresses = append(out.Addresses, &r)
+		}
+	}
+	return out, nil
+}
+
+func (fake *FakeEC2) AllocateAddress(in *ec2.AllocateAddressInput) (*ec2.AllocateAddressOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	id := fake.newId("eipalloc")
+	ip := fmt.Sprintf("54.200.%d.%d", (fake.nextId>>8)&0xff, fake.nextId&0xff)
+	fake.addresses[id] = &ec2.Address{AllocationId: aws.String(id), Domain: aws.String(ec2.DomainTypeVpc), PublicIp: aws.String(ip)}
+	return &ec2.AllocateAddressOutput{AllocationId: aws.String(id), Domain: aws.String(ec2.DomainTypeVpc), PublicIp: aws.String(ip)}, nil
+}
+
+func (fake *FakeEC2) AssociateAddress(in *ec2.AssociateAddressInput) (*ec2.AssociateAddressOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	id := aws.StringValue(in.AllocationId)
+	addr, ok := fake.addresses[id]
+	if !ok {
+		return nil, fakeError("InvalidAllocationID.NotFound", "The allocation ID '%s' does not exist", id)
+	}
+	instId := aws.StringValue(in.InstanceId)
+	inst, ok := fake.instances[instId]
+	if !ok || *inst.State.Name == "terminated" {
+		return nil, fakeError("InvalidInstanceID.NotFound", "The instance ID '%s' does not exist", instId)
+	}
+	if addr.AssociationId != nil && !aws.BoolValue(in.AllowReassociation) {
+		return nil, fakeError("Resource.AlreadyAssociated", "resource %s is already associated", id)
+	}
+	fake.disassociate(addr)
+	addr.AssociationId = aws.String(fake.newId("eipassoc"))
+	addr.InstanceId = inst.InstanceId
+	addr.PrivateIpAddress = inst.PrivateIpAddress
+	inst.PublicIpAddress = addr.PublicIp
+	return &ec2.AssociateAddressOutput{AssociationId: addr.AssociationId}, nil
+}
+
+func (fake *FakeEC2) disassociate(addr *ec2.Address) {
+	if addr.InstanceId != nil {
+		if inst, ok := fake.instances[*addr.InstanceId]; ok {
+			inst.PublicIpAddress = nil
+		}
+	}
+	addr.AssociationId = nil
+	addr.InstanceId = nil
+	addr.NetworkInterfaceId = nil
+	addr.PrivateIpAddress = nil
+}
+
+func (fake *FakeEC2) DisassociateAddress(in *ec2.DisassociateAddressInput) (*ec2.DisassociateAddressOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	id := aws.StringValue(in.AssociationId)
+	for _, addr := range fake.addresses {
+		if aws.StringValue(addr.AssociationId) == id {
+			fake.disassociate(addr)
+			return &ec2.DisassociateAddressOutput{}, nil
+		}
+	}
+	return nil, fakeError("InvalidAssociationID.NotFound", "The association ID '%s' does not exist", id)
+}
+
+func (fake *FakeEC2) ReleaseAddress(in *ec2.ReleaseAddressInput) (*ec2.ReleaseAddressOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	id := aws.StringValue(in.AllocationId)
+	addr, ok := fake.addresses[id]
+	if !ok {
+		return nil, fakeError("InvalidAllocationID.NotFound", "The allocation ID '%s' does not exist", id)
+	}
+	if addr.AssociationId != nil {
+		return nil, fakeError("InvalidIPAddress.InUse", "Address %s is in use", *addr.PublicIp)
+	}
+	delete(fake.addresses, id)
+	return &ec2.ReleaseAddressOutput{}, nil
+}
+
+// --- peering
+
+func (fake *FakeEC2) DescribeVpcPeeringConnections(in *ec2.DescribeVpcPeeringConnectionsInput) (*ec2.DescribeVpcPeeringConnectionsOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	out := &ec2.DescribeVpcPeeringConnectionsOutput{VpcPeeringConnections: []*ec2.VpcPeeringConnection{}}
+	for _, id := range sortedKeys(fake.peerings) {
+		peering := fake.peerings[id]
+		a := tagAttrs(attrs{}, peering.Tags)
+		a.add("vpc-peering-connection-id", peering.VpcPeeringConnectionId)
+		a.add("status-code", peering.Status.Code)
+		a.add("requester-vpc-info.vpc-id", peering.RequesterVpcInfo.VpcId)
+		a.add("requester-vpc-info.cidr-block", peering.RequesterVpcInfo.CidrBlock)
+		a.add("requester-vpc-info.owner-id", peering.RequesterVpcInfo.OwnerId)
+		a.add("accepter-vpc-info.vpc-id", peering.AccepterVpcInfo.VpcId)
+		a.add("accepter-vpc-info.cidr-block", peering.AccepterVpcInfo.CidrBlock)
+		a.add("accepter-vpc-info.owner-id", peering.AccepterVpcInfo.OwnerId)
+		ok, err := matches(in.Filters, a, "vpc-peering-connection-id", "status-code",
+			"requester-vpc-info.vpc-id", "requester-vpc-info.cidr-block", "requester-vpc-info.owner-id",
+			"accepter-vpc-info.vpc-id", "accepter-vpc-info.cidr-block", "accepter-vpc-info.owner-id")
+		if err != nil {
+			return nil, err
+		}
+		if ok && wanted(id, in.VpcPeeringConnectionIds) {
+			var p ec2.VpcPeeringConnection
+			clone(peering, &p)
+			out.VpcPeeringConnections = append(out.VpcPeeringConnections, &p)
+		}
+	}
+	return out, nil
+}
+
+func (fake *FakeEC2) CreateVpcPeeringConnection(in *ec2.CreateVpcPeeringConnectionInput) (*ec2.CreateVpcPeeringConnectionOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	requester, ok := fake.vpcs[aws.StringValue(in.VpcId)]
+	if !ok {
+		return nil, fakeError("InvalidVpcID.NotFound", "The vpc ID '%s' does not exist", aws.StringValue(in.VpcId))
+	}
+	accepter, ok := fake.vpcs[aws.StringValue(in.PeerVpcId)]
+	if !ok {
+		return nil, fakeError("InvalidVpcID.NotFound", "The vpc ID '%s' does not exist", aws.StringValue(in.PeerVpcId))
+	}
+	if in.PeerOwnerId != nil && *in.PeerOwnerId != aws.StringValue(accepter.OwnerId) {
+		return nil, fakeError("InvalidVpcID.NotFound", "The vpc ID '%s' does not exist in account %s", *in.PeerVpcId, *in.PeerOwnerId)
+	}
+	rlo, rhi, _ := cidrRange(*requester.CidrBlock)
+	alo, ahi, _ := cidrRange(*accepter.CidrBlock)
+	if rlo <= ahi && alo <= rhi {
+		return nil, fakeError("InvalidParameterValue", "The CIDR of the peer VPC overlaps with that of the requester")
+	}
+	id := fake.newId("pcx")
+	peering := &ec2.VpcPeeringConnection{
+		VpcPeeringConnectionId: aws.String(id),
+		RequesterVpcInfo:       &ec2.VpcPeeringConnectionVpcInfo{VpcId: requester.VpcId, CidrBlock: requester.CidrBlock, OwnerId: requester.OwnerId},
+		AccepterVpcInfo:        &ec2.VpcPeeringConnectionVpcInfo{VpcId: accepter.VpcId, CidrBlock: accepter.CidrBlock, OwnerId: accepter.OwnerId},
+		Status:                 &ec2.VpcPeeringConnectionStateReason{Code: aws.String("pending-acceptance"), Message: aws.String("Pending Acceptance by " + fakeOwnerId)},
+	}
+	fake.peerings[id] = peering
+	var p ec2.VpcPeeringConnection
+	clone(peering, &p)
+	return &ec2.CreateVpcPeeringConnectionOutput{VpcPeeringConnection: &p}, nil
+}
+
+func (fake *FakeEC2) AcceptVpcPeeringConnection(in *ec2.AcceptVpcPeeringConnectionInput) (*ec2.AcceptVpcPeeringConnectionOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	id := aws.StringValue(in.VpcPeeringConnectionId)
+	peering, ok := fake.peerings[id]
+	if !ok {
+		return nil, fakeError("InvalidVpcPeeringConnectionID.NotFound", "The vpcPeeringConnection ID '%s' does not exist", id)
+	}
+	if *peering.Status.Code != "pending-acceptance" {
+		return nil, fakeError("InvalidStateTransition", "Invalid state transition for pcx %s, attempted to transition from %s to active", id, *peering.Status.Code)
+	}
+	peering.Status = &ec2.VpcPeeringConnectionStateReason{Code: aws.String("active"), Message: aws.String("Active")}
+	for _, rt := range fake.routeTables {
+		for _, route := range rt.Routes {
+			if aws.StringValue(route.VpcPeeringConnectionId) == id {
+				route.State = aws.String("active")
+			}
+		}
+	}
+	var p ec2.VpcPeeringConnection
+	clone(peering, &p)
+	return &ec2.AcceptVpcPeeringConnectionOutput{VpcPeeringConnection: &p}, nil
+}
+
+func (fake *FakeEC2) RejectVpcPeeringConnection(in *ec2.RejectVpcPeeringConnectionInput) (*ec2.RejectVpcPeeringConnectionOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	id := aws.StringValue(in.VpcPeeringConnectionId)
+	peering, ok := fake.peerings[id]
+	if !ok {
+		return nil, fakeError("InvalidVpcPeeringConnectionID.NotFound", "The vpcPeeringConnection ID '%s' does not exist", id)
+	}
+	if *peering.Status.Code != "pending-acceptance" {
+		return nil, fakeError("InvalidStateTransition", "Invalid state transition for pcx %s, attempted to transition from %s to rejected", id, *peering.Status.Code)
+	}
+	peering.Status = &ec2.VpcPeeringConnectionStateReason{Code: aws.String("rejected"), Message: aws.String("Rejected by " + fakeOwnerId)}
+	return &ec2.RejectVpcPeeringConnectionOutput{Return: aws.Bool(true)}, nil
+}
+
+func (fake *FakeEC2) DeleteVpcPeeringConnection(in *ec2.DeleteVpcPeeringConnectionInput) (*ec2.DeleteVpcPeeringConnectionOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	id := aws.StringValue(in.VpcPeeringConnectionId)
+	peering, ok := fake.peerings[id]
+	if !ok || *peering.Status.Code == "deleted" {
+		return nil, fakeError("InvalidVpcPeeringConnectionID.NotFound", "The vpcPeeringConnection ID '%s' does not exist", id)
+	}
+	//deleted peerings stay visible for a while, and routes that used them become blackholes
+	peering.Status = &ec2.VpcPeeringConnectionStateReason{Code: aws.String("deleted"), Message: aws.String("Deleted by " + fakeOwnerId)}
+	for _, rt := range fake.routeTables {
+		for _, route := range rt.Routes {
+			if aws.StringValue(route.VpcPeeringConnectionId) == id {
+				route.State = aws.String("blackhole")
+			}
+		}
+	}
+	return &ec2.DeleteVpcPeeringConnectionOutput{Return: aws.Bool(true)}, nil
+}
+
+// --- key pairs
+
+func (fake *FakeEC2) DescribeKeyPairs(in *ec2.DescribeKeyPairsInput) (*ec2.DescribeKeyPairsOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for _, name := range in.KeyNames {
+		if _, ok := fake.keyPairs[aws.StringValue(name)]; !ok {
+			return nil, fakeError("InvalidKeyPair.NotFound", "The key pair '%s' does not exist", aws.StringValue(name))
+		}
+	}
+	out := &ec2.DescribeKeyPairsOutput{KeyPairs: []*ec2.KeyPairInfo{}}
+	for _, name := range sortedKeys(fake.keyPairs) {
+		kp := fake.keyPairs[name]
+		a := attrs{}
+		a.add("key-name", kp.KeyName)
+		a.add("fingerprint", kp.KeyFingerprint)
+		a.add("key-pair-id", kp.KeyPairId)
+		ok, err := matches(in.Filters, a, "key-name", "fingerprint", "key-pair-id")
+		if err != nil {
+			return nil, err
+		}
+		if ok && wanted(name, in.KeyNames) {
+			var r ec2.KeyPairInfo
+			clone(kp, &r)
+			out.KeyPairs = append(out.KeyPairs, &r)
+		}
+	}
+	return out, nil
+}
+
+func (fake *FakeEC2) addKeyPair(name string, pub ssh.PublicKey) (*ec2.KeyPairInfo, error) {
+	if _, ok := fake.keyPairs[name]; ok {
+		return nil, fakeError("InvalidKeyPair.Duplicate", "The keypair '%s' already exists", name)
+	}
+	kp := &ec2.KeyPairInfo{
+		KeyName:        aws.String(name),
+		KeyFingerprint: aws.String(strings.TrimPrefix(ssh.FingerprintLegacyMD5(pub), "MD5:")),
+		KeyPairId:      aws.String(fake.newId("key")),
+	}
+	fake.keyPairs[name] = kp
+	return kp, nil
+}
+
+// CreateKeyPair makes a real (ed25519) key, so that the private key material it returns can be used.
+func (fake *FakeEC2) CreateKeyPair(in *ec2.CreateKeyPairInput) (*ec2.CreateKeyPairOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		return nil, err
+	}
+	kp, err := fake.addKeyPair(aws.StringValue(in.KeyName), sshPub)
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.CreateKeyPairOutput{
+		KeyName:        kp.KeyName,
+		KeyFingerprint: kp.KeyFingerprint,
+		KeyPairId:      kp.KeyPairId,
+		KeyMaterial:    aws.String(string(pem.EncodeToMemory(block))),
+	}, nil
+}
+
+func (fake *FakeEC2) ImportKeyPair(in *ec2.ImportKeyPairInput) (*ec2.ImportKeyPairOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(in.PublicKeyMaterial)
+	if err != nil {
+		return nil, fakeError("InvalidKey.Format", "Key is not in valid OpenSSH public key format")
+	}
+	kp, err := fake.addKeyPair(aws.StringValue(in.KeyName), pub)
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.ImportKeyPairOutput{KeyName: kp.KeyName, KeyFingerprint: kp.KeyFingerprint, KeyPairId: kp.KeyPairId}, nil
+}
+
+// DeleteKeyPair succeeds whether or not the key pair exists, as EC2's does.
+func (fake *FakeEC2) DeleteKeyPair(in *ec2.DeleteKeyPairInput) (*ec2.DeleteKeyPairOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	delete(fake.keyPairs, aws.StringValue(in.KeyName))
+	return &ec2.DeleteKeyPairOutput{}, nil
+}
+
+// --- instances
+
+func (fake *FakeEC2) DescribeInstances(in *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	out := &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{}}
+	for _, id := range sortedKeys(fake.instances) {
+		inst := fake.instances[id]
+		a := tagAttrs(attrs{}, inst.Tags)
+		a.add("instance-id", inst.InstanceId)
+		a.add("instance-state-name", inst.State.Name)
+		a.add("subnet-id", inst.SubnetId)
+		a.add("vpc-id", inst.VpcId)
+		a.add("image-id", inst.ImageId)
+		a.add("key-name", inst.KeyName)
+		a.add("private-ip-address", inst.PrivateIpAddress)
+		a.add("ip-address", inst.PublicIpAddress)
+		ok, err := matches(in.Filters, a, "instance-id", "instance-state-name", "subnet-id", "vpc-id", "image-id", "key-name",
+			"private-ip-address", "ip-address")
+		if err != nil {
+			return nil, err
+		}
+		if ok && wanted(id, in.InstanceIds) {
+			var i ec2.Instance
+			clone(inst, &i)
+			out.Reservations = append(out.Reservations, &ec2.Reservation{OwnerId: aws.String(fakeOwnerId), Instances: []*ec2.Instance{&i}})
+		}
+		fake.advance(inst)
+	}
+	return out, nil
+}
+
+// advance moves an instance out of a transitional state, so that each one is observed exactly once.
+func (fake *FakeEC2) advance(inst *ec2.Instance) {
+	switch *inst.State.Name {
+	case "pending":
+		inst.State = &ec2.InstanceState{Code: aws.Int64(16), Name: aws.String("running")}
+	case "shutting-down":
+		inst.State = &ec2.InstanceState{Code: aws.Int64(48), Name: aws.String("terminated")}
+	case "stopping":
+		inst.State = &ec2.InstanceState{Code: aws.Int64(80), Name: aws.String("stopped")}
+	}
+}
+
+func (fake *FakeEC2) RunInstances(in *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	subnetId := aws.StringValue(in.SubnetId)
+	if subnetId == "" {
+		subnetId = fake.defaultSubnet()
+	}
+	subnet, ok := fake.subnets[subnetId]
+	if !ok {
+		return nil, fakeError("InvalidSubnetID.NotFound", "The subnet ID '%s' does not exist", subnetId)
+	}
+	if aws.StringValue(in.ImageId) == "" {
+		return nil, fakeError("MissingParameter", "The request must contain the parameter ImageId")
+	}
+	groups := make([]*ec2.GroupIdentifier, 0)
+	for _, sgId := range in.SecurityGroupIds {
+		sg, ok := fake.groups[aws.StringValue(sgId)]
+		if !ok || *sg.VpcId != *subnet.VpcId {
+			return nil, fakeError("InvalidGroup.NotFound", "The security group '%s' does not exist in VPC '%s'", aws.StringValue(sgId), *subnet.VpcId)
+		}
+		groups = append(groups, &ec2.GroupIdentifier{GroupId: sg.GroupId, GroupName: sg.GroupName})
+	}
+	if len(groups) == 0 {
+		for _, sg := range fake.groups {
+			if *sg.VpcId == *subnet.VpcId && *sg.GroupName == "default" {
+				groups = append(groups, &ec2.GroupIdentifier{GroupId: sg.GroupId, GroupName: sg.GroupName})
+			}
+		}
+	}
+	count := int(aws.Int64Value(in.MinCount))
+	if count < 1 {
+		count = 1
+	}
+	rez := &ec2.Reservation{ReservationId: aws.String(fake.newId("r")), OwnerId: aws.String(fakeOwnerId), Instances: []*ec2.Instance{}}
+	now := time.Now()
+	for i := 0; i < count; i++ {
+		_, hi, _ := cidrRange(*subnet.CidrBlock)
+		if fake.nextIp[subnetId] >= hi {
+			return nil, fakeError("InsufficientFreeAddressesInSubnet", "Not enough free addresses in subnet '%s'", subnetId)
+		}
+		ipBytes := make([]byte, 4)
+		binary.BigEndian.PutUint32(ipBytes, fake.nextIp[subnetId])
+		fake.nextIp[subnetId]++
+		privateIp := net.IP(ipBytes).String()
+		id := fake.newId("i")
+		inst := &ec2.Instance{
+			InstanceId:       aws.String(id),
+			ImageId:          in.ImageId,
+			InstanceType:     in.InstanceType,
+			KeyName:          in.KeyName,
+			SubnetId:         subnet.SubnetId,
+			VpcId:            subnet.VpcId,
+			PrivateIpAddress: aws.String(privateIp),
+			PrivateDnsName:   aws.String("ip-" + strings.Replace(privateIp, ".", "-", -1) + ".us-west-2.compute.internal"),
+			LaunchTime:       &now,
+			Placement:        &ec2.Placement{AvailabilityZone: subnet.AvailabilityZone},
+			SecurityGroups:   groups,
+			State:            &ec2.InstanceState{Code: aws.Int64(0), Name: aws.String("pending")},
+		}
+		fake.instances[id] = inst
+		var c ec2.Instance
+		clone(inst, &c)
+		rez.Instances = append(rez.Instances, &c)
+	}
+	return rez, nil
+}
+
+// defaultSubnet returns the subnet of the region's default VPC, where instances launched without a subnet go. Like
+// the rest of the fake, the default VPC is created lazily.
+func (fake *FakeEC2) defaultSubnet() string {
+	for id, subnet := range fake.subnets {
+		if aws.BoolValue(fake.vpcs[*subnet.VpcId].IsDefault) {
+			return id
+		}
+	}
+	vpc, _ := fake.createVpc(&ec2.CreateVpcInput{CidrBlock: aws.String("172.31.0.0/16"), InstanceTenancy: aws.String("default")})
+	subnet, _ := fake.createSubnet(&ec2.CreateSubnetInput{VpcId: vpc.Vpc.VpcId, CidrBlock: aws.String("172.31.0.0/20")})
+	fake.vpcs[*vpc.Vpc.VpcId].IsDefault = aws.Bool(true)
+	fake.vpcs[*vpc.Vpc.VpcId].State = aws.String("available")
+	return *subnet.Subnet.SubnetId
+}
+
+func (fake *FakeEC2) TerminateInstances(in *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for _, id := range in.InstanceIds {
+		if _, ok := fake.instances[aws.StringValue(id)]; !ok {
+			return nil, fakeError("InvalidInstanceID.NotFound", "The instance ID '%s' does not exist", aws.StringValue(id))
+		}
+	}
+	out := &ec2.TerminateInstancesOutput{TerminatingInstances: []*ec2.InstanceStateChange{}}
+	for _, id := range in.InstanceIds {
+		inst := fake.instances[*id]
+		prev := inst.State
+		if *inst.State.Name != "terminated" {
+			inst.State = &ec2.InstanceState{Code: aws.Int64(32), Name: aws.String("shutting-down")}
+		}
+		for _, addr := range fake.addresses {
+			if aws.StringValue(addr.InstanceId) == *id {
+				fake.disassociate(addr)
+			}
+		}
+		out.TerminatingInstances = append(out.TerminatingInstances, &ec2.InstanceStateChange{InstanceId: inst.InstanceId, PreviousState: prev, CurrentState: inst.State})
+	}
+	return out, nil
+}
+
+func (fake *FakeEC2) StartInstances(in *ec2.StartInstancesInput) (*ec2.StartInstancesOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for _, id := range in.InstanceIds {
+		inst, ok := fake.instances[aws.StringValue(id)]
+		if !ok {
+			return nil, fakeError("InvalidInstanceID.NotFound", "The instance ID '%s' does not exist", aws.StringValue(id))
+		}
+		state := *inst.State.Name
+		if state != "stopped" && state != "pending" && state != "running" {
+			return nil, fakeError("IncorrectInstanceState", "The instance '%s' is not in a state from which it can be started", *id)
+		}
+	}
+	out := &ec2.StartInstancesOutput{StartingInstances: []*ec2.InstanceStateChange{}}
+	for _, id := range in.InstanceIds {
+		inst := fake.instances[*id]
+		prev := inst.State
+		if *inst.State.Name == "stopped" {
+			inst.State = &ec2.InstanceState{Code: aws.Int64(0), Name: aws.String("pending")}
+		}
+		out.StartingInstances = append(out.StartingInstances, &ec2.InstanceStateChange{InstanceId: inst.InstanceId, PreviousState: prev, CurrentState: inst.State})
+	}
+	return out, nil
+}
+
+func (fake *FakeEC2) StopInstances(in *ec2.StopInstancesInput) (*ec2.StopInstancesOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for _, id := range in.InstanceIds {
+		inst, ok := fake.instances[aws.StringValue(id)]
+		if !ok {
+			return nil, fakeError("InvalidInstanceID.NotFound", "The instance ID '%s' does not exist", aws.StringValue(id))
+		}
+		state := *inst.State.Name
+		if state == "terminated" || state == "shutting-down" {
+			return nil, fakeError("IncorrectInstanceState", "The instance '%s' is not in a state from which it can be stopped", *id)
+		}
+	}
+	out := &ec2.StopInstancesOutput{StoppingInstances: []*ec2.InstanceStateChange{}}
+	for _, id := range in.InstanceIds {
+		inst := fake.instances[*id]
+		prev := inst.State
+		if *inst.State.Name == "running" || *inst.State.Name == "pending" {
+			inst.State = &ec2.InstanceState{Code: aws.Int64(64), Name: aws.String("stopping")}
+			inst.PublicIpAddress = nil
+			for _, addr := range fake.addresses {
+				if aws.StringValue(addr.InstanceId) == *id {
+					inst.PublicIpAddress = addr.PublicIp //an EIP stays associated with a stopped instance
+				}
+			}
+		}
+		out.StoppingInstances = append(out.StoppingInstances, &ec2.InstanceStateChange{InstanceId: inst.InstanceId, PreviousState: prev, CurrentState: inst.State})
+	}
+	return out, nil
+}
+
+// GetConsoleOutput reports no output, as for an instance that has not finished booting.
+func (fake *FakeEC2) GetConsoleOutput(in *ec2.GetConsoleOutputInput) (*ec2.GetConsoleOutputOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if _, ok := fake.instances[aws.StringValue(in.InstanceId)]; !ok {
+		return nil, fakeError("InvalidInstanceID.NotFound", "The instance ID '%s' does not exist", aws.StringValue(in.InstanceId))
+	}
+	return &ec2.GetConsoleOutputOutput{InstanceId: in.InstanceId}, nil
+}
@@ -0,0 +1,184 @@
+package awsnet
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Selector picks machines in the environment. Empty fields match anything.
+type Selector struct {
+	Network string //i.e. "myapp"
+	Zone    string //i.e. "fe"
+	Name    string //a glob matched against the machine's name within the environment, i.e. "myapp.web*"
+}
+
+// SelectMachines returns the running (or pending) machines in the environment that the selector matches.
+func (cloud *Cloud) SelectMachines(sel Selector) ([]*Machine, error) {
+	all, err := cloud.ListMachines()
+	if err != nil {
+		return nil, err
+	}
+	var subnets map[string]bool
+	if sel.Zone != "" {
+		res, err := cloud.ec2.DescribeSubnets(&ec2.DescribeSubnetsInput{Filters: []*ec2.Filter{filter("tag:Env", cloud.Name)}})
+		if err != nil {
+			return nil, err
+		}
+		subnets = make(map[string]bool)
+		for _, sn := range res.Subnets {
+			if strings.HasSuffix(findTag(sn.Tags, "Name"), "."+sel.Zone) {
+				subnets[aws.StringValue(sn.SubnetId)] = true
+			}
+		}
+	}
+	prefix := cloud.Name + "."
+	lst := make([]*Machine, 0, len(all))
+	for _, m := range all {
+		if sel.Network != "" && m.Network != prefix+sel.Network && m.Network != sel.Network {
+			continue
+		}
+		if subnets != nil && !subnets[m.SubnetId()] {
+			continue
+		}
+		if sel.Name != "" {
+			short, _ := path.Match(sel.Name, strings.TrimPrefix(m.Name, prefix))
+			full, _ := path.Match(sel.Name, m.Name)
+			if !short && !full {
+				continue
+			}
+		}
+		lst = append(lst, m)
+	}
+	return lst, nil
+}
+
+// ExecResult is the outcome of running a command on one machine with ExecAll.
+type ExecResult struct {
+	Machine string  `json:"machine"`
+	Id      string  `json:"id"`
+	Status  int     `json:"status"` //the command's exit status, or -1 when it never ran, or didn't report one
+	Error   string  `json:"error,omitempty"`
+	Seconds float64 `json:"seconds"`
+}
+
+// ExecAll runs the command on every machine, at most parallel of them at a time, with each line of their output
+// prefixed by the machine's name, as is the echo of each connection (on stderr). The results are in the same order as
+// the machines. Machines behind the jumphost share a single connection to it.
+func (cloud *Cloud) ExecAll(machines []*Machine, keyname string, parallel int, stdout io.Writer, stderr io.Writer, remoteCommand ...string) []*ExecResult {
+	if parallel < 1 {
+		parallel = 1
+	}
+	width := 0
+	for _, m := range machines {
+		if len(m.Name) > width {
+			width = len(m.Name)
+		}
+	}
+	var outLock sync.Mutex
+	var jump *Conn
+	var jumpErr error
+	var jumpOnce sync.Once
+	defer func() {
+		if jump != nil {
+			jump.Close()
+		}
+	}()
+	results := make([]*ExecResult, len(machines))
+	sem := make(chan bool, parallel)
+	var wg sync.WaitGroup
+	for i, m := range machines {
+		wg.Add(1)
+		sem <- true
+		go func(i int, m *Machine) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			start := time.Now()
+			res := &ExecResult{Machine: m.Name, Id: m.Id(), Status: -1}
+			results[i] = res
+			prefix := fmt.Sprintf("%-*s | ", width, m.Name)
+			out := &prefixWriter{lock: &outLock, out: stdout, prefix: prefix}
+			errOut := &prefixWriter{lock: &outLock, out: stderr, prefix: prefix}
+			var conn *Conn
+			var err error
+			if m.Network == "" || m.isJumphost() {
+				conn, err = cloud.dial(m.ec2Instance, keyname, errOut)
+			} else {
+				jumpOnce.Do(func() {
+					jump, jumpErr = cloud.connectJumphost(keyname, errOut)
+				})
+				err = jumpErr
+				if err == nil {
+					conn, err = cloud.dialThrough(jump, m.ec2Instance, keyname, errOut)
+				}
+				if conn != nil {
+					conn.jump = nil //shared, closed once everything is done
+				}
+			}
+			if err == nil {
+				err = conn.Run(commandLine(remoteCommand), nil, out, errOut)
+				conn.Close()
+			}
+			out.Flush()
+			errOut.Flush()
+			res.Seconds = time.Since(start).Seconds()
+			if err == nil {
+				res.Status = 0
+			} else if e, ok := err.(*ExitError); ok {
+				res.Status = e.Status
+				res.Error = e.Error()
+			} else {
+				res.Error = err.Error()
+			}
+			if err != nil {
+				errOut.Write([]byte(res.Error + "\n"))
+				errOut.Flush()
+			}
+		}(i, m)
+	}
+	wg.Wait()
+	return results
+}
+
+// prefixWriter writes whole lines, each one prefixed, to a writer shared with other goroutines.
+type prefixWriter struct {
+	lock   *sync.Mutex
+	out    io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (w *prefixWriter) Write(b []byte) (int, error) {
+	w.buf = append(w.buf, b...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		w.writeLine(w.buf[:i+1])
+		w.buf = w.buf[i+1:]
+	}
+}
+
+// Flush writes out a last line that had no newline.
+func (w *prefixWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.writeLine(append(w.buf, '\n'))
+		w.buf = nil
+	}
+}
+
+func (w *prefixWriter) writeLine(line []byte) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	io.WriteString(w.out, w.prefix)
+	w.out.Write(line)
+}
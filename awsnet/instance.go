@@ -0,0 +1,141 @@
+package awsnet
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Standalone machines live outside of any environment's networks (i.e. in the region's default VPC), and are
+// identified only by their Name tag. This is what the ec2 tool manages.
+
+// FindStandaloneMachine returns the running (or pending) machine with exactly the given Name tag, or nil.
+func (cloud *Cloud) FindStandaloneMachine(name string) (*Machine, error) {
+	req := &ec2.DescribeInstancesInput{Filters: []*ec2.Filter{filter("tag:Name", name)}}
+	res, err := cloud.ec2.DescribeInstances(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, rez := range res.Reservations {
+		for _, inst := range rez.Instances {
+			state := *inst.State.Name
+			if state == "pending" || state == "running" {
+				return cloud.newMachine(inst), nil
+			} //treat "stopping", "stopped", "terminating", and "terminated" as nonexistent
+		}
+	}
+	return nil, nil
+}
+
+// LaunchStandaloneMachine launches a machine in the default VPC and tags it with the given name. It does not wait
+// for the machine to be running.
+func (cloud *Cloud) LaunchStandaloneMachine(name string, keyname string, instanceImage string, instanceType string) (*Machine, error) {
+	if keyname == "" {
+		keyname = DefaultKeyName
+	}
+	runResult, err := cloud.ec2.RunInstances(&ec2.RunInstancesInput{
+		ImageId:      aws.String(instanceImage),
+		InstanceType: aws.String(instanceType),
+		KeyName:      aws.String(keyname),
+		MinCount:     aws.Int64(1),
+		MaxCount:     aws.Int64(1),
+	})
+	if err != nil {
+		return nil, err
+	}
+	inst := runResult.Instances[0]
+	tags := []*ec2.Tag{
+		&ec2.Tag{Key: aws.String("Name"), Value: aws.String(name)},
+		&ec2.Tag{Key: aws.String("User"), Value: aws.String(cloud.imageUser(instanceImage))},
+		&ec2.Tag{Key: aws.String("Key"), Value: aws.String(keyname)},
+	}
+	_, err = cloud.ec2.CreateTags(&ec2.CreateTagsInput{Resources: []*string{inst.InstanceId}, Tags: tags})
+	if err != nil {
+		return nil, err
+	}
+	inst.Tags = tags
+	return cloud.newMachine(inst), nil
+}
+
+// State returns the machine's instance state as last fetched, i.e. "pending" or "running".
+func (machine *Machine) State() string {
+	return *machine.ec2Instance.State.Name
+}
+
+func (machine *Machine) ImageId() string {
+	return aws.StringValue(machine.ec2Instance.ImageId)
+}
+
+func (machine *Machine) InstanceType() string {
+	return aws.StringValue(machine.ec2Instance.InstanceType)
+}
+
+func (machine *Machine) KeyName() string {
+	return aws.StringValue(machine.ec2Instance.KeyName)
+}
+
+// SubnetId returns the id of the subnet, i.e. the Zone, that the machine was launched in.
+func (machine *Machine) SubnetId() string {
+	return aws.StringValue(machine.ec2Instance.SubnetId)
+}
+
+func (machine *Machine) PublicDnsName() string {
+	tmp := machine.ec2Instance.PublicDnsName
+	if tmp == nil {
+		return ""
+	}
+	return *tmp
+}
+
+// Refresh fetches the current state of the machine's instance.
+func (machine *Machine) Refresh() error {
+	inst, err := machine.Cloud.getInstance(machine.Id())
+	if err != nil {
+		return err
+	}
+	if inst == nil {
+		return fmt.Errorf("Cannot refresh: instance '%s' disappeared", machine.Id())
+	}
+	machine.ec2Instance = inst
+	return nil
+}
+
+// WaitForRunning waits for a pending machine to be running.
+func (machine *Machine) WaitForRunning() error {
+	err := machine.Cloud.waitForInstanceState(machine.ec2Instance, "running")
+	if err != nil {
+		return err
+	}
+	return machine.Refresh()
+}
+
+// WaitForSSH waits until the machine accepts SSH connections with the given key.
+func (machine *Machine) WaitForSSH(keyname string) error {
+	return machine.Cloud.waitForInstance(machine.ec2Instance, keyname)
+}
+
+// Start the machine if it is stopped (or stopping), and wait for it to be running.
+func (machine *Machine) Start() error {
+	cloud := machine.Cloud
+	err := cloud.waitForInstanceState(machine.ec2Instance, "stopped")
+	if err != nil {
+		return err
+	}
+	_, err = cloud.ec2.StartInstances(&ec2.StartInstancesInput{InstanceIds: []*string{machine.ec2Instance.InstanceId}})
+	if err != nil {
+		return err
+	}
+	err = cloud.waitForInstanceState(machine.ec2Instance, "running")
+	if err != nil {
+		return err
+	}
+	if !Quiet {
+		fmt.Printf("Started instance %s (%s)\n", machine.Name, machine.Id())
+	}
+	return machine.Refresh()
+}
+
+// Terminate the machine, and wait for it to be gone.
+func (machine *Machine) Terminate() error {
+	return machine.Cloud.terminateInstance(machine.ec2Instance)
+}
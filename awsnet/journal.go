@@ -0,0 +1,250 @@
+package awsnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Setup, CreateNetwork, creating zones and launching machines each create a series of resources, any of which can
+// fail. Each resource is recorded in a journal as soon as it exists, and when the operation fails partway the journal
+// is unwound, removing them again newest first. Whatever cannot be removed (or everything, with KeepPartial set) is
+// saved to JournalPath, for Rollback to finish later. Nothing else can be done in the environment until then, but
+// the failed operation itself can be run again, to resume it, when it is one that converges, like Setup.
+
+// a Journal is the resources an operation in the environment has created so far, in order.
+type Journal struct {
+	Env     string          `json:"env"`
+	Op      string          `json:"op"`
+	Started time.Time       `json:"started"`
+	Error   string          `json:"error,omitempty"` //why the operation failed
+	Entries []*JournalEntry `json:"entries"`
+}
+
+// a JournalEntry is one created resource, or one thing done to another (an attachment, an association, a route).
+type JournalEntry struct {
+	Kind   string `json:"kind"`
+	Id     string `json:"id"`               //for a route, its destination
+	Parent string `json:"parent,omitempty"` //the VPC a gateway is attached to, the route table a route is in
+	Name   string `json:"name,omitempty"`
+}
+
+func (e *JournalEntry) String() string {
+	s := e.Kind + " " + e.Id
+	if e.Parent != "" {
+		s += " in " + e.Parent
+	}
+	if e.Name != "" {
+		s += " (" + e.Name + ")"
+	}
+	return s
+}
+
+// JournalPath returns where the environment's unfinished journal is saved.
+func (cloud *Cloud) JournalPath() string {
+	return filepath.Join(filepath.Dir(ConfigPath()), "journal", cloud.Name+".json")
+}
+
+// record notes a resource the current operation created. Outside of an operation, there is nothing to note.
+func (cloud *Cloud) record(kind string, id string, parent string, name string) {
+	if cloud.journal != nil {
+		cloud.journal.Entries = append(cloud.journal.Entries, &JournalEntry{Kind: kind, Id: id, Parent: parent, Name: name})
+	}
+}
+
+// convergingOps are the operations that find what they already created, and create only what is missing, so that
+// running one again after it failed picks up where it left off. The others would trip over their own leftovers.
+var convergingOps = map[string]bool{"setup": true, "make-private": true}
+
+// journaled runs the operation with a journal, unwinding what it created if it fails. An operation that is part of
+// another one shares its journal, and leaves the unwinding to it.
+func (cloud *Cloud) journaled(op string, fn func() error) error {
+	if cloud.journal != nil {
+		return fn()
+	}
+	pending, err := cloud.LoadJournal()
+	if err != nil {
+		return err
+	}
+	journal := &Journal{Env: cloud.Name, Op: op, Started: time.Now().UTC()}
+	if pending != nil {
+		if pending.Op != op {
+			return fmt.Errorf("The failed %s in %s was not rolled back yet (see %s)", pending.Op, cloud.Name, cloud.JournalPath())
+		}
+		if !convergingOps[strings.Fields(op)[0]] {
+			return fmt.Errorf("The failed %s in %s cannot be resumed, run 'vpc rollback' first (see %s)", op, cloud.Name, cloud.JournalPath())
+		}
+		//running the same operation again picks up where it left off, and takes over its journal
+		if !Quiet {
+			fmt.Printf("Resuming the %s that failed: %s\n", op, pending.Error)
+		}
+		journal = pending
+		journal.Error = ""
+	}
+	cloud.journal = journal
+	err = fn()
+	cloud.journal = nil
+	if err == nil {
+		if pending != nil {
+			return cloud.saveJournal(&Journal{}) //finished, nothing left to roll back
+		}
+		return nil
+	}
+	if len(journal.Entries) == 0 {
+		return err
+	}
+	journal.Error = err.Error()
+	if !cloud.KeepPartial {
+		if !Quiet {
+			fmt.Printf("The %s failed, removing what it created: %v\n", op, err)
+		}
+		uerr := cloud.unwind(journal)
+		if uerr == nil {
+			return err
+		}
+		fmt.Printf("Cannot finish removing what the %s created: %v\n", op, uerr)
+	}
+	serr := cloud.saveJournal(journal)
+	if serr != nil {
+		return fmt.Errorf("%v (and cannot save the journal: %v)", err, serr)
+	}
+	return fmt.Errorf("%v (what it created is left in %s, for rollback)", err, cloud.JournalPath())
+}
+
+// LoadJournal returns the environment's unfinished journal, or nil if there is none.
+func (cloud *Cloud) LoadJournal() (*Journal, error) {
+	data, err := ioutil.ReadFile(cloud.JournalPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var journal Journal
+	err = json.Unmarshal(data, &journal)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse journal %s: %v", cloud.JournalPath(), err)
+	}
+	return &journal, nil
+}
+
+func (cloud *Cloud) saveJournal(journal *Journal) error {
+	path := cloud.JournalPath()
+	if len(journal.Entries) == 0 {
+		err := os.Remove(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(journal, "", "   ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// Rollback removes what the environment's last failed operation left behind, newest first, as recorded in its
+// journal. With DryRun set, nothing is touched, and Removals lists what would have been.
+func (cloud *Cloud) Rollback() error {
+	journal, err := cloud.LoadJournal()
+	if err != nil {
+		return err
+	}
+	if journal == nil {
+		return fmt.Errorf("Nothing to roll back in %s", cloud.Name)
+	}
+	if !Quiet {
+		fmt.Printf("Rolling back the %s of %s, which failed: %s\n", journal.Op, journal.Started.Local().Format(time.Stamp), journal.Error)
+	}
+	if cloud.DryRun {
+		for i := len(journal.Entries) - 1; i >= 0; i-- {
+			e := journal.Entries[i]
+			if e.Kind == "route" {
+				//listed by its route table, like the routes over a peering DestroyNetwork would remove
+				cloud.wouldRemove(e.Kind, e.Parent, e.Id)
+			} else {
+				cloud.wouldRemove(e.Kind, e.Id, e.Name)
+			}
+		}
+		return nil
+	}
+	err = cloud.unwind(journal)
+	serr := cloud.saveJournal(journal)
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// unwind undoes the journal's entries, newest first, stopping at the first one that cannot be undone. The journal is
+// left with the entries that remain.
+func (cloud *Cloud) unwind(journal *Journal) error {
+	for i := len(journal.Entries) - 1; i >= 0; i-- {
+		e := journal.Entries[i]
+		err := cloud.undo(e)
+		if err != nil && !isNotFound(err) {
+			journal.Entries = journal.Entries[:i+1]
+			return fmt.Errorf("Cannot remove %s: %v", e, err)
+		}
+		if !Quiet {
+			fmt.Printf("Removed %s\n", e)
+		}
+	}
+	journal.Entries = nil
+	return nil
+}
+
+// isNotFound reports whether the error says the resource is already gone, which is as good as removing it.
+func isNotFound(err error) bool {
+	return strings.Contains(err.Error(), "NotFound")
+}
+
+func (cloud *Cloud) undo(e *JournalEntry) error {
+	var err error
+	id := aws.String(e.Id)
+	switch e.Kind {
+	case "vpc":
+		_, err = cloud.ec2.DeleteVpc(&ec2.DeleteVpcInput{VpcId: id})
+	case "subnet":
+		_, err = cloud.ec2.DeleteSubnet(&ec2.DeleteSubnetInput{SubnetId: id})
+	case "security-group":
+		_, err = cloud.ec2.DeleteSecurityGroup(&ec2.DeleteSecurityGroupInput{GroupId: id})
+	case "internet-gateway":
+		_, err = cloud.ec2.DeleteInternetGateway(&ec2.DeleteInternetGatewayInput{InternetGatewayId: id})
+	case "gateway-attachment":
+		_, err = cloud.ec2.DetachInternetGateway(&ec2.DetachInternetGatewayInput{InternetGatewayId: id, VpcId: aws.String(e.Parent)})
+	case "route-table":
+		_, err = cloud.ec2.DeleteRouteTable(&ec2.DeleteRouteTableInput{RouteTableId: id})
+	case "route-table-association":
+		_, err = cloud.ec2.DisassociateRouteTable(&ec2.DisassociateRouteTableInput{AssociationId: id})
+	case "route":
+		_, err = cloud.ec2.DeleteRoute(&ec2.DeleteRouteInput{RouteTableId: aws.String(e.Parent), DestinationCidrBlock: id})
+	case "peering":
+		_, err = cloud.ec2.DeleteVpcPeeringConnection(&ec2.DeleteVpcPeeringConnectionInput{VpcPeeringConnectionId: id})
+	case "address":
+		_, err = cloud.ec2.ReleaseAddress(&ec2.ReleaseAddressInput{AllocationId: id})
+	case "address-association":
+		_, err = cloud.ec2.DisassociateAddress(&ec2.DisassociateAddressInput{AssociationId: id})
+	case "nat-gateway":
+		_, err = cloud.ec2.DeleteNatGateway(&ec2.DeleteNatGatewayInput{NatGatewayId: id})
+		if err == nil {
+			_, err = cloud.waitForNatGateway(e.Id, "deleted") //its subnet and address are only free after that
+		}
+	case "instance":
+		err = cloud.terminateInstance(&ec2.Instance{InstanceId: id})
+	default:
+		err = fmt.Errorf("Unknown kind of resource: %s", e.Kind)
+	}
+	return err
+}
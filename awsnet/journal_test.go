@@ -0,0 +1,201 @@
+package awsnet
+
+import (
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"os"
+	"strings"
+	"testing"
+)
+
+// failingEC2 fails the call named by failOn, the way AWS does when a limit is reached.
+type failingEC2 struct {
+	*FakeEC2
+	failOn string
+}
+
+func (f *failingEC2) AllocateAddress(in *ec2.AllocateAddressInput) (*ec2.AllocateAddressOutput, error) {
+	if f.failOn == "AllocateAddress" {
+		return nil, fakeError("AddressLimitExceeded", "The maximum number of addresses has been reached.")
+	}
+	return f.FakeEC2.AllocateAddress(in)
+}
+
+func (f *failingEC2) CreateNatGateway(in *ec2.CreateNatGatewayInput) (*ec2.CreateNatGatewayOutput, error) {
+	if f.failOn == "CreateNatGateway" {
+		return nil, fakeError("NatGatewayLimitExceeded", "The maximum number of NAT gateways has been reached.")
+	}
+	return f.FakeEC2.CreateNatGateway(in)
+}
+
+func newFailingCloud(t *testing.T, failOn string) (*Cloud, *FakeEC2, *failingEC2) {
+	_, fake := newTestCloud(t)
+	f := &failingEC2{FakeEC2: fake, failOn: failOn}
+	cloud := NewCloud("dev", f)
+	cloud.Offline = true
+	return cloud, fake, f
+}
+
+func TestFailedSetupUnwinds(t *testing.T) {
+	cloud, fake, _ := newFailingCloud(t, "AllocateAddress")
+	before := live(fake)
+	err := cloud.Setup("0.0.0.0/0", AdminNetBlock, BastionNetBlock)
+	if err == nil || !strings.Contains(err.Error(), "AddressLimitExceeded") {
+		t.Fatalf("Expected setup to fail, got %v", err)
+	}
+	if live(fake) != before {
+		t.Fatalf("Expected %s after unwinding, got %s", before, live(fake))
+	}
+	_, err = os.Stat(cloud.JournalPath())
+	if err == nil {
+		t.Fatal("Expected no journal to be left")
+	}
+}
+
+func TestKeepPartialAndRollback(t *testing.T) {
+	cloud, fake, f := newFailingCloud(t, "AllocateAddress")
+	before := live(fake)
+	cloud.KeepPartial = true
+	err := cloud.Setup("0.0.0.0/0", AdminNetBlock, BastionNetBlock)
+	if err == nil || !strings.Contains(err.Error(), "for rollback") {
+		t.Fatalf("Expected setup to fail and keep what it created, got %v", err)
+	}
+	partial := live(fake)
+	if partial == before {
+		t.Fatal("Expected setup to leave what it created")
+	}
+	journal, err := cloud.LoadJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if journal == nil || journal.Op != "setup" || len(journal.Entries) == 0 {
+		t.Fatalf("Expected a journal of the setup, got %v", journal)
+	}
+	_, err = cloud.CreateNetwork("myapp", "")
+	if err == nil || !strings.Contains(err.Error(), "not rolled back yet") {
+		t.Fatalf("Expected another operation to be refused until the rollback, got %v", err)
+	}
+
+	cloud.DryRun = true
+	err = cloud.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live(fake) != partial || len(cloud.Removals) != len(journal.Entries) {
+		t.Fatalf("Expected a dry run to list %d removals and change nothing, got %v", len(journal.Entries), cloud.Removals)
+	}
+	if last := journal.Entries[len(journal.Entries)-1]; cloud.Removals[0].Kind != last.Kind || cloud.Removals[0].Id != last.Id {
+		t.Fatalf("Expected the rollback to start with the last thing created (%s), got %s", last, cloud.Removals[0])
+	}
+
+	cloud.DryRun = false
+	err = cloud.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live(fake) != before {
+		t.Fatalf("Expected %s after the rollback, got %s", before, live(fake))
+	}
+	err = cloud.Rollback()
+	if err == nil || !strings.Contains(err.Error(), "Nothing to roll back") {
+		t.Fatalf("Expected nothing left to roll back, got %v", err)
+	}
+
+	f.failOn = ""
+	err = cloud.Setup("0.0.0.0/0", AdminNetBlock, BastionNetBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFailedOperationResumes(t *testing.T) {
+	cloud, fake, f := newFailingCloud(t, "AllocateAddress")
+	cloud.KeepPartial = true
+	err := cloud.Setup("0.0.0.0/0", AdminNetBlock, BastionNetBlock)
+	if err == nil {
+		t.Fatal("Expected setup to fail")
+	}
+	f.failOn = ""
+	err = cloud.Setup("0.0.0.0/0", AdminNetBlock, BastionNetBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(cloud.JournalPath())
+	if err == nil {
+		t.Fatal("Expected the journal to go once the setup is done")
+	}
+	vpcs, err := fake.DescribeVpcs(&ec2.DescribeVpcsInput{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vpcs.Vpcs) != 1 {
+		t.Fatalf("Expected the resumed setup to reuse the admin VPC, got %d VPCs", len(vpcs.Vpcs))
+	}
+}
+
+func TestFailedPrivateZoneUnwinds(t *testing.T) {
+	cloud, fake, f := newFailingCloud(t, "")
+	err := cloud.Setup("0.0.0.0/0", AdminNetBlock, BastionNetBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	net, err := cloud.CreateNetwork("myapp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := live(fake)
+	f.failOn = "CreateNatGateway"
+	_, err = net.CreateZoneIn("be", "", "", true)
+	if err == nil {
+		t.Fatal("Expected the private zone not to be created")
+	}
+	if live(fake) != before {
+		t.Fatalf("Expected %s after unwinding, got %s", before, live(fake))
+	}
+	f.failOn = ""
+	zone, err := net.CreateSpreadZone("be", "", 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !zone.Private {
+		t.Fatalf("Expected zone %s to be private", zone.Name)
+	}
+}
+
+func TestFailedCreateIsNotResumed(t *testing.T) {
+	cloud, fake, f := newFailingCloud(t, "")
+	err := cloud.Setup("0.0.0.0/0", AdminNetBlock, BastionNetBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	net, err := cloud.CreateNetwork("myapp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := live(fake)
+	cloud.KeepPartial = true
+	f.failOn = "CreateNatGateway"
+	_, err = net.CreateZoneIn("be", "", "", true)
+	if err == nil {
+		t.Fatal("Expected the private zone not to be created")
+	}
+	partial := live(fake)
+	f.failOn = ""
+	_, err = net.CreateZoneIn("be", "", "", true)
+	if err == nil || !strings.Contains(err.Error(), "cannot be resumed, run 'vpc rollback' first") {
+		t.Fatalf("Expected the failed create-zone to be left to the rollback, got %v", err)
+	}
+	if live(fake) != partial {
+		t.Fatalf("Expected the refused create-zone to leave %s, got %s", partial, live(fake))
+	}
+	err = cloud.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live(fake) != before {
+		t.Fatalf("Expected %s after the rollback, got %s", before, live(fake))
+	}
+	_, err = net.CreateZoneIn("be", "", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,139 @@
+package awsnet
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// The private key of an EC2 key pair is kept at ~/.ssh/<name>.pem, readable only by its owner. Machines are tagged
+// with the key they were launched with, so connecting to them doesn't need it named again.
+
+// DefaultKeyName is the key pair machines are launched with when none is named.
+const DefaultKeyName = "ec2-user"
+
+// KeyPair is an EC2 key pair in the region.
+type KeyPair struct {
+	Name        string
+	Fingerprint string
+	Local       bool //its private key is at KeyPath(Name)
+}
+
+// KeyPath returns where the private key of the named key pair is kept.
+func KeyPath(keyname string) string {
+	return filepath.Join(os.Getenv("HOME"), ".ssh", keyname+".pem")
+}
+
+// ListKeyPairs returns the region's key pairs.
+func (cloud *Cloud) ListKeyPairs() ([]*KeyPair, error) {
+	res, err := cloud.ec2.DescribeKeyPairs(&ec2.DescribeKeyPairsInput{})
+	if err != nil {
+		return nil, err
+	}
+	lst := make([]*KeyPair, 0, len(res.KeyPairs))
+	for _, kp := range res.KeyPairs {
+		name := aws.StringValue(kp.KeyName)
+		_, err := os.Stat(KeyPath(name))
+		lst = append(lst, &KeyPair{Name: name, Fingerprint: aws.StringValue(kp.KeyFingerprint), Local: err == nil})
+	}
+	return lst, nil
+}
+
+// CreateKeyPair creates a new key pair, and saves its private key.
+func (cloud *Cloud) CreateKeyPair(name string) (*KeyPair, error) {
+	path := KeyPath(name)
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("Private key already exists, not overwriting it: %s", path)
+	}
+	res, err := cloud.ec2.CreateKeyPair(&ec2.CreateKeyPairInput{KeyName: aws.String(name)})
+	if err != nil {
+		return nil, err
+	}
+	err = savePrivateKey(path, []byte(aws.StringValue(res.KeyMaterial)))
+	if err != nil {
+		return nil, err
+	}
+	if !Quiet {
+		fmt.Printf("Created key pair '%s', private key saved to %s\n", name, path)
+	}
+	return &KeyPair{Name: name, Fingerprint: aws.StringValue(res.KeyFingerprint), Local: true}, nil
+}
+
+// ImportKeyPair imports the public half of an existing private key as a new key pair, and keeps a copy of the
+// private key with the others.
+func (cloud *Cloud) ImportKeyPair(name string, privateKeyFile string) (*KeyPair, error) {
+	pem, err := ioutil.ReadFile(privateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse private key %s: %v", privateKeyFile, err)
+	}
+	path := KeyPath(name)
+	if existing, err := ioutil.ReadFile(path); err == nil && string(existing) != string(pem) {
+		return nil, fmt.Errorf("A different private key already exists, not overwriting it: %s", path)
+	}
+	res, err := cloud.ec2.ImportKeyPair(&ec2.ImportKeyPairInput{
+		KeyName:           aws.String(name),
+		PublicKeyMaterial: ssh.MarshalAuthorizedKey(signer.PublicKey()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = savePrivateKey(path, pem)
+	if err != nil {
+		return nil, err
+	}
+	if !Quiet {
+		fmt.Printf("Imported key pair '%s', private key saved to %s\n", name, path)
+	}
+	return &KeyPair{Name: name, Fingerprint: aws.StringValue(res.KeyFingerprint), Local: true}, nil
+}
+
+// DeleteKeyPair deletes the key pair, and its private key too if removeLocal is set. Machines launched with it keep
+// running, but can only be reached with another copy of the private key.
+func (cloud *Cloud) DeleteKeyPair(name string, removeLocal bool) error {
+	_, err := cloud.ec2.DeleteKeyPair(&ec2.DeleteKeyPairInput{KeyName: aws.String(name)})
+	if err != nil {
+		return err
+	}
+	if removeLocal {
+		err = os.Remove(KeyPath(name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if !Quiet {
+		fmt.Printf("Deleted key pair '%s'\n", name)
+	}
+	return nil
+}
+
+func savePrivateKey(path string, pem []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path, pem, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(path, 0600) //in case it was already there, with looser permissions
+}
+
+// machineKey resolves the key to connect to the instance with: the one asked for, or else the one it was launched
+// with, as tagged (or as EC2 recorded it).
+func machineKey(inst *ec2.Instance, keyname string) string {
+	if keyname != "" {
+		return keyname
+	}
+	if key := findTag(inst.Tags, "Key"); key != "" {
+		return key
+	}
+	return aws.StringValue(inst.KeyName)
+}
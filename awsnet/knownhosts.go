@@ -0,0 +1,262 @@
+package awsnet
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Each environment keeps the SSH host keys of its machines in its own known_hosts file, one line per machine:
+//
+//    i-0123456789abcdef0 54.200.1.2,10.255.255.5 ssh-ed25519 AAAAC3Nz...
+//
+// Machines are keyed by instance id, since their addresses get reused. A key is captured on first contact, checked
+// against the instance's console output when that is available, and verified on every later connection. Entries
+// are purged when the machine is terminated.
+
+var knownHostsLock sync.Mutex
+
+type knownHost struct {
+	id  string
+	ips []string
+	key ssh.PublicKey
+}
+
+// KnownHostsPath returns the environment's known_hosts file, next to the config file, i.e.
+// ~/.config/hacks/dev.known_hosts.
+func (cloud *Cloud) KnownHostsPath() string {
+	name := cloud.Name
+	if name == "" {
+		name = "default" //standalone machines
+	}
+	return filepath.Join(filepath.Dir(ConfigPath()), name+".known_hosts")
+}
+
+func (cloud *Cloud) loadKnownHosts() ([]*knownHost, error) {
+	data, err := ioutil.ReadFile(cloud.KnownHostsPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var hosts []*knownHost
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("Bad entry in %s, line %d", cloud.KnownHostsPath(), n)
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(fields[2]))
+		if err != nil {
+			return nil, fmt.Errorf("Bad key in %s, line %d: %v", cloud.KnownHostsPath(), n, err)
+		}
+		hosts = append(hosts, &knownHost{id: fields[0], ips: strings.Split(fields[1], ","), key: key})
+	}
+	return hosts, scanner.Err()
+}
+
+func (cloud *Cloud) saveKnownHosts(hosts []*knownHost) error {
+	path := cloud.KnownHostsPath()
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, h := range hosts {
+		fmt.Fprintf(&buf, "%s %s %s", h.id, strings.Join(h.ips, ","), ssh.MarshalAuthorizedKey(h.key))
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, buf.Bytes(), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// hostKeyCallback verifies the key presented by the instance, which is reached at the address being dialed.
+func (cloud *Cloud) hostKeyCallback(inst *ec2.Instance) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		ip, _, err := net.SplitHostPort(hostname)
+		if err != nil {
+			ip = hostname
+		}
+		return cloud.verifyHostKey(aws.StringValue(inst.InstanceId), ip, key)
+	}
+}
+
+// verifyHostKey checks the key against the one known for the instance. A first key is checked against the one the
+// instance printed to its console, if it did, and remembered. The known hosts file is locked only while it is read
+// and written, not while the console output is fetched, which can take a while.
+func (cloud *Cloud) verifyHostKey(instId string, ip string, key ssh.PublicKey) error {
+	known, err := cloud.checkKnownHost(instId, ip, key)
+	if err != nil || known {
+		return err
+	}
+	consoleKeys, err := cloud.consoleHostKeys(instId)
+	if err != nil && !Quiet {
+		fmt.Printf("warning: cannot check the host key of %s against its console output: %v\n", instId, err)
+	}
+	if len(consoleKeys) > 0 {
+		found := false
+		for _, k := range consoleKeys {
+			if bytes.Equal(k.Marshal(), key.Marshal()) {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("Host key for %s (%s) does not match its console output", instId, ip)
+		}
+	}
+	return cloud.addKnownHost(instId, ip, key, len(consoleKeys) > 0)
+}
+
+// checkKnownHost reports whether a key is known for the instance, failing if it is another one. The address is added
+// to those of the instance when it is new.
+func (cloud *Cloud) checkKnownHost(instId string, ip string, key ssh.PublicKey) (bool, error) {
+	knownHostsLock.Lock()
+	defer knownHostsLock.Unlock()
+	hosts, err := cloud.loadKnownHosts()
+	if err != nil {
+		return false, err
+	}
+	return cloud.matchKnownHost(hosts, instId, ip, key)
+}
+
+func (cloud *Cloud) matchKnownHost(hosts []*knownHost, instId string, ip string, key ssh.PublicKey) (bool, error) {
+	for _, h := range hosts {
+		if h.id == instId {
+			if !bytes.Equal(h.key.Marshal(), key.Marshal()) {
+				return true, fmt.Errorf("Host key for %s (%s) has changed, see %s", instId, ip, cloud.KnownHostsPath())
+			}
+			for _, known := range h.ips {
+				if known == ip {
+					return true, nil
+				}
+			}
+			h.ips = append(h.ips, ip)
+			return true, cloud.saveKnownHosts(hosts)
+		}
+	}
+	return false, nil
+}
+
+// addKnownHost remembers the key of an instance, unless another connection to it got there first.
+func (cloud *Cloud) addKnownHost(instId string, ip string, key ssh.PublicKey, fromConsole bool) error {
+	knownHostsLock.Lock()
+	defer knownHostsLock.Unlock()
+	hosts, err := cloud.loadKnownHosts()
+	if err != nil {
+		return err
+	}
+	known, err := cloud.matchKnownHost(hosts, instId, ip, key)
+	if err != nil || known {
+		return err
+	}
+	//a new machine may have been given the address of a terminated one
+	lst := make([]*knownHost, 0, len(hosts)+1)
+	for _, h := range hosts {
+		ips := make([]string, 0, len(h.ips))
+		for _, known := range h.ips {
+			if known != ip {
+				ips = append(ips, known)
+			}
+		}
+		if len(ips) > 0 {
+			h.ips = ips
+			lst = append(lst, h)
+		}
+	}
+	lst = append(lst, &knownHost{id: instId, ips: []string{ip}, key: key})
+	if !Quiet {
+		how := "on first contact"
+		if fromConsole {
+			how = "from console output"
+		}
+		fmt.Printf("Added host key for %s (%s) %s to %s\n", instId, ip, how, cloud.KnownHostsPath())
+	}
+	return cloud.saveKnownHosts(lst)
+}
+
+// hostKeyAlgorithms asks for the type of key already known for the instance, so that the server doesn't present
+// another one. With nothing known yet, the defaults are fine.
+func (cloud *Cloud) hostKeyAlgorithms(instId string) []string {
+	knownHostsLock.Lock()
+	defer knownHostsLock.Unlock()
+	hosts, _ := cloud.loadKnownHosts()
+	for _, h := range hosts {
+		if h.id == instId {
+			if h.key.Type() == ssh.KeyAlgoRSA {
+				return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+			}
+			return []string{h.key.Type()}
+		}
+	}
+	return nil
+}
+
+// consoleHostKeys returns the host keys that cloud-init printed to the instance's console, if any have shown up yet.
+func (cloud *Cloud) consoleHostKeys(instId string) ([]ssh.PublicKey, error) {
+	res, err := cloud.ec2.GetConsoleOutput(&ec2.GetConsoleOutputInput{InstanceId: aws.String(instId)})
+	if err != nil {
+		return nil, err
+	}
+	if res.Output == nil {
+		return nil, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(*res.Output)
+	if err != nil {
+		return nil, nil
+	}
+	var keys []ssh.PublicKey
+	inKeys := false
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.Contains(line, "-----BEGIN SSH HOST KEY KEYS-----"):
+			inKeys = true
+		case strings.Contains(line, "-----END SSH HOST KEY KEYS-----"):
+			inKeys = false
+		case inKeys:
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+			if err == nil {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// forgetHost removes a terminated instance's entry from the environment's known_hosts file.
+func (cloud *Cloud) forgetHost(instId string) error {
+	knownHostsLock.Lock()
+	defer knownHostsLock.Unlock()
+	hosts, err := cloud.loadKnownHosts()
+	if err != nil || hosts == nil {
+		return err
+	}
+	lst := make([]*knownHost, 0, len(hosts))
+	for _, h := range hosts {
+		if h.id != instId {
+			lst = append(lst, h)
+		}
+	}
+	if len(lst) == len(hosts) {
+		return nil
+	}
+	return cloud.saveKnownHosts(lst)
+}
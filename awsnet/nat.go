@@ -0,0 +1,203 @@
+package awsnet
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// A private zone has no way in from the internet, but its machines can still reach out (i.e. to install packages)
+// through the network's NAT gateway. The NAT gateway lives in the network's public "nat" zone, which routes to an
+// internet gateway, and each private zone's route table sends everything outside the network (but the admin network,
+// which goes over the peering) to the NAT gateway.
+
+// NatZoneName is the name of the public zone a network's NAT gateway is put in.
+const NatZoneName = "nat"
+
+// natZoneBlock is the size of the nat zone, which only ever holds the NAT gateway.
+const natZoneBlock = "/28"
+
+// findNatGateway returns the network's NAT gateway, if it has one that is available or on its way.
+func (net *Network) findNatGateway() (*ec2.NatGateway, error) {
+	res, err := net.Cloud.ec2.DescribeNatGateways(&ec2.DescribeNatGatewaysInput{Filter: []*ec2.Filter{filter("vpc-id", net.Id)}})
+	if err != nil {
+		return nil, err
+	}
+	for _, nat := range res.NatGateways {
+		switch aws.StringValue(nat.State) {
+		case "pending", "available":
+			return nat, nil
+		}
+	}
+	return nil, nil
+}
+
+// ensureNatGateway returns the network's NAT gateway, first creating it (and the nat zone and internet gateway it
+// needs) if the network has none.
+func (net *Network) ensureNatGateway() (*ec2.NatGateway, error) {
+	cloud := net.Cloud
+	nat, err := net.findNatGateway()
+	if err != nil || nat != nil {
+		return nat, err
+	}
+	gwId, err := net.ensureInternetGateway()
+	if err != nil {
+		return nil, err
+	}
+	natZone, err := cloud.GetZone(net.Name + "." + NatZoneName)
+	if err != nil {
+		return nil, err
+	}
+	if natZone == nil {
+		natZone, err = net.CreateZone(NatZoneName, natZoneBlock)
+		if err != nil {
+			return nil, err
+		}
+		if !Quiet {
+			fmt.Printf("Created public zone '%s' (%s) - %s\n", natZone.Name, natZone.Id, natZone.AddressBlock)
+		}
+	}
+	err = natZone.SetRoute("0.0.0.0/0", *gwId)
+	if err != nil {
+		return nil, err
+	}
+	natName := net.Name + ".nat"
+	eip, err := cloud.ec2.AllocateAddress(&ec2.AllocateAddressInput{Domain: aws.String(ec2.DomainTypeVpc)})
+	if err != nil {
+		return nil, err
+	}
+	cloud.record("address", *eip.AllocationId, "", aws.StringValue(eip.PublicIp))
+	_, err = cloud.ec2.CreateTags(&ec2.CreateTagsInput{Resources: []*string{eip.AllocationId}, Tags: net.tags(natName)})
+	if err != nil {
+		return nil, err
+	}
+	res, err := cloud.ec2.CreateNatGateway(&ec2.CreateNatGatewayInput{AllocationId: eip.AllocationId, SubnetId: aws.String(natZone.Id)})
+	if err != nil {
+		return nil, err
+	}
+	natId := res.NatGateway.NatGatewayId
+	cloud.record("nat-gateway", *natId, "", natName)
+	_, err = cloud.ec2.CreateTags(&ec2.CreateTagsInput{Resources: []*string{natId}, Tags: net.tags(natName)})
+	if err != nil {
+		return nil, err
+	}
+	if !Quiet {
+		fmt.Printf("Created NAT gateway '%s' (%s) with elastic IP %s, waiting for it...", natName, *natId, aws.StringValue(eip.PublicIp))
+	}
+	nat, err = cloud.waitForNatGateway(*natId, "available")
+	if !Quiet {
+		fmt.Println()
+	}
+	return nat, err
+}
+
+// ensureInternetGateway returns the id of the internet gateway attached to the network, first attaching the
+// network's detached one, or creating and attaching one, if there is none.
+func (net *Network) ensureInternetGateway() (*string, error) {
+	cloud := net.Cloud
+	gws, err := cloud.ec2.DescribeInternetGateways(&ec2.DescribeInternetGatewaysInput{Filters: []*ec2.Filter{filter("attachment.vpc-id", net.Id)}})
+	if err != nil {
+		return nil, err
+	}
+	if len(gws.InternetGateways) > 0 {
+		return gws.InternetGateways[0].InternetGatewayId, nil
+	}
+	gatewayName := net.Name + ".gateway"
+	gws, err = cloud.ec2.DescribeInternetGateways(&ec2.DescribeInternetGatewaysInput{Filters: []*ec2.Filter{
+		filter("tag:Env", cloud.Name),
+		filter("tag:Name", gatewayName),
+	}})
+	if err != nil {
+		return nil, err
+	}
+	var gwId *string
+	for _, gw := range gws.InternetGateways {
+		if len(gw.Attachments) == 0 {
+			gwId = gw.InternetGatewayId //left behind by a failed setup
+			break
+		}
+	}
+	if gwId == nil {
+		gw, err := cloud.ec2.CreateInternetGateway(&ec2.CreateInternetGatewayInput{})
+		if err != nil {
+			return nil, err
+		}
+		gwId = gw.InternetGateway.InternetGatewayId
+		cloud.record("internet-gateway", *gwId, "", gatewayName)
+		_, err = cloud.ec2.CreateTags(&ec2.CreateTagsInput{Resources: []*string{gwId}, Tags: net.tags(gatewayName)})
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = cloud.ec2.AttachInternetGateway(&ec2.AttachInternetGatewayInput{VpcId: net.vpc.VpcId, InternetGatewayId: gwId})
+	if err != nil {
+		return nil, err
+	}
+	cloud.record("gateway-attachment", *gwId, net.Id, gatewayName)
+	if !Quiet {
+		fmt.Printf("Attached internet gateway '%s' (%s) to %s\n", gatewayName, *gwId, net.Name)
+	}
+	return gwId, nil
+}
+
+// MakePrivate routes the zone's outbound internet traffic through the network's NAT gateway, creating that first if
+// need be. Nothing can reach the zone's machines from the internet, since none of them get public IPs.
+func (zone *Zone) MakePrivate() error {
+	return zone.Network.Cloud.journaled("make-private "+zone.Name, zone.makePrivate)
+}
+
+func (zone *Zone) makePrivate() error {
+	net := zone.Network
+	cloud := net.Cloud
+	if zone.Name == net.Name+"."+NatZoneName {
+		return fmt.Errorf("The %s zone is public, it holds the NAT gateway", zone.Name)
+	}
+	nat, err := net.ensureNatGateway()
+	if err != nil {
+		return err
+	}
+	err = zone.SetRoute("0.0.0.0/0", *nat.NatGatewayId)
+	if err != nil {
+		return err
+	}
+	ids := make([]*string, 0, len(zone.Subnets))
+	for _, sn := range zone.Subnets {
+		ids = append(ids, aws.String(sn.Id))
+	}
+	_, err = cloud.ec2.CreateTags(&ec2.CreateTagsInput{
+		Resources: ids,
+		Tags:      []*ec2.Tag{&ec2.Tag{Key: aws.String("Access"), Value: aws.String("private")}},
+	})
+	if err != nil {
+		return err
+	}
+	zone.Private = true
+	if !Quiet {
+		fmt.Printf("Zone '%s' is private, with outbound traffic through NAT gateway %s\n", zone.Name, *nat.NatGatewayId)
+	}
+	return nil
+}
+
+// waitForNatGateway polls the NAT gateway until it reaches the final state, "available" or "deleted".
+func (cloud *Cloud) waitForNatGateway(natId string, finalState string) (*ec2.NatGateway, error) {
+	for {
+		res, err := cloud.ec2.DescribeNatGateways(&ec2.DescribeNatGatewaysInput{NatGatewayIds: []*string{aws.String(natId)}})
+		if err != nil {
+			return nil, err
+		}
+		if len(res.NatGateways) == 0 {
+			return nil, fmt.Errorf("Cannot wait: NAT gateway '%s' disappeared", natId)
+		}
+		nat := res.NatGateways[0]
+		switch aws.StringValue(nat.State) {
+		case finalState:
+			return nat, nil
+		case "failed":
+			return nil, fmt.Errorf("NAT gateway '%s' failed: %s", natId, aws.StringValue(nat.FailureMessage))
+		}
+		cloud.pause(5.0)
+		if !Quiet {
+			fmt.Print(".")
+		}
+	}
+}
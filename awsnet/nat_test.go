@@ -0,0 +1,55 @@
+package awsnet
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDestroyPrivateZone(t *testing.T) {
+	cloud, fake := newTestCloud(t)
+	err := cloud.Setup("0.0.0.0/0", AdminNetBlock, BastionNetBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := live(fake)
+	net, err := cloud.CreateNetwork("myapp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone, err := net.CreateZone("be", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = zone.MakePrivate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cloud.DryRun = true
+	err = cloud.DestroyNetwork("myapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the NAT gateway holds its EIP, and the route tables route to it, so it must go first
+	order := make([]string, 0)
+	for _, r := range cloud.Removals {
+		switch r.Kind {
+		case "nat-gateway", "address", "route-table":
+			if len(order) == 0 || order[len(order)-1] != r.Kind {
+				order = append(order, r.Kind)
+			}
+		}
+	}
+	if strings.Join(order, " ") != "nat-gateway address route-table" {
+		t.Fatalf("Expected a dry run to remove the NAT gateway, then its address, then the route tables, got %v", cloud.Removals)
+	}
+
+	cloud.DryRun = false
+	err = cloud.DestroyNetwork("myapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live(fake) != before {
+		t.Fatalf("Expected %s after destroying the network, got %s", before, live(fake))
+	}
+}
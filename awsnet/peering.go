@@ -0,0 +1,403 @@
+package awsnet
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"strings"
+)
+
+// Every network is peered with the admin network. When both are in the same AWS account, creating the network peers
+// it right away. When the admin network is in another account (a RemoteAdmin), the admin side has to approve: creating
+// the network only requests the peering, and sets up the network's side of it, and the admin account's credentials
+// list the requests with PendingPeerings, and complete them with AcceptPeering (or turn them down with RejectPeering).
+
+// a RemoteAdmin is the admin network of the environment, when it is in another AWS account, and so cannot be looked up.
+type RemoteAdmin struct {
+	Account      string //the AWS account id it is in
+	VpcId        string
+	NetBlock     string
+	BastionBlock string //the block of its bastion zone, which the jumphost is in
+}
+
+// a Peering connects a network with another VPC (usually the admin network's), as seen from the network.
+type Peering struct {
+	Id          string
+	Name        string
+	Status      string
+	Peer        string //the other VPC's id
+	PeerBlock   string //and its net block
+	PeerAccount string //and the AWS account it is in
+}
+
+func (p *Peering) String() string {
+	name := p.Name
+	if name == "" {
+		name = "unnamed"
+	}
+	return fmt.Sprintf("%s (%s) with %s - %s, %s", p.Id, name, p.Peer, p.PeerBlock, p.Status)
+}
+
+// peerWithAdmin peers the network with the admin network, and names the peering after the two.
+func (cloud *Cloud) peerWithAdmin(adminVpc *ec2.Vpc, net *Network) (*string, error) {
+	//both are in this account, so the admin side requests, and accepts right away
+	peerOut, err := cloud.ec2.CreateVpcPeeringConnection(&ec2.CreateVpcPeeringConnectionInput{PeerVpcId: net.vpc.VpcId, VpcId: adminVpc.VpcId})
+	if err != nil {
+		return nil, err
+	}
+	peeringId := peerOut.VpcPeeringConnection.VpcPeeringConnectionId
+	peeringName := cloud.adminPeeringName(net)
+	cloud.record("peering", *peeringId, "", peeringName)
+	_, err = cloud.ec2.AcceptVpcPeeringConnection(&ec2.AcceptVpcPeeringConnectionInput{VpcPeeringConnectionId: peeringId})
+	if err != nil {
+		return nil, err
+	}
+	err = cloud.tagPeering(peeringId, peeringName)
+	if err != nil {
+		return nil, err
+	}
+	return peeringId, nil
+}
+
+// adminPeeringName is the name of the peering between the admin network and the network, i.e. "dev.admin:dev.myapp".
+func (cloud *Cloud) adminPeeringName(net *Network) string {
+	return cloud.Name + "." + AdminNetName + ":" + net.Name
+}
+
+func (cloud *Cloud) tagPeering(peeringId *string, name string) error {
+	_, err := cloud.ec2.CreateTags(&ec2.CreateTagsInput{
+		Resources: []*string{peeringId},
+		Tags: []*ec2.Tag{
+			&ec2.Tag{Key: aws.String("Name"), Value: aws.String(name)},
+			&ec2.Tag{Key: aws.String("Env"), Value: aws.String(cloud.Name)},
+		},
+	})
+	return err
+}
+
+// findAdminPeering returns the peering the requester VPC asked of the accepter VPC (the admin network's and the
+// network's, or the other way around for a RemoteAdmin) that is active or waiting to be accepted, if there is one. It
+// is found by the VPCs it joins, not by its tags, which may have been lost.
+func (cloud *Cloud) findAdminPeering(requesterId string, accepterId string) (*ec2.VpcPeeringConnection, error) {
+	res, err := cloud.ec2.DescribeVpcPeeringConnections(&ec2.DescribeVpcPeeringConnectionsInput{Filters: []*ec2.Filter{
+		filter("requester-vpc-info.vpc-id", requesterId),
+		filter("accepter-vpc-info.vpc-id", accepterId),
+	}})
+	if err != nil {
+		return nil, err
+	}
+	var found *ec2.VpcPeeringConnection
+	for _, peering := range res.VpcPeeringConnections {
+		switch aws.StringValue(peering.Status.Code) {
+		case "active":
+			return peering, nil
+		case "pending-acceptance", "provisioning":
+			found = peering
+		}
+	}
+	return found, nil
+}
+
+// Peerings returns the network's peerings that are active or on their way, found by the VPCs they join rather than by
+// their tags, which may have been lost or edited by hand.
+func (net *Network) Peerings() ([]*Peering, error) {
+	lst := make([]*Peering, 0)
+	for _, side := range []string{"requester-vpc-info.vpc-id", "accepter-vpc-info.vpc-id"} {
+		res, err := net.Cloud.ec2.DescribeVpcPeeringConnections(&ec2.DescribeVpcPeeringConnectionsInput{Filters: []*ec2.Filter{
+			filter(side, net.Id),
+		}})
+		if err != nil {
+			return nil, err
+		}
+		for _, peering := range res.VpcPeeringConnections {
+			switch aws.StringValue(peering.Status.Code) {
+			case "deleted", "deleting", "rejected", "failed", "expired":
+				continue
+			}
+			peer := peering.AccepterVpcInfo
+			if aws.StringValue(peer.VpcId) == net.Id {
+				peer = peering.RequesterVpcInfo
+			}
+			lst = append(lst, &Peering{
+				Id:          *peering.VpcPeeringConnectionId,
+				Name:        findTag(peering.Tags, "Name"),
+				Status:      aws.StringValue(peering.Status.Code),
+				Peer:        aws.StringValue(peer.VpcId),
+				PeerBlock:   aws.StringValue(peer.CidrBlock),
+				PeerAccount: aws.StringValue(peer.OwnerId),
+			})
+		}
+	}
+	return lst, nil
+}
+
+// deletePeering deletes the peering, after removing the routes over it from the route tables of the VPC on its other
+// side (those of the network itself go along with it). With DryRun set, nothing is touched, and Removals lists what
+// would have been.
+func (net *Network) deletePeering(p *Peering) error {
+	cloud := net.Cloud
+	res, err := cloud.ec2.DescribeRouteTables(&ec2.DescribeRouteTablesInput{Filters: []*ec2.Filter{
+		filter("vpc-id", p.Peer),
+		filter("route.vpc-peering-connection-id", p.Id),
+	}})
+	if err != nil {
+		return err
+	}
+	for _, rt := range res.RouteTables {
+		for _, route := range rt.Routes {
+			if aws.StringValue(route.VpcPeeringConnectionId) != p.Id {
+				continue
+			}
+			if cloud.DryRun {
+				cloud.wouldRemove("route", *rt.RouteTableId, aws.StringValue(route.DestinationCidrBlock))
+				continue
+			}
+			_, err = cloud.ec2.DeleteRoute(&ec2.DeleteRouteInput{RouteTableId: rt.RouteTableId, DestinationCidrBlock: route.DestinationCidrBlock})
+			if err != nil && !isNotFound(err) {
+				return err
+			}
+			if !Quiet {
+				fmt.Printf("Deleted the route for %s in %s\n", *route.DestinationCidrBlock, *rt.RouteTableId)
+			}
+		}
+	}
+	if cloud.DryRun {
+		cloud.wouldRemove("peering", p.Id, p.Name)
+		return nil
+	}
+	_, err = cloud.ec2.DeleteVpcPeeringConnection(&ec2.DeleteVpcPeeringConnectionInput{VpcPeeringConnectionId: aws.String(p.Id)})
+	if err != nil {
+		return err
+	}
+	if !Quiet {
+		fmt.Printf("Deleted VPC peering connection %s with %s\n", p.Id, p.Peer)
+	}
+	return nil
+}
+
+// requestAdminPeering asks the remote admin network's account to peer with the network, and sets up the network's side
+// of the peering: its routes to the admin network (which go nowhere until the peering is accepted) and the jumphost's
+// way in.
+func (cloud *Cloud) requestAdminPeering(net *Network) error {
+	remote := cloud.RemoteAdmin
+	peeringId, err := cloud.requestPeering(net)
+	if err != nil {
+		return err
+	}
+	err = net.addRoute(remote.NetBlock, *peeringId)
+	if err != nil {
+		return err
+	}
+	sg, err := net.defaultSecurityGroup()
+	if err != nil {
+		return err
+	}
+	err = cloud.authorizeInboundAddress(sg.GroupId, remote.BastionBlock, "tcp", 22) //only the jumphost needs in
+	if err != nil {
+		return err
+	}
+	if !Quiet {
+		fmt.Printf("Requested peering %s with the admin network (%s in account %s)\n", *peeringId, remote.VpcId, remote.Account)
+		fmt.Printf("To complete it, run 'vpc -e %s peering accept %s %s' with the admin account's credentials\n", cloud.Name, *peeringId, net.shortName())
+	}
+	return nil
+}
+
+// requestPeering asks the remote admin network's account to peer with the network, and names the peering after the two.
+func (cloud *Cloud) requestPeering(net *Network) (*string, error) {
+	remote := cloud.RemoteAdmin
+	if remote.Account == "" || remote.VpcId == "" {
+		return nil, fmt.Errorf("An admin network in another account needs both admin-account and admin-vpc set")
+	}
+	peerOut, err := cloud.ec2.CreateVpcPeeringConnection(&ec2.CreateVpcPeeringConnectionInput{
+		VpcId:       net.vpc.VpcId,
+		PeerVpcId:   aws.String(remote.VpcId),
+		PeerOwnerId: aws.String(remote.Account),
+	})
+	if err != nil {
+		return nil, err
+	}
+	peeringId := peerOut.VpcPeeringConnection.VpcPeeringConnectionId
+	peeringName := cloud.adminPeeringName(net)
+	cloud.record("peering", *peeringId, "", peeringName)
+	err = cloud.tagPeering(peeringId, peeringName)
+	if err != nil {
+		return nil, err
+	}
+	return peeringId, nil
+}
+
+// findPeering returns the network's peering with the given id, or an error if it has none by that id.
+func (net *Network) findPeering(peeringId string) (*Peering, error) {
+	lst, err := net.Peerings()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range lst {
+		if p.Id == peeringId {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("Network %s has no peering %s", net.Name, peeringId)
+}
+
+func (cloud *Cloud) adminNetwork() (*Network, error) {
+	admin, err := cloud.FindNetwork(AdminNetName)
+	if err != nil {
+		return nil, err
+	}
+	if admin == nil {
+		return nil, fmt.Errorf("Cloud not set up: %s", cloud.Name)
+	}
+	return admin, nil
+}
+
+// PendingPeerings returns the requests to peer with the admin network that are waiting to be accepted.
+func (cloud *Cloud) PendingPeerings() ([]*Peering, error) {
+	admin, err := cloud.adminNetwork()
+	if err != nil {
+		return nil, err
+	}
+	lst, err := admin.Peerings()
+	if err != nil {
+		return nil, err
+	}
+	pending := make([]*Peering, 0)
+	for _, p := range lst {
+		if p.Status == "pending-acceptance" {
+			pending = append(pending, p)
+		}
+	}
+	return pending, nil
+}
+
+// AcceptPeering accepts a request to peer with the admin network, names the peering after the requesting network
+// (netName, i.e. "myapp", or its VPC id when that is not given), and routes the network's block from every admin zone
+// over it. When the requesting network is in this account too, its side is completed as well: its routes to the admin
+// network, and the jumphost's way in. Accepting an active peering again just makes sure of all that.
+func (cloud *Cloud) AcceptPeering(peeringId string, netName string) error {
+	admin, err := cloud.adminNetwork()
+	if err != nil {
+		return err
+	}
+	p, err := admin.findPeering(peeringId)
+	if err != nil {
+		return err
+	}
+	switch p.Status {
+	case "pending-acceptance":
+		err = admin.checkPeerBlock(p)
+		if err != nil {
+			return err
+		}
+		_, err = cloud.ec2.AcceptVpcPeeringConnection(&ec2.AcceptVpcPeeringConnectionInput{VpcPeeringConnectionId: aws.String(p.Id)})
+		if err != nil {
+			return err
+		}
+		if !Quiet {
+			fmt.Printf("Accepted peering %s with %s (%s) in account %s\n", p.Id, p.Peer, p.PeerBlock, p.PeerAccount)
+		}
+	case "active":
+	default:
+		return fmt.Errorf("Cannot accept peering %s, it is %s", p.Id, p.Status)
+	}
+	if netName == "" {
+		netName = p.Peer
+	} else if !strings.HasPrefix(netName, cloud.Name+".") {
+		netName = cloud.Name + "." + netName
+	}
+	err = cloud.tagPeering(aws.String(p.Id), cloud.Name+"."+AdminNetName+":"+netName)
+	if err != nil {
+		return err
+	}
+	err = admin.addRoute(p.PeerBlock, p.Id) //the entire app vpc, from every admin zone
+	if err != nil {
+		return err
+	}
+	if !Quiet {
+		fmt.Printf("Routed %s over the peering from the admin network\n", p.PeerBlock)
+	}
+	lst, err := cloud.ListNetworks()
+	if err != nil {
+		return err
+	}
+	for _, net := range lst {
+		if net.Id != p.Peer {
+			continue
+		}
+		adminNetBlock, bastionNetBlock := adminBlocks(admin.vpc)
+		err = net.addRoute(adminNetBlock, p.Id)
+		if err != nil {
+			return err
+		}
+		sg, err := net.defaultSecurityGroup()
+		if err != nil {
+			return err
+		}
+		err = cloud.authorizeInboundAddress(sg.GroupId, bastionNetBlock, "tcp", 22)
+		if err != nil && !strings.Contains(err.Error(), "InvalidPermission.Duplicate") {
+			return err
+		}
+		if !Quiet {
+			fmt.Printf("Routed %s over the peering from %s, and authorized tcp/22 from %s\n", adminNetBlock, net.Name, bastionNetBlock)
+		}
+	}
+	return nil
+}
+
+// checkPeerBlock makes sure the block of the VPC requesting to peer overlaps no network the admin network routes to
+// already, be it one in the environment or another peer.
+func (net *Network) checkPeerBlock(p *Peering) error {
+	cidrs := []string{net.AddressBlock}
+	lst, err := net.Cloud.ListNetworks()
+	if err != nil {
+		return err
+	}
+	for _, other := range lst {
+		if other.Id != p.Peer && other.Id != net.Id {
+			cidrs = append(cidrs, other.AddressBlock)
+		}
+	}
+	peerings, err := net.Peerings()
+	if err != nil {
+		return err
+	}
+	for _, other := range peerings {
+		if other.Id != p.Id && other.Status == "active" {
+			cidrs = append(cidrs, other.PeerBlock)
+		}
+	}
+	block, err := parseBlock(p.PeerBlock)
+	if err != nil {
+		return err
+	}
+	for _, used := range usedBlocks(cidrs) {
+		if overlaps(block, used) {
+			return fmt.Errorf("Cannot accept peering %s: its block %s overlaps %s, which the admin network already routes to", p.Id, p.PeerBlock, used)
+		}
+	}
+	return nil
+}
+
+// RejectPeering turns down a request to peer with the admin network.
+func (cloud *Cloud) RejectPeering(peeringId string) error {
+	admin, err := cloud.adminNetwork()
+	if err != nil {
+		return err
+	}
+	p, err := admin.findPeering(peeringId)
+	if err != nil {
+		return err
+	}
+	if p.Status != "pending-acceptance" {
+		return fmt.Errorf("Cannot reject peering %s, it is %s", p.Id, p.Status)
+	}
+	_, err = cloud.ec2.RejectVpcPeeringConnection(&ec2.RejectVpcPeeringConnectionInput{VpcPeeringConnectionId: aws.String(p.Id)})
+	if err != nil {
+		return err
+	}
+	if !Quiet {
+		fmt.Printf("Rejected peering %s with %s (%s) in account %s\n", p.Id, p.Peer, p.PeerBlock, p.PeerAccount)
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+package awsnet
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"strings"
+	"testing"
+)
+
+func TestPeeringsFoundByVpc(t *testing.T) {
+	cloud, fake := newTestCloud(t)
+	err := cloud.Setup("0.0.0.0/0", AdminNetBlock, BastionNetBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cloud.CreateNetwork("a", "10.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := cloud.CreateNetwork("b", "10.0.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerings, err := b.Peerings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peerings) != 1 || peerings[0].Name != "dev.admin:dev.b" || peerings[0].PeerBlock != AdminNetBlock {
+		t.Fatalf("Expected b's peering with the admin network, got %v", peerings)
+	}
+	*fake.tagsOf(peerings[0].Id) = nil //lost its tags
+	peerings, err = b.Peerings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peerings) != 1 || peerings[0].Name != "" {
+		t.Fatalf("Expected b's untagged peering, got %v", peerings)
+	}
+	admin, err := cloud.FindNetwork(AdminNetName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerings, err = admin.Peerings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peerings) != 2 {
+		t.Fatalf("Expected the admin network to be peered with a and b, got %v", peerings)
+	}
+}
+
+func TestDestroyNetworkRemovesPeering(t *testing.T) {
+	cloud, fake := newTestCloud(t)
+	err := cloud.Setup("0.0.0.0/0", AdminNetBlock, BastionNetBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cloud.CreateNetwork("a", "10.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := cloud.CreateNetwork("b", "10.0.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerings, err := b.Peerings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peeringId := peerings[0].Id
+	*fake.tagsOf(peeringId) = nil
+
+	cloud.DryRun = true
+	err = cloud.DestroyNetwork("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, peeringListed := 0, false
+	for _, r := range cloud.Removals {
+		switch {
+		case r.Kind == "route" && r.Name == "10.0.1.0/24" && strings.HasPrefix(r.Id, "rtb-"):
+			routes++
+		case r.Kind == "peering" && r.Id == peeringId:
+			peeringListed = true
+		}
+	}
+	if routes != 2 || !peeringListed {
+		t.Fatalf("Expected a dry run to list the peering and the two admin routes over it, got %v", cloud.Removals)
+	}
+
+	cloud.DryRun = false
+	err = cloud.DestroyNetwork("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := *fake.peerings[peeringId].Status.Code; code != "deleted" {
+		t.Fatalf("Expected the untagged peering to be deleted, it is %s", code)
+	}
+	admin, err := cloud.FindNetwork(AdminNetName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables, err := admin.routeTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rt := range tables {
+		if findRoute(rt, "10.0.1.0/24") != nil {
+			t.Errorf("Expected the route to b to go from %s", *rt.RouteTableId)
+		}
+		if findRoute(rt, "10.0.0.0/24") == nil {
+			t.Errorf("Expected the route to a to stay in %s", *rt.RouteTableId)
+		}
+	}
+	peerings, err = admin.Peerings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peerings) != 1 {
+		t.Fatalf("Expected just the peering with a to be left, got %v", peerings)
+	}
+}
+
+const adminAccount = "210987654321"
+
+// newRemoteAdminClouds sets up an admin network in another account, and returns the Cloud of that account and that of
+// this one, which only knows the admin network as a RemoteAdmin.
+func newRemoteAdminClouds(t *testing.T) (*Cloud, *Cloud, *FakeEC2) {
+	adminCloud, fake := newTestCloud(t)
+	err := adminCloud.Setup("0.0.0.0/0", AdminNetBlock, BastionNetBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := adminCloud.FindNetwork(AdminNetName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.vpcs[admin.Id].OwnerId = aws.String(adminAccount)
+	cloud := NewCloud("dev", fake)
+	cloud.Offline = true
+	cloud.RemoteAdmin = &RemoteAdmin{Account: adminAccount, VpcId: admin.Id, NetBlock: AdminNetBlock, BastionBlock: BastionNetBlock}
+	return adminCloud, cloud, fake
+}
+
+// routeState returns the state of the zone's route for the destination, or "" if it has none.
+func routeState(t *testing.T, zone *Zone, destination string) string {
+	_, routes, err := zone.Routes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range routes {
+		if r.Destination == destination {
+			return r.State
+		}
+	}
+	return ""
+}
+
+func TestRemoteAdminWrongAccount(t *testing.T) {
+	_, cloud, fake := newRemoteAdminClouds(t)
+	before := live(fake)
+	cloud.RemoteAdmin.Account = "999999999999"
+	_, err := cloud.CreateNetwork("myapp", "")
+	if err == nil || !strings.Contains(err.Error(), "InvalidVpcID.NotFound") {
+		t.Fatalf("Expected the peering request to fail, got %v", err)
+	}
+	if live(fake) != before {
+		t.Fatalf("Expected %s after unwinding, got %s", before, live(fake))
+	}
+}
+
+func TestRemoteAdminAcceptPeering(t *testing.T) {
+	adminCloud, cloud, fake := newRemoteAdminClouds(t)
+	net, err := cloud.CreateNetwork("myapp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone, err := net.CreateZone("early", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := routeState(t, zone, AdminNetBlock); state != "blackhole" {
+		t.Fatalf("Expected a zone created before the peering is accepted to route to the admin network, got %q", state)
+	}
+
+	rt, err := zone.routeTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.DeleteRoute(&ec2.DeleteRouteInput{RouteTableId: rt.RouteTableId, DestinationCidrBlock: aws.String(AdminNetBlock)})
+	lst, err := cloud.Verify(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lst) != 2 || lst[0].Fixable || !strings.Contains(lst[0].Problem, "waiting for account "+adminAccount) || !lst[1].Fixed {
+		t.Fatalf("Expected the pending peering to be left to the admin account, and the missing route to be put back, got %v", lst)
+	}
+
+	pending, err := adminCloud.PendingPeerings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].Peer != net.Id {
+		t.Fatalf("Expected the peering request to be pending, got %v", pending)
+	}
+	err = adminCloud.AcceptPeering(pending[0].Id, "myapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = adminCloud.AcceptPeering(pending[0].Id, "myapp")
+	if err != nil {
+		t.Fatalf("Expected accepting again to be harmless, got %v", err)
+	}
+	if state := routeState(t, zone, AdminNetBlock); state != "active" {
+		t.Fatalf("Expected the route to the admin network to be active once the peering is, got %q", state)
+	}
+	admin, err := adminCloud.FindNetwork(AdminNetName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bastion, err := adminCloud.GetZone("dev.admin.bastion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := routeState(t, bastion, net.AddressBlock); state != "active" {
+		t.Fatalf("Expected the admin network to route to %s, got %q", net.AddressBlock, state)
+	}
+	peerings, err := admin.Peerings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peerings) != 1 || peerings[0].Name != "dev.admin:dev.myapp" || peerings[0].Status != "active" {
+		t.Fatalf("Expected an active peering named after the network, got %v", peerings)
+	}
+	lst, err = cloud.Verify(false)
+	if err != nil || len(lst) != 0 {
+		t.Fatalf("Expected no discrepancies once accepted, got %v (%v)", lst, err)
+	}
+}
+
+func TestRemoteAdminRejectPeering(t *testing.T) {
+	adminCloud, cloud, _ := newRemoteAdminClouds(t)
+	net, err := cloud.CreateNetwork("myapp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := adminCloud.PendingPeerings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("Expected one pending peering, got %v", pending)
+	}
+	err = adminCloud.RejectPeering(pending[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerings, err := net.Peerings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peerings) != 0 {
+		t.Fatalf("Expected the rejected peering to be gone, got %v", peerings)
+	}
+	err = adminCloud.AcceptPeering(pending[0].Id, "")
+	if err == nil {
+		t.Fatal("Expected a rejected peering not to be accepted")
+	}
+	err = adminCloud.RejectPeering(pending[0].Id)
+	if err == nil {
+		t.Fatal("Expected a rejected peering not to be rejected again")
+	}
+}
+
+func TestRemoteAdminNeedsNetBlocks(t *testing.T) {
+	config := &Config{Envs: map[string]*Settings{"team": &Settings{AdminAccount: adminAccount, AdminVpc: "vpc-0a1b2c3d", AdminNet: "172.31.255.0/24"}}}
+	settings := config.Effective("team")
+	_, err := ConfiguredCloud(settings)
+	if err == nil || !strings.Contains(err.Error(), "bastion-net must be set") {
+		t.Fatalf("Expected the built in bastion-net not to be used for another account's admin network, got %v", err)
+	}
+	settings.Override("bastion-net", "172.31.255.0/28", "flag -b")
+	cloud, err := ConfiguredCloud(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cloud.RemoteAdmin == nil || cloud.RemoteAdmin.NetBlock != "172.31.255.0/24" || cloud.RemoteAdmin.BastionBlock != "172.31.255.0/28" {
+		t.Fatalf("Expected the configured net blocks for the admin network, got %v", cloud.RemoteAdmin)
+	}
+}
@@ -0,0 +1,298 @@
+package awsnet
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"strings"
+)
+
+// Every zone has a route table of its own, tagged with the zone's name, so that one zone's routes (i.e. a private
+// zone's default route to the NAT gateway) don't leak into another's. Routes that are for the whole network, like
+// those over the peering to the admin network, go in the main route table and in every zone's. Zones created before
+// they got their own table use the main one until they are given one.
+
+// a Route sends traffic for a net block to a target: an internet gateway ("igw-..."), a NAT gateway ("nat-..."), a
+// peering ("pcx-..."), an instance ("i-...") or "local", for the network itself.
+type Route struct {
+	Destination string
+	Target      string
+	State       string
+}
+
+func (r *Route) String() string {
+	return fmt.Sprintf("%s -> %s (%s)", r.Destination, r.Target, r.State)
+}
+
+func newRoute(route *ec2.Route) *Route {
+	target := aws.StringValue(route.GatewayId)
+	for _, id := range []*string{route.NatGatewayId, route.VpcPeeringConnectionId, route.InstanceId} {
+		if id != nil {
+			target = *id
+		}
+	}
+	return &Route{Destination: aws.StringValue(route.DestinationCidrBlock), Target: target, State: aws.StringValue(route.State)}
+}
+
+// routeTarget fills in the route's target, by the kind of id it is.
+func routeTarget(in *ec2.CreateRouteInput, target string) error {
+	switch {
+	case strings.HasPrefix(target, "igw-"):
+		in.GatewayId = aws.String(target)
+	case strings.HasPrefix(target, "nat-"):
+		in.NatGatewayId = aws.String(target)
+	case strings.HasPrefix(target, "pcx-"):
+		in.VpcPeeringConnectionId = aws.String(target)
+	case strings.HasPrefix(target, "i-"):
+		in.InstanceId = aws.String(target)
+	default:
+		return fmt.Errorf("Bad route target: %s (must be an igw-, nat-, pcx- or i- id)", target)
+	}
+	return nil
+}
+
+// mainRouteTable returns the network's main route table, which subnets with no table of their own use.
+func (net *Network) mainRouteTable() (*ec2.RouteTable, error) {
+	res, err := net.Cloud.ec2.DescribeRouteTables(&ec2.DescribeRouteTablesInput{Filters: []*ec2.Filter{
+		filter("vpc-id", net.Id),
+		filter("association.main", "true"),
+	}})
+	if err != nil {
+		return nil, err
+	}
+	if len(res.RouteTables) == 0 {
+		return nil, fmt.Errorf("Network %s has no main route table", net.Name)
+	}
+	return res.RouteTables[0], nil
+}
+
+// routeTables returns all of the network's route tables, the main one first.
+func (net *Network) routeTables() ([]*ec2.RouteTable, error) {
+	res, err := net.Cloud.ec2.DescribeRouteTables(&ec2.DescribeRouteTablesInput{Filters: []*ec2.Filter{filter("vpc-id", net.Id)}})
+	if err != nil {
+		return nil, err
+	}
+	lst := make([]*ec2.RouteTable, 0, len(res.RouteTables))
+	for _, rt := range res.RouteTables {
+		if isMainRouteTable(rt) {
+			lst = append([]*ec2.RouteTable{rt}, lst...)
+		} else {
+			lst = append(lst, rt)
+		}
+	}
+	return lst, nil
+}
+
+// addRoute adds a route for the whole network: to the main route table, and to every zone's. Tables that already
+// have a route for the destination keep it.
+func (net *Network) addRoute(destination string, target string) error {
+	lst, err := net.routeTables()
+	if err != nil {
+		return err
+	}
+	for _, rt := range lst {
+		if findRoute(rt, destination) != nil {
+			continue
+		}
+		in := &ec2.CreateRouteInput{RouteTableId: rt.RouteTableId, DestinationCidrBlock: aws.String(destination)}
+		err = routeTarget(in, target)
+		if err != nil {
+			return err
+		}
+		_, err = net.Cloud.ec2.CreateRoute(in)
+		if err != nil {
+			return err
+		}
+		net.Cloud.record("route", destination, *rt.RouteTableId, "")
+	}
+	return nil
+}
+
+func findRoute(rt *ec2.RouteTable, destination string) *ec2.Route {
+	for _, route := range rt.Routes {
+		if aws.StringValue(route.DestinationCidrBlock) == destination {
+			return route
+		}
+	}
+	return nil
+}
+
+// routeTable returns the zone's own route table, or nil if it uses the main one.
+func (zone *Zone) routeTable() (*ec2.RouteTable, error) {
+	res, err := zone.Network.Cloud.ec2.DescribeRouteTables(&ec2.DescribeRouteTablesInput{Filters: []*ec2.Filter{
+		filter("association.subnet-id", zone.Id),
+	}})
+	if err != nil {
+		return nil, err
+	}
+	for _, rt := range res.RouteTables {
+		if !isMainRouteTable(rt) {
+			return rt, nil
+		}
+	}
+	return nil, nil
+}
+
+// ensureRouteTable returns the zone's own route table, first giving it one if it uses the main one.
+func (zone *Zone) ensureRouteTable() (*ec2.RouteTable, error) {
+	rt, err := zone.routeTable()
+	if err != nil || rt != nil {
+		return rt, err
+	}
+	return zone.createRouteTable()
+}
+
+// createRouteTable gives the zone a route table of its own, starting with the routes the main route table has, and
+// associates all of the zone's subnets with it.
+func (zone *Zone) createRouteTable() (*ec2.RouteTable, error) {
+	net := zone.Network
+	cloud := net.Cloud
+	main, err := net.mainRouteTable()
+	if err != nil {
+		return nil, err
+	}
+	res, err := cloud.ec2.CreateRouteTable(&ec2.CreateRouteTableInput{VpcId: net.vpc.VpcId})
+	if err != nil {
+		return nil, err
+	}
+	rtId := res.RouteTable.RouteTableId
+	cloud.record("route-table", *rtId, "", zone.Name)
+	tags := append(net.tags(zone.Name), &ec2.Tag{Key: aws.String("Zone"), Value: aws.String(zone.Name)})
+	_, err = cloud.ec2.CreateTags(&ec2.CreateTagsInput{Resources: []*string{rtId}, Tags: tags})
+	if err != nil {
+		return nil, err
+	}
+	for _, route := range main.Routes {
+		if aws.StringValue(route.GatewayId) == "local" {
+			continue
+		}
+		//a route over a peering the admin account has yet to accept goes nowhere for now, but will
+		if aws.StringValue(route.State) != "active" && route.VpcPeeringConnectionId == nil {
+			continue
+		}
+		_, err = cloud.ec2.CreateRoute(&ec2.CreateRouteInput{
+			RouteTableId:           rtId,
+			DestinationCidrBlock:   route.DestinationCidrBlock,
+			GatewayId:              route.GatewayId,
+			InstanceId:             route.InstanceId,
+			NatGatewayId:           route.NatGatewayId,
+			VpcPeeringConnectionId: route.VpcPeeringConnectionId,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, sn := range zone.Subnets {
+		assoc, err := cloud.ec2.AssociateRouteTable(&ec2.AssociateRouteTableInput{RouteTableId: rtId, SubnetId: aws.String(sn.Id)})
+		if err != nil {
+			return nil, err
+		}
+		cloud.record("route-table-association", *assoc.AssociationId, *rtId, sn.Id)
+	}
+	if !Quiet {
+		fmt.Printf("Created route table for zone '%s' (%s)\n", zone.Name, *rtId)
+	}
+	return zone.routeTable()
+}
+
+// Routes returns the routes of the zone's route table (the main one, if it has none of its own), and that table's id.
+func (zone *Zone) Routes() (string, []*Route, error) {
+	rt, err := zone.routeTable()
+	if err == nil && rt == nil {
+		rt, err = zone.Network.mainRouteTable()
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	lst := make([]*Route, 0, len(rt.Routes))
+	for _, route := range rt.Routes {
+		lst = append(lst, newRoute(route))
+	}
+	return *rt.RouteTableId, lst, nil
+}
+
+// SetRoute routes the destination net block to the target in the zone's route table, replacing any route it already
+// has for it. A zone that uses the main route table is first given its own.
+func (zone *Zone) SetRoute(destination string, target string) error {
+	if _, err := parseBlock(destination); err != nil {
+		return err
+	}
+	rt, err := zone.ensureRouteTable()
+	if err != nil {
+		return err
+	}
+	if existing := findRoute(rt, destination); existing != nil && aws.StringValue(existing.GatewayId) == "local" {
+		return fmt.Errorf("Cannot change the local route of zone %s", zone.Name)
+	}
+	err = zone.Network.Cloud.putRoute(rt, destination, target)
+	if err != nil {
+		return err
+	}
+	if !Quiet {
+		fmt.Printf("Routed %s to %s in zone '%s'\n", destination, target, zone.Name)
+	}
+	return nil
+}
+
+// putRoute routes the destination net block to the target in the route table, replacing any route it already has for
+// it.
+func (cloud *Cloud) putRoute(rt *ec2.RouteTable, destination string, target string) error {
+	in := &ec2.CreateRouteInput{RouteTableId: rt.RouteTableId, DestinationCidrBlock: aws.String(destination)}
+	err := routeTarget(in, target)
+	if err != nil {
+		return err
+	}
+	if findRoute(rt, destination) != nil {
+		_, err = cloud.ec2.ReplaceRoute(&ec2.ReplaceRouteInput{
+			RouteTableId:           in.RouteTableId,
+			DestinationCidrBlock:   in.DestinationCidrBlock,
+			GatewayId:              in.GatewayId,
+			InstanceId:             in.InstanceId,
+			NatGatewayId:           in.NatGatewayId,
+			VpcPeeringConnectionId: in.VpcPeeringConnectionId,
+		})
+		return err
+	}
+	_, err = cloud.ec2.CreateRoute(in)
+	if err != nil {
+		return err
+	}
+	cloud.record("route", destination, *rt.RouteTableId, "")
+	return nil
+}
+
+// DeleteRoute removes the route for the destination net block from the zone's own route table.
+func (zone *Zone) DeleteRoute(destination string) error {
+	rt, err := zone.routeTable()
+	if err != nil {
+		return err
+	}
+	if rt == nil {
+		return fmt.Errorf("Zone %s has no route table of its own", zone.Name)
+	}
+	existing := findRoute(rt, destination)
+	if existing == nil {
+		return fmt.Errorf("Zone %s has no route for %s", zone.Name, destination)
+	}
+	if aws.StringValue(existing.GatewayId) == "local" {
+		return fmt.Errorf("Cannot delete the local route of zone %s", zone.Name)
+	}
+	_, err = zone.Network.Cloud.ec2.DeleteRoute(&ec2.DeleteRouteInput{RouteTableId: rt.RouteTableId, DestinationCidrBlock: aws.String(destination)})
+	if err != nil {
+		return err
+	}
+	if !Quiet {
+		fmt.Printf("Deleted the route for %s in zone '%s'\n", destination, zone.Name)
+	}
+	return nil
+}
+
+// isMainRouteTable reports whether the route table is its VPC's main one, used by subnets with no table of their own.
+func isMainRouteTable(rt *ec2.RouteTable) bool {
+	for _, assoc := range rt.Associations {
+		if aws.BoolValue(assoc.Main) {
+			return true
+		}
+	}
+	return false
+}
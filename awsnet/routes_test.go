@@ -0,0 +1,90 @@
+package awsnet
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNetworkRoutes(t *testing.T) {
+	cloud, _ := newTestCloud(t)
+	err := cloud.Setup("0.0.0.0/0", AdminNetBlock, BastionNetBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	net, err := cloud.CreateNetwork("myapp", "10.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fe, err := net.CreateZone("fe", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gwId, err := net.ensureInternetGateway()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = net.addRoute("192.168.0.0/16", *gwId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	main, err := net.mainRouteTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if findRoute(main, "192.168.0.0/16") == nil {
+		t.Fatal("Expected the main route table to get the network's route")
+	}
+	be, err := net.CreateZone("be", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, zone := range []*Zone{fe, be} {
+		rt, err := zone.routeTable()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rt == nil || *rt.RouteTableId == *main.RouteTableId {
+			t.Fatalf("Expected zone %s to have a route table of its own", zone.Name)
+		}
+		if findRoute(rt, "192.168.0.0/16") == nil {
+			t.Errorf("Expected the route table of zone %s to have the network's route", zone.Name)
+		}
+	}
+}
+
+func TestLocalRouteRefused(t *testing.T) {
+	cloud, _ := newTestCloud(t)
+	err := cloud.Setup("0.0.0.0/0", AdminNetBlock, BastionNetBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	net, err := cloud.CreateNetwork("myapp", "10.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone, err := net.CreateZone("fe", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gwId, err := net.ensureInternetGateway()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = zone.SetRoute("10.0.0.0/24", *gwId)
+	if err == nil || !strings.Contains(err.Error(), "local route") {
+		t.Fatalf("Expected the local route not to be replaced, got %v", err)
+	}
+	err = zone.DeleteRoute("10.0.0.0/24")
+	if err == nil || !strings.Contains(err.Error(), "local route") {
+		t.Fatalf("Expected the local route not to be deleted, got %v", err)
+	}
+	_, routes, err := zone.Routes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range routes {
+		if r.Destination == "10.0.0.0/24" && r.Target != "local" {
+			t.Fatalf("Expected the local route to be left alone, got %s", r)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package awsnet
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The scp protocol, spoken to the remote host's own scp in source (-f) or sink (-t) mode over an SSH session. Every
+// message is acknowledged with a single byte: 0 for ok, 1 for a warning, 2 for an error, the latter two followed by a
+// message line.
+
+// Put copies the local file or directory src to dst on the remote host, recursively and preserving modes and
+// modification times, like scp -rp.
+func (conn *Conn) Put(src string, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	return conn.scp("scp -rpt "+shellQuote(dst), func(w io.Writer, r *bufio.Reader) error {
+		return scpSend(w, r, src, info, conn.Progress)
+	})
+}
+
+// Get copies the file or directory src on the remote host to the local dst, recursively and preserving modes and
+// modification times, like scp -rp.
+func (conn *Conn) Get(src string, dst string) error {
+	return conn.scp("scp -rpf "+shellQuote(src), func(w io.Writer, r *bufio.Reader) error {
+		return scpReceive(w, r, dst, conn.Progress)
+	})
+}
+
+// Put copies the local file or directory src to dst on the machine, through the jumphost if need be. Progress is
+// reported unless Quiet.
+func (machine *Machine) Put(keyname string, src string, dst string) error {
+	conn, err := machine.connectForCopy(keyname)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Put(src, dst)
+}
+
+// Get copies the file or directory src on the machine to the local dst, through the jumphost if need be. Progress
+// is reported unless Quiet.
+func (machine *Machine) Get(keyname string, src string, dst string) error {
+	conn, err := machine.connectForCopy(keyname)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Get(src, dst)
+}
+
+func (machine *Machine) connectForCopy(keyname string) (*Conn, error) {
+	conn, err := machine.Connect(keyname)
+	if err == nil && !Quiet {
+		conn.Progress = os.Stdout
+	}
+	return conn, err
+}
+
+func (conn *Conn) scp(command string, transfer func(w io.Writer, r *bufio.Reader) error) error {
+	session, err := conn.client.NewSession()
+	if err != nil {
+		return fmt.Errorf("Cannot open session on %s: %v", conn.Host, err)
+	}
+	defer session.Close()
+	w, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	out, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	if !Quiet {
+		fmt.Printf("[%s on %s]\n", command, conn.Host)
+	}
+	err = session.Start(command)
+	if err != nil {
+		return fmt.Errorf("Cannot run scp on %s: %v", conn.Host, err)
+	}
+	err = transfer(w, bufio.NewReader(out))
+	w.Close()
+	werr := conn.exitError(session.Wait())
+	if err != nil {
+		return fmt.Errorf("Cannot copy to or from %s: %v", conn.Host, err)
+	}
+	if e, ok := werr.(*ExitError); ok {
+		e.Stderr = lastLine(stderr.String())
+	}
+	return werr
+}
+
+func scpAck(r *bufio.Reader) error {
+	b, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+	msg, _ := r.ReadString('\n')
+	return fmt.Errorf("%s", strings.TrimSpace(msg))
+}
+
+func scpSend(w io.Writer, r *bufio.Reader, path string, info os.FileInfo, prog io.Writer) error {
+	err := scpAck(r) //the sink says when it is ready, and then acks every message
+	if err != nil {
+		return err
+	}
+	return scpSendEntry(w, r, path, info, prog)
+}
+
+func scpSendEntry(w io.Writer, r *bufio.Reader, path string, info os.FileInfo, prog io.Writer) error {
+	mtime := info.ModTime().Unix()
+	_, err := fmt.Fprintf(w, "T%d 0 %d 0\n", mtime, mtime)
+	if err == nil {
+		err = scpAck(r)
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		_, err = fmt.Fprintf(w, "D%04o 0 %s\n", info.Mode().Perm(), info.Name())
+		if err == nil {
+			err = scpAck(r)
+		}
+		if err != nil {
+			return err
+		}
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			child := filepath.Join(path, entry.Name())
+			entry, err = os.Stat(child) //follow symlinks, like scp
+			if err != nil {
+				return err
+			}
+			if !entry.IsDir() && !entry.Mode().IsRegular() {
+				continue
+			}
+			err = scpSendEntry(w, r, child, entry, prog)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = fmt.Fprintf(w, "E\n")
+		if err == nil {
+			err = scpAck(r)
+		}
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(w, "C%04o %d %s\n", info.Mode().Perm(), info.Size(), info.Name())
+	if err == nil {
+		err = scpAck(r)
+	}
+	if err != nil {
+		return err
+	}
+	p := newProgress(prog, path, info.Size())
+	_, err = io.CopyN(w, io.TeeReader(f, p), info.Size())
+	p.finish()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte{0})
+	if err != nil {
+		return err
+	}
+	return scpAck(r)
+}
+
+func scpReceive(w io.Writer, r *bufio.Reader, dst string, prog io.Writer) error {
+	ok := func() error {
+		_, err := w.Write([]byte{0})
+		return err
+	}
+	target := func(dir string, name string) string {
+		if dir != "" {
+			return filepath.Join(dir, name)
+		}
+		if info, err := os.Stat(dst); err == nil && info.IsDir() {
+			return filepath.Join(dst, name)
+		}
+		return dst
+	}
+	var dirs []string        //the local directories being received into, innermost last
+	var dirTimes []time.Time //and their modification times, applied once they are complete
+	var mtime time.Time
+	err := ok()
+	for err == nil {
+		var line string
+		line, err = r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		dir := ""
+		if len(dirs) > 0 {
+			dir = dirs[len(dirs)-1]
+		}
+		switch line[0] {
+		case 1, 2:
+			err = fmt.Errorf("%s", strings.TrimSpace(line[1:]))
+		case 'T':
+			var m, ma, a, aa int64
+			_, err = fmt.Sscanf(line, "T%d %d %d %d\n", &m, &ma, &a, &aa)
+			if err == nil {
+				mtime = time.Unix(m, 0)
+				err = ok()
+			}
+		case 'D':
+			var mode os.FileMode
+			var name string
+			mode, _, name, err = scpHeader(line)
+			if err == nil {
+				path := target(dir, name)
+				err = os.MkdirAll(path, mode|0700)
+				if err == nil {
+					os.Chmod(path, mode)
+					dirs = append(dirs, path)
+					dirTimes = append(dirTimes, mtime)
+					mtime = time.Time{}
+					err = ok()
+				}
+			}
+		case 'E':
+			if len(dirs) == 0 {
+				return fmt.Errorf("Unexpected end of directory from scp")
+			}
+			if t := dirTimes[len(dirTimes)-1]; !t.IsZero() {
+				os.Chtimes(dir, t, t)
+			}
+			dirs = dirs[:len(dirs)-1]
+			dirTimes = dirTimes[:len(dirTimes)-1]
+			err = ok()
+		case 'C':
+			var mode os.FileMode
+			var size int64
+			var name string
+			mode, size, name, err = scpHeader(line)
+			if err == nil {
+				err = ok()
+			}
+			if err == nil {
+				err = scpReceiveFile(r, target(dir, name), mode, size, mtime, prog)
+				mtime = time.Time{}
+			}
+			if err == nil {
+				err = scpAck(r)
+			}
+			if err == nil {
+				err = ok()
+			}
+		default:
+			err = fmt.Errorf("Unexpected message from scp: %q", line)
+		}
+	}
+	return err
+}
+
+func scpReceiveFile(r io.Reader, path string, mode os.FileMode, size int64, mtime time.Time, prog io.Writer) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	p := newProgress(prog, path, size)
+	_, err = io.CopyN(io.MultiWriter(f, p), r, size)
+	p.finish()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	os.Chmod(path, mode)
+	if !mtime.IsZero() {
+		os.Chtimes(path, mtime, mtime)
+	}
+	return nil
+}
+
+// scpHeader parses a "C0644 1234 name" or "D0755 0 name" message.
+func scpHeader(line string) (os.FileMode, int64, string, error) {
+	parts := strings.SplitN(strings.TrimRight(line[1:], "\n"), " ", 3)
+	if len(parts) != 3 {
+		return 0, 0, "", fmt.Errorf("Bad message from scp: %q", line)
+	}
+	mode, err := strconv.ParseUint(parts[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("Bad mode from scp: %q", line)
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("Bad size from scp: %q", line)
+	}
+	name := parts[2]
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return 0, 0, "", fmt.Errorf("Bad file name from scp: %q", name)
+	}
+	return os.FileMode(mode).Perm(), size, name, nil
+}
+
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_./~+,:=@-]+$`)
+
+// shellQuote quotes a remote path for the remote shell, leaving plain ones (and so a leading ~) alone.
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// progress reports how far along the copy of a file is, on a single line that is rewritten at most a few times a
+// second. With nowhere to report to, it only counts.
+type progress struct {
+	out   io.Writer
+	name  string
+	total int64
+	done  int64
+	shown time.Time
+}
+
+func newProgress(out io.Writer, name string, total int64) *progress {
+	return &progress{out: out, name: name, total: total}
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	if p.out != nil && time.Since(p.shown) > 200*time.Millisecond {
+		p.show()
+	}
+	return len(b), nil
+}
+
+func (p *progress) show() {
+	pct := int64(100)
+	if p.total > 0 {
+		pct = p.done * 100 / p.total
+	}
+	fmt.Fprintf(p.out, "\r%-48s %3d%% %9s", p.name, pct, byteSize(p.done))
+	p.shown = time.Now()
+}
+
+func (p *progress) finish() {
+	if p.out != nil {
+		p.show()
+		fmt.Fprintln(p.out)
+	}
+}
+
+func byteSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -0,0 +1,62 @@
+package awsnet
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+	"io"
+	"os"
+)
+
+// Shell runs an interactive login shell on the remote host. When in is a terminal, the shell gets a PTY of the same
+// size, the local terminal is in raw mode until the shell exits, and window size changes are passed along.
+func (conn *Conn) Shell(in *os.File, out io.Writer, errOut io.Writer) error {
+	session, err := conn.client.NewSession()
+	if err != nil {
+		return fmt.Errorf("Cannot open session on %s: %v", conn.Host, err)
+	}
+	defer session.Close()
+	fd := int(in.Fd())
+	if term.IsTerminal(fd) {
+		width, height, err := term.GetSize(fd)
+		if err != nil {
+			width, height = 80, 24
+		}
+		termType := os.Getenv("TERM")
+		if termType == "" {
+			termType = "xterm"
+		}
+		modes := ssh.TerminalModes{ssh.ECHO: 1, ssh.TTY_OP_ISPEED: 14400, ssh.TTY_OP_OSPEED: 14400}
+		err = session.RequestPty(termType, height, width, modes)
+		if err != nil {
+			return fmt.Errorf("Cannot get a terminal on %s: %v", conn.Host, err)
+		}
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(fd, state)
+		stop := watchWindowSize(fd, func(width int, height int) {
+			session.WindowChange(height, width)
+		})
+		defer stop()
+	}
+	session.Stdin = in
+	session.Stdout = out
+	session.Stderr = errOut
+	err = session.Shell()
+	if err != nil {
+		return fmt.Errorf("Cannot start shell on %s: %v", conn.Host, err)
+	}
+	return conn.exitError(session.Wait())
+}
+
+// Shell opens an interactive shell on the machine, through the jumphost if need be.
+func (machine *Machine) Shell(keyname string, in *os.File, out io.Writer, errOut io.Writer) error {
+	conn, err := machine.Connect(keyname)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Shell(in, out, errOut)
+}
@@ -0,0 +1,405 @@
+package awsnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A Spec declares the networks, zones and machines an environment should have. The admin network is not part of
+// it, that is managed by Setup and Cleanup.
+type Spec struct {
+	Env      string         `json:"env,omitempty" yaml:"env,omitempty"`
+	Defaults MachineSpec    `json:"defaults,omitempty" yaml:"defaults,omitempty"`
+	Networks []*NetworkSpec `json:"networks" yaml:"networks"`
+}
+
+// a NetworkSpec or ZoneSpec with no cidr gets the next free block when it is created, and any block once it exists.
+type NetworkSpec struct {
+	Name     string         `json:"name" yaml:"name"`
+	Cidr     string         `json:"cidr,omitempty" yaml:"cidr,omitempty"`
+	Zones    []*ZoneSpec    `json:"zones,omitempty" yaml:"zones,omitempty"`
+	Machines []*MachineSpec `json:"machines,omitempty" yaml:"machines,omitempty"`
+}
+
+// a ZoneSpec's cidr is the zone's whole block: with spread, the one carved into a subnet in each of the first spread
+// availability zones (see CreateSpreadZone), otherwise that of its one subnet, in az if given. A private zone gets
+// the network's nat zone along with it, which is left out of the spec.
+type ZoneSpec struct {
+	Name    string `json:"name" yaml:"name"`
+	Cidr    string `json:"cidr,omitempty" yaml:"cidr,omitempty"`
+	Az      string `json:"az,omitempty" yaml:"az,omitempty"`
+	Spread  int    `json:"spread,omitempty" yaml:"spread,omitempty"`
+	Private bool   `json:"private,omitempty" yaml:"private,omitempty"`
+}
+
+// a MachineSpec names a machine in its network, and the zone it runs in. Empty fields take the Spec's defaults.
+type MachineSpec struct {
+	Name  string `json:"name,omitempty" yaml:"name,omitempty"`
+	Zone  string `json:"zone,omitempty" yaml:"zone,omitempty"`
+	Image string `json:"image,omitempty" yaml:"image,omitempty"`
+	Type  string `json:"type,omitempty" yaml:"type,omitempty"`
+	Key   string `json:"key,omitempty" yaml:"key,omitempty"`
+}
+
+// LoadSpec reads a spec from a YAML (.yaml or .yml) or JSON file.
+func LoadSpec(path string) (*Spec, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	spec := &Spec{}
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".yaml" || ext == ".yml" {
+		err = yaml.Unmarshal(data, spec)
+	} else {
+		err = json.Unmarshal(data, spec)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse spec %s: %v", path, err)
+	}
+	return spec, spec.validate()
+}
+
+func (spec *Spec) validate() error {
+	nets := make(map[string]bool)
+	for _, ns := range spec.Networks {
+		if ns.Name == "" {
+			return fmt.Errorf("Every network in the spec needs a name")
+		}
+		if ns.Name == AdminNetName {
+			return fmt.Errorf("The admin network cannot be part of a spec, use setup")
+		}
+		if nets[ns.Name] {
+			return fmt.Errorf("Network '%s' is in the spec more than once", ns.Name)
+		}
+		nets[ns.Name] = true
+		zones := make(map[string]bool)
+		for _, zs := range ns.Zones {
+			if zs.Name == "" {
+				return fmt.Errorf("Every zone in network '%s' needs a name", ns.Name)
+			}
+			if zs.Name == NatZoneName {
+				return fmt.Errorf("The %s zone cannot be part of a spec, it comes with the private zones", NatZoneName)
+			}
+			if zones[zs.Name] {
+				return fmt.Errorf("Zone '%s' is in network '%s' more than once", zs.Name, ns.Name)
+			}
+			if zs.Spread < 0 || zs.Spread > 0 && zs.Az != "" {
+				return fmt.Errorf("Zone '%s' in network '%s' needs either an az or a spread", zs.Name, ns.Name)
+			}
+			zones[zs.Name] = true
+		}
+		machines := make(map[string]bool)
+		for _, ms := range ns.Machines {
+			if ms.Name == "" {
+				return fmt.Errorf("Every machine in network '%s' needs a name", ns.Name)
+			}
+			if !zones[ms.Zone] {
+				return fmt.Errorf("Machine '%s' is not in a zone of network '%s'", ms.Name, ns.Name)
+			}
+			if machines[ms.Name] {
+				return fmt.Errorf("Machine '%s' is in network '%s' more than once", ms.Name, ns.Name)
+			}
+			machines[ms.Name] = true
+		}
+	}
+	return nil
+}
+
+// resolve fills in the empty fields of a machine spec from the defaults.
+func (spec *Spec) resolve(ms *MachineSpec) *MachineSpec {
+	result := *ms
+	if result.Image == "" {
+		result.Image = spec.Defaults.Image
+	}
+	if result.Type == "" {
+		result.Type = spec.Defaults.Type
+	}
+	if result.Key == "" {
+		result.Key = spec.Defaults.Key
+	}
+	return &result
+}
+
+// a Change is one step of a Plan: creating, destroying or replacing a network, zone or machine, starting a stopped
+// machine, or making a zone private.
+type Change struct {
+	Action string //"create", "start", "update", "destroy", or "replace"
+	Kind   string //"network", "zone", or "machine"
+	Name   string
+	Detail string
+	apply  func() error
+}
+
+func (change *Change) String() string {
+	sym := map[string]string{"create": "+", "start": ">", "update": "*", "destroy": "-", "replace": "~"}[change.Action]
+	s := fmt.Sprintf("%s %s %s", sym, change.Kind, change.Name)
+	if change.Detail != "" {
+		s += " (" + change.Detail + ")"
+	}
+	return s
+}
+
+// a Plan is the list of changes that brings an environment in line with a Spec, in the order they must be made.
+type Plan struct {
+	Changes []*Change
+}
+
+func (plan *Plan) String() string {
+	if len(plan.Changes) == 0 {
+		return "No changes"
+	}
+	lines := make([]string, 0, len(plan.Changes))
+	for _, change := range plan.Changes {
+		lines = append(lines, change.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Plan compares the spec against the networks, zones and machines that exist in the environment. Removals come first,
+// so that zones are empty and address space is free by the time anything is created. A network or zone whose
+// address block differs from the spec is an error: destroying it is too drastic to do implicitly.
+func (cloud *Cloud) Plan(spec *Spec) (*Plan, error) {
+	if spec.Env != "" && spec.Env != cloud.Name {
+		return nil, fmt.Errorf("Spec is for environment '%s', not '%s'", spec.Env, cloud.Name)
+	}
+	nets, err := cloud.ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]*Network)
+	for _, net := range nets {
+		existing[net.shortName()] = net
+	}
+	removals := make([]*Change, 0)
+	creations := make([]*Change, 0)
+	wanted := make(map[string]bool)
+	for _, ns := range spec.Networks {
+		wanted[ns.Name] = true
+		net := existing[ns.Name]
+		if net == nil {
+			creations = append(creations, cloud.createNetworkChange(ns))
+			for _, zs := range ns.Zones {
+				creations = append(creations, cloud.createZoneChange(ns.Name, zs))
+			}
+			for _, ms := range ns.Machines {
+				creations = append(creations, cloud.launchMachineChange(ns.Name, spec.resolve(ms)))
+			}
+			continue
+		}
+		if ns.Cidr != "" && net.AddressBlock != ns.Cidr {
+			return nil, fmt.Errorf("Network %s is %s, but the spec says %s. Destroy it first to change it", net.Name, net.AddressBlock, ns.Cidr)
+		}
+		r, c, err := cloud.planNetwork(spec, ns, net)
+		if err != nil {
+			return nil, err
+		}
+		removals = append(removals, r...)
+		creations = append(creations, c...)
+	}
+	names := make([]string, 0)
+	for name := range existing {
+		if name != AdminNetName && !wanted[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		removals = append(removals, cloud.destroyNetworkChange(existing[name]))
+	}
+	return &Plan{Changes: append(removals, creations...)}, nil
+}
+
+func (cloud *Cloud) planNetwork(spec *Spec, ns *NetworkSpec, net *Network) ([]*Change, []*Change, error) {
+	removals := make([]*Change, 0)
+	creations := make([]*Change, 0)
+	zones, err := net.ListZones()
+	if err != nil {
+		return nil, nil, err
+	}
+	zonesById := make(map[string]string)
+	existingZones := make(map[string]*Zone)
+	for _, zone := range zones {
+		name := strings.TrimPrefix(zone.Name, net.Name+".")
+		for _, sn := range zone.Subnets {
+			zonesById[sn.Id] = name
+		}
+		//the nat zone goes with the network, once it has a private zone
+		if name != NatZoneName {
+			existingZones[name] = zone
+		}
+	}
+	wantedZones := make(map[string]bool)
+	for _, zs := range ns.Zones {
+		wantedZones[zs.Name] = true
+		zone := existingZones[zs.Name]
+		if zone == nil {
+			creations = append(creations, cloud.createZoneChange(ns.Name, zs))
+		} else if block := zone.WholeBlock(); zs.Cidr != "" && block != zs.Cidr {
+			return nil, nil, fmt.Errorf("Zone %s is %s, but the spec says %s. Destroy it first to change it", zone.Name, block, zs.Cidr)
+		} else if zs.Spread > 0 && len(zone.Subnets) != zs.Spread {
+			return nil, nil, fmt.Errorf("Zone %s is spread across %d availability zones, but the spec says %d. Destroy it first to change it", zone.Name, len(zone.Subnets), zs.Spread)
+		} else if zs.Az != "" && (len(zone.Subnets) != 1 || zone.AvailabilityZone != zs.Az) {
+			return nil, nil, fmt.Errorf("Zone %s is not just in %s, as the spec says. Destroy it first to change it", zone.Name, zs.Az)
+		} else if zone.Private && !zs.Private {
+			return nil, nil, fmt.Errorf("Zone %s is private, but the spec says public. Destroy it first to change it", zone.Name)
+		} else if zs.Private && !zone.Private {
+			creations = append(creations, &Change{Action: "update", Kind: "zone", Name: zone.Name, Detail: "private", apply: zone.MakePrivate})
+		}
+	}
+	//stopped machines are still there, they only need starting
+	instances, err := net.listInstancesIn("pending", "running", "stopping", "stopped")
+	if err != nil {
+		return nil, nil, err
+	}
+	existingMachines := make(map[string]*Machine)
+	for _, inst := range instances {
+		machine := cloud.newMachine(inst)
+		existingMachines[strings.TrimPrefix(machine.Name, net.Name+".")] = machine
+	}
+	wantedMachines := make(map[string]bool)
+	for _, ms := range ns.Machines {
+		ms = spec.resolve(ms)
+		wantedMachines[ms.Name] = true
+		machine := existingMachines[ms.Name]
+		if machine == nil {
+			creations = append(creations, cloud.launchMachineChange(ns.Name, ms))
+			continue
+		}
+		diffs := make([]string, 0)
+		if zone := zonesById[machine.SubnetId()]; zone != ms.Zone {
+			diffs = append(diffs, "zone "+zone+" -> "+ms.Zone)
+		}
+		if ms.Image != "" && machine.ImageId() != ms.Image {
+			diffs = append(diffs, "image "+machine.ImageId()+" -> "+ms.Image)
+		}
+		if ms.Type != "" && machine.InstanceType() != ms.Type {
+			diffs = append(diffs, "type "+machine.InstanceType()+" -> "+ms.Type)
+		}
+		if len(diffs) > 0 {
+			//a replacement is terminated along with the other removals, and launched again with the creations
+			removals = append(removals, &Change{Action: "replace", Kind: "machine", Name: machine.Name, Detail: strings.Join(diffs, ", "), apply: machine.Terminate})
+			creations = append(creations, cloud.launchMachineChange(ns.Name, ms))
+		} else if state := machine.State(); state == "stopping" || state == "stopped" {
+			creations = append(creations, &Change{Action: "start", Kind: "machine", Name: machine.Name, Detail: machine.Id(), apply: machine.Start})
+		}
+	}
+	names := make([]string, 0)
+	for name := range existingMachines {
+		if !wantedMachines[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m := existingMachines[name]
+		removals = append(removals, &Change{Action: "destroy", Kind: "machine", Name: m.Name, Detail: m.Id(), apply: m.Terminate})
+	}
+	names = make([]string, 0)
+	for name := range existingZones {
+		if !wantedZones[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		zone := existingZones[name]
+		removals = append(removals, &Change{Action: "destroy", Kind: "zone", Name: zone.Name, Detail: zone.WholeBlock(), apply: zone.Destroy})
+	}
+	return removals, creations, nil
+}
+
+func (cloud *Cloud) createNetworkChange(ns *NetworkSpec) *Change {
+	return &Change{Action: "create", Kind: "network", Name: cloud.Name + "." + ns.Name, Detail: ns.Cidr, apply: func() error {
+		_, err := cloud.CreateNetwork(ns.Name, ns.Cidr)
+		return err
+	}}
+}
+
+func (cloud *Cloud) destroyNetworkChange(net *Network) *Change {
+	return &Change{Action: "destroy", Kind: "network", Name: net.Name, Detail: net.AddressBlock, apply: func() error {
+		return cloud.DestroyNetwork(net.shortName())
+	}}
+}
+
+func (cloud *Cloud) createZoneChange(netName string, zs *ZoneSpec) *Change {
+	details := make([]string, 0)
+	if zs.Cidr != "" {
+		details = append(details, zs.Cidr)
+	}
+	if zs.Az != "" {
+		details = append(details, "in "+zs.Az)
+	}
+	if zs.Spread > 0 {
+		details = append(details, fmt.Sprintf("spread across %d", zs.Spread))
+	}
+	if zs.Private {
+		details = append(details, "private")
+	}
+	return &Change{Action: "create", Kind: "zone", Name: cloud.Name + "." + netName + "." + zs.Name, Detail: strings.Join(details, " "), apply: func() error {
+		net, err := cloud.FindNetwork(netName)
+		if err != nil {
+			return err
+		}
+		if net == nil {
+			return fmt.Errorf("No such network: %s.%s", cloud.Name, netName)
+		}
+		if zs.Spread > 0 {
+			_, err = net.CreateSpreadZone(zs.Name, zs.Cidr, zs.Spread, zs.Private)
+		} else {
+			_, err = net.CreateZoneIn(zs.Name, zs.Cidr, zs.Az, zs.Private)
+		}
+		return err
+	}}
+}
+
+func (cloud *Cloud) launchMachineChange(netName string, ms *MachineSpec) *Change {
+	zoneName := cloud.Name + "." + netName + "." + ms.Zone
+	detail := fmt.Sprintf("%s in %s", ms.Image, zoneName)
+	if ms.Type != "" {
+		detail = fmt.Sprintf("%s %s in %s", ms.Type, ms.Image, zoneName)
+	}
+	return &Change{Action: "create", Kind: "machine", Name: cloud.Name + "." + netName + "." + ms.Name, Detail: detail, apply: func() error {
+		zone, err := cloud.GetZone(zoneName)
+		if err != nil {
+			return err
+		}
+		if zone == nil {
+			return fmt.Errorf("No such zone: %s", zoneName)
+		}
+		_, err = cloud.LaunchMachine(zone, ms.Name, ms.Key, ms.Image, ms.Type)
+		return err
+	}}
+}
+
+// Destructive reports whether the plan destroys or replaces anything.
+func (plan *Plan) Destructive() bool {
+	for _, change := range plan.Changes {
+		if change.Action == "destroy" || change.Action == "replace" {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply makes the changes in the plan, in order, stopping at the first failure. With DryRun set, it makes none.
+func (cloud *Cloud) Apply(plan *Plan) error {
+	if cloud.DryRun {
+		return nil
+	}
+	for _, change := range plan.Changes {
+		if !Quiet {
+			fmt.Println(change)
+		}
+		err := change.apply()
+		if err != nil {
+			return fmt.Errorf("Failed to %s %s %s: %v", change.Action, change.Kind, change.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package awsnet
+
+import (
+	"testing"
+)
+
+// applySpec plans the spec against the cloud and applies the plan, and returns the plan.
+func applySpec(t *testing.T, cloud *Cloud, spec *Spec) *Plan {
+	err := spec.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := cloud.Plan(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cloud.Apply(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plan
+}
+
+func TestApplyWithoutCidrs(t *testing.T) {
+	cloud, _ := newTestCloud(t)
+	err := cloud.Setup("0.0.0.0/0", AdminNetBlock, BastionNetBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := &Spec{Networks: []*NetworkSpec{
+		&NetworkSpec{Name: "myapp", Zones: []*ZoneSpec{&ZoneSpec{Name: "fe"}}},
+	}}
+	applySpec(t, cloud, spec)
+	zone, err := cloud.GetZone("dev.myapp.fe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zone == nil || zone.AddressBlock != "10.0.0.0/28" || zone.Network.AddressBlock != "10.0.0.0/24" {
+		t.Fatalf("Expected the zone to be created in the next free blocks, got %v", zone)
+	}
+	if plan := applySpec(t, cloud, spec); len(plan.Changes) != 0 {
+		t.Fatalf("Expected no changes once applied, got %s", plan)
+	}
+}
+
+func TestApplyStartsStoppedMachine(t *testing.T) {
+	cloud, fake := newTestCloud(t)
+	err := cloud.Setup("0.0.0.0/0", AdminNetBlock, BastionNetBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := &Spec{Defaults: MachineSpec{Image: "ami-1", Type: "t1.micro", Key: "k"}, Networks: []*NetworkSpec{
+		&NetworkSpec{Name: "myapp", Zones: []*ZoneSpec{&ZoneSpec{Name: "fe"}}, Machines: []*MachineSpec{&MachineSpec{Name: "web", Zone: "fe"}}},
+	}}
+	applySpec(t, cloud, spec)
+	net, err := cloud.FindNetwork("myapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = net.Stop(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := live(fake)
+	plan := applySpec(t, cloud, spec)
+	if len(plan.Changes) != 1 || plan.Changes[0].Action != "start" {
+		t.Fatalf("Expected the stopped machine to be started, got %s", plan)
+	}
+	if live(fake) != before {
+		t.Fatalf("Expected starting the machine to create nothing, got %s", live(fake))
+	}
+	machines, err := net.ListMachines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(machines) != 1 || machines[0].State() != "running" {
+		t.Fatalf("Expected the machine to be running again, got %v", machines)
+	}
+}
+
+func TestApplySpreadZone(t *testing.T) {
+	cloud, _ := newTestCloud(t)
+	err := cloud.Setup("0.0.0.0/0", AdminNetBlock, BastionNetBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := &Spec{Networks: []*NetworkSpec{
+		&NetworkSpec{Name: "myapp", Cidr: "10.0.0.0/24", Zones: []*ZoneSpec{&ZoneSpec{Name: "fe", Cidr: "10.0.0.0/26", Spread: 2}}},
+	}}
+	applySpec(t, cloud, spec)
+	zone, err := cloud.GetZone("dev.myapp.fe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zone == nil || len(zone.Subnets) != 2 || zone.WholeBlock() != "10.0.0.0/26" {
+		t.Fatalf("Expected the zone to be spread across two availability zones, got %v", zone)
+	}
+	if plan := applySpec(t, cloud, spec); len(plan.Changes) != 0 {
+		t.Fatalf("Expected no changes once applied, got %s", plan)
+	}
+	spec.Networks[0].Zones[0].Spread = 3
+	_, err = cloud.Plan(spec)
+	if err == nil {
+		t.Fatal("Expected a zone spread across fewer availability zones than the spec says to be refused")
+	}
+}
+
+func TestApplyPrivateZone(t *testing.T) {
+	cloud, _ := newTestCloud(t)
+	err := cloud.Setup("0.0.0.0/0", AdminNetBlock, BastionNetBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := &Spec{Networks: []*NetworkSpec{
+		&NetworkSpec{Name: "myapp", Zones: []*ZoneSpec{&ZoneSpec{Name: "fe"}, &ZoneSpec{Name: "be", Private: true}}},
+	}}
+	applySpec(t, cloud, spec)
+	zone, err := cloud.GetZone("dev.myapp.be")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zone == nil || !zone.Private {
+		t.Fatalf("Expected a private zone, got %v", zone)
+	}
+	if plan := applySpec(t, cloud, spec); len(plan.Changes) != 0 {
+		t.Fatalf("Expected no changes once applied, and the nat zone to be left alone, got %s", plan)
+	}
+
+	spec.Networks[0].Zones[0].Private = true
+	plan := applySpec(t, cloud, spec)
+	if len(plan.Changes) != 1 || plan.Changes[0].Action != "update" {
+		t.Fatalf("Expected the public zone to be made private, got %s", plan)
+	}
+	zone, err = cloud.GetZone("dev.myapp.fe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !zone.Private {
+		t.Fatalf("Expected zone %s to be private", zone.Name)
+	}
+	spec.Networks[0].Zones[0].Private = false
+	_, err = cloud.Plan(spec)
+	if err == nil {
+		t.Fatal("Expected a private zone not to be made public")
+	}
+}
@@ -0,0 +1,258 @@
+package awsnet
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// SSHUser is the login user for images that nothing else names one for.
+const SSHUser = "ec2-user"
+
+// ImageUsers maps image ids to their login user, i.e. "ubuntu" for Ubuntu's AMIs and "admin" for Debian's.
+var ImageUsers = map[string]string{}
+
+// loginUser resolves the user to log in to the instance as: the cloud's User override (i.e. a -u flag), the User tag
+// set at launch, the image's entry in ImageUsers, or else SSHUser.
+func (cloud *Cloud) loginUser(inst *ec2.Instance) string {
+	if cloud.User != "" {
+		return cloud.User
+	}
+	if user := findTag(inst.Tags, "User"); user != "" {
+		return user
+	}
+	return cloud.imageUser(aws.StringValue(inst.ImageId))
+}
+
+// imageUser is the user that machines launched from the image get tagged with.
+func (cloud *Cloud) imageUser(image string) string {
+	if cloud.User != "" {
+		return cloud.User
+	}
+	if user, ok := ImageUsers[image]; ok {
+		return user
+	}
+	return SSHUser
+}
+
+// ExitError is returned when a remote command ran, but did not exit cleanly.
+type ExitError struct {
+	Host   string
+	Status int
+	Signal string //set when the command was killed by a signal
+	Stderr string //the tail of the command's error output, when it was captured
+}
+
+func (e *ExitError) Error() string {
+	s := fmt.Sprintf("Command on %s exited with status %d", e.Host, e.Status)
+	if e.Signal != "" {
+		s = fmt.Sprintf("Command on %s was killed by signal %s", e.Host, e.Signal)
+	}
+	if e.Stderr != "" {
+		s += ": " + e.Stderr
+	}
+	return s
+}
+
+// Conn is an SSH connection to a machine, possibly tunneled through the admin jumphost.
+type Conn struct {
+	Host     string
+	Progress io.Writer //when set, Put and Get report each file's progress to it
+	client   *ssh.Client
+	jump     *Conn //the jumphost connection this one goes through, if any
+}
+
+// Close the connection, and the jumphost connection under it.
+func (conn *Conn) Close() error {
+	err := conn.client.Close()
+	if conn.jump != nil {
+		conn.jump.Close()
+	}
+	return err
+}
+
+// Run runs the command on the remote host, streaming its output to stdout and stderr (either may be nil). A command
+// that runs but fails is returned as an *ExitError.
+func (conn *Conn) Run(command string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	session, err := conn.client.NewSession()
+	if err != nil {
+		return fmt.Errorf("Cannot open session on %s: %v", conn.Host, err)
+	}
+	defer session.Close()
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+	return conn.exitError(session.Run(command))
+}
+
+// Output runs the command on the remote host and returns its standard output. On failure, the tail of its error output
+// is included in the *ExitError.
+func (conn *Conn) Output(command string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	err := conn.Run(command, nil, &stdout, &stderr)
+	if e, ok := err.(*ExitError); ok {
+		e.Stderr = lastLine(stderr.String())
+	}
+	return stdout.String(), err
+}
+
+func (conn *Conn) exitError(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch e := err.(type) {
+	case *ssh.ExitError:
+		return &ExitError{Host: conn.Host, Status: e.ExitStatus(), Signal: e.Signal()}
+	case *ssh.ExitMissingError:
+		return &ExitError{Host: conn.Host, Status: -1, Signal: "(connection lost)"}
+	}
+	return fmt.Errorf("Cannot run command on %s: %v", conn.Host, err)
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+func (cloud *Cloud) sshConfig(inst *ec2.Instance, keyname string) (*ssh.ClientConfig, error) {
+	keyname = machineKey(inst, keyname)
+	if keyname == "" {
+		return nil, fmt.Errorf("No key known for %s, use -k to name one", aws.StringValue(inst.InstanceId))
+	}
+	pem, err := ioutil.ReadFile(KeyPath(keyname))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read key '%s': %v", keyname, err)
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse key '%s': %v", keyname, err)
+	}
+	return &ssh.ClientConfig{
+		User:              cloud.loginUser(inst),
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback:   cloud.hostKeyCallback(inst),
+		HostKeyAlgorithms: cloud.hostKeyAlgorithms(aws.StringValue(inst.InstanceId)),
+		Timeout:           15 * time.Second,
+	}, nil
+}
+
+// dial connects directly to the instance's public address, echoing what it connects to on echo unless Quiet.
+func (cloud *Cloud) dial(inst *ec2.Instance, keyname string, echo io.Writer) (*Conn, error) {
+	if inst.PublicIpAddress == nil {
+		return nil, fmt.Errorf("No public address on target host")
+	}
+	host := *inst.PublicIpAddress
+	config, err := cloud.sshConfig(inst, keyname)
+	if err != nil {
+		return nil, err
+	}
+	if !Quiet {
+		fmt.Fprintf(echo, "[ssh %s@%s]\n", config.User, host)
+	}
+	client, err := ssh.Dial("tcp", net.JoinHostPort(host, "22"), config)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot connect to %s as %s: %v", host, config.User, err)
+	}
+	return &Conn{Host: host, client: client}, nil
+}
+
+// dialThrough connects to the instance's private address, tunneling through the jump connection, i.e. ProxyJump.
+func (cloud *Cloud) dialThrough(jump *Conn, inst *ec2.Instance, keyname string, echo io.Writer) (*Conn, error) {
+	if inst.PrivateIpAddress == nil {
+		return nil, fmt.Errorf("No private address on target host")
+	}
+	host := *inst.PrivateIpAddress
+	config, err := cloud.sshConfig(inst, keyname)
+	if err != nil {
+		return nil, err
+	}
+	if !Quiet {
+		fmt.Fprintf(echo, "[ssh %s@%s via %s]\n", config.User, host, jump.Host)
+	}
+	addr := net.JoinHostPort(host, "22")
+	tunnel, err := jump.client.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot reach %s from jumphost %s: %v", host, jump.Host, err)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(tunnel, addr, config)
+	if err != nil {
+		tunnel.Close()
+		return nil, fmt.Errorf("Cannot connect to %s as %s: %v", host, config.User, err)
+	}
+	return &Conn{Host: host, client: ssh.NewClient(c, chans, reqs), jump: jump}, nil
+}
+
+func (machine *Machine) isJumphost() bool {
+	return strings.HasSuffix(machine.Name, "."+AdminNetName+".jumphost")
+}
+
+// ConnectJumphost opens an SSH connection to the environment's admin jumphost.
+func (cloud *Cloud) ConnectJumphost(keyname string) (*Conn, error) {
+	return cloud.connectJumphost(keyname, os.Stdout)
+}
+
+func (cloud *Cloud) connectJumphost(keyname string, echo io.Writer) (*Conn, error) {
+	jumpHost, err := cloud.FindMachine(AdminNetName + ".jumphost")
+	if err != nil {
+		return nil, fmt.Errorf("Cannot find jumphost to connect through: %v", err)
+	}
+	if jumpHost == nil {
+		return nil, fmt.Errorf("Cannot find jumphost to connect through: not running")
+	}
+	return cloud.dial(jumpHost.ec2Instance, keyname, echo)
+}
+
+// Connect opens an SSH connection to the machine. Machines in an environment's networks are reached through the admin
+// jumphost, while the jumphost itself and standalone machines are reached directly.
+func (machine *Machine) Connect(keyname string) (*Conn, error) {
+	if machine.Network == "" || machine.isJumphost() {
+		return machine.Cloud.dial(machine.ec2Instance, keyname, os.Stdout)
+	}
+	jump, err := machine.Cloud.ConnectJumphost(keyname)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := machine.Cloud.dialThrough(jump, machine.ec2Instance, keyname, os.Stdout)
+	if err != nil {
+		jump.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Run runs a command on the machine, streaming its output to stdout and stderr. A command that runs but fails is
+// returned as an *ExitError, carrying its exit status.
+func (machine *Machine) Run(keyname string, stdin io.Reader, stdout io.Writer, stderr io.Writer, remoteCommand ...string) error {
+	conn, err := machine.Connect(keyname)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Run(commandLine(remoteCommand), stdin, stdout, stderr)
+}
+
+// Exec runs a command on the machine, and returns its output.
+func (machine *Machine) Exec(keyname string, remoteCommand ...string) (string, error) {
+	conn, err := machine.Connect(keyname)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.Output(commandLine(remoteCommand))
+}
+
+// commandLine joins the words, like the ssh command does. With no command at all, it runs hostname as a connection check.
+func commandLine(remoteCommand []string) string {
+	if len(remoteCommand) == 0 {
+		return "hostname"
+	}
+	return strings.Join(remoteCommand, " ")
+}
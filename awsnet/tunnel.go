@@ -0,0 +1,148 @@
+package awsnet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+)
+
+// Forward accepts connections on the local listener, and forwards each of them to remoteAddr as seen from the remote
+// host, i.e. like ssh -L. It returns when the listener is closed.
+func (conn *Conn) Forward(l net.Listener, remoteAddr string) error {
+	return conn.serve(l, remoteAddr)
+}
+
+// ServeSOCKS accepts SOCKS5 connections on the local listener, and connects each of them to the address it asks for,
+// as seen (and resolved) from the remote host, i.e. like ssh -D. It returns when the listener is closed.
+func (conn *Conn) ServeSOCKS(l net.Listener) error {
+	return conn.serve(l, "")
+}
+
+// serve forwards each connection to remoteAddr or, when that is empty, to wherever its SOCKS request says.
+func (conn *Conn) serve(l net.Listener, remoteAddr string) error {
+	for {
+		local, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go conn.forward(local, remoteAddr)
+	}
+}
+
+func (conn *Conn) forward(local net.Conn, remoteAddr string) {
+	defer local.Close()
+	socks := remoteAddr == ""
+	addr := remoteAddr
+	if socks {
+		var err error
+		addr, err = socksHandshake(local)
+		if err != nil {
+			fmt.Printf("SOCKS connection from %s failed: %v\n", local.RemoteAddr(), err)
+			return
+		}
+	}
+	remote, err := conn.client.Dial("tcp", addr)
+	if socks {
+		reply := byte(0) //succeeded
+		if err != nil {
+			reply = 5 //connection refused
+		}
+		local.Write([]byte{5, reply, 0, 1, 0, 0, 0, 0, 0, 0}) //no bound address to speak of
+	}
+	if err != nil {
+		fmt.Printf("Cannot reach %s from %s: %v\n", addr, conn.Host, err)
+		return
+	}
+	defer remote.Close()
+	if !Quiet {
+		fmt.Printf("[tunnel %s -> %s via %s]\n", local.RemoteAddr(), addr, conn.Host)
+	}
+	done := make(chan bool, 2)
+	go func() {
+		io.Copy(remote, local)
+		done <- true
+	}()
+	go func() {
+		io.Copy(local, remote)
+		done <- true
+	}()
+	<-done
+}
+
+// socksHandshake reads a SOCKS5 greeting and CONNECT request, without authentication, and returns the address asked
+// for. The reply is left to the caller, once the remote connection has been tried.
+func socksHandshake(local net.Conn) (string, error) {
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(local, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != 5 {
+		return "", fmt.Errorf("Not a SOCKS5 client (version %d)", buf[0])
+	}
+	if _, err := io.ReadFull(local, buf[:buf[1]]); err != nil {
+		return "", err
+	}
+	if _, err := local.Write([]byte{5, 0}); err != nil { //no authentication required
+		return "", err
+	}
+	if _, err := io.ReadFull(local, buf[:4]); err != nil {
+		return "", err
+	}
+	if buf[1] != 1 {
+		local.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0}) //command not supported
+		return "", fmt.Errorf("Unsupported SOCKS command %d", buf[1])
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		if _, err := io.ReadFull(local, buf[:4]); err != nil {
+			return "", err
+		}
+		host = net.IP(buf[:4]).String()
+	case 3:
+		if _, err := io.ReadFull(local, buf[:1]); err != nil {
+			return "", err
+		}
+		n := int(buf[0])
+		if _, err := io.ReadFull(local, buf[:n]); err != nil {
+			return "", err
+		}
+		host = string(buf[:n])
+	case 4:
+		if _, err := io.ReadFull(local, buf[:16]); err != nil {
+			return "", err
+		}
+		host = net.IP(buf[:16]).String()
+	default:
+		local.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0}) //address type not supported
+		return "", fmt.Errorf("Unsupported SOCKS address type %d", buf[3])
+	}
+	if _, err := io.ReadFull(local, buf[:2]); err != nil {
+		return "", err
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// Tunnel forwards connections on the local listener to the port on the machine. Machines in an environment's
+// networks are reached at their private address from the admin jumphost, so no SSH session to the machine itself is
+// needed.
+func (machine *Machine) Tunnel(keyname string, l net.Listener, remotePort int) error {
+	var conn *Conn
+	var err error
+	host := machine.PrivateIp()
+	if machine.Network == "" || machine.isJumphost() {
+		conn, err = machine.Cloud.dial(machine.ec2Instance, keyname, os.Stdout)
+		host = "127.0.0.1"
+	} else {
+		conn, err = machine.Cloud.ConnectJumphost(keyname)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Forward(l, net.JoinHostPort(host, strconv.Itoa(remotePort)))
+}
@@ -0,0 +1,379 @@
+package awsnet
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Everything the tool creates follows the same conventions: the admin network's jumphost is running, every other
+// network is peered with the admin network by a peering named "env.admin:env.net", each routes to the other over it,
+// the network's default security group lets the bastion zone in on tcp/22, and every resource carries the Name,
+// Network and Env tags it is found by. Verify checks an environment against them, for hand edits and half-finished
+// operations that left it otherwise.
+
+// a Discrepancy is one way the environment differs from what its conventions expect.
+type Discrepancy struct {
+	Network  string
+	Problem  string
+	Fixed    bool
+	Fixable  bool   //by Verify, with fix set
+	FixError string //why fixing it failed
+}
+
+func (d *Discrepancy) String() string {
+	s := d.Network + ": " + d.Problem
+	switch {
+	case d.Fixed:
+		s += " (fixed)"
+	case d.FixError != "":
+		s += " (cannot fix: " + d.FixError + ")"
+	case d.Fixable:
+		s += " (fixable)"
+	}
+	return s
+}
+
+// a verifier collects the discrepancies of one run of Verify, fixing each as it is found if asked to.
+type verifier struct {
+	cloud *Cloud
+	fix   bool
+	found []*Discrepancy
+}
+
+// report notes a discrepancy. When fixing, and it can be fixed, it is fixed right away, and true is returned, so that
+// the checks that depend on it can go on.
+func (v *verifier) report(net *Network, fix func() error, format string, args ...interface{}) bool {
+	d := &Discrepancy{Network: net.Name, Problem: fmt.Sprintf(format, args...), Fixable: fix != nil}
+	v.found = append(v.found, d)
+	if v.fix && fix != nil {
+		err := fix()
+		if err != nil {
+			d.FixError = err.Error()
+		} else {
+			d.Fixed = true
+		}
+	}
+	return d.Fixed
+}
+
+// Verify checks every network in the environment for a missing or unaccepted admin peering, missing or wrong routes
+// over it, a missing ssh ingress rule, untagged resources, and (in the admin network) a jumphost that is not running.
+// With fix set, whatever can be fixed is, as it is found. When the admin network is in another account (a RemoteAdmin),
+// only the networks' side of things can be checked.
+func (cloud *Cloud) Verify(fix bool) ([]*Discrepancy, error) {
+	if cloud.RemoteAdmin != nil {
+		lst, err := cloud.ListNetworks()
+		if err != nil {
+			return nil, err
+		}
+		v := &verifier{cloud: cloud, fix: fix}
+		for _, net := range lst {
+			if net.Id == cloud.RemoteAdmin.VpcId {
+				continue //these credentials can see the admin account's VPCs too
+			}
+			err = v.checkPeering(nil, net)
+			if err != nil {
+				return nil, err
+			}
+			err = v.checkTags(net)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return v.found, nil
+	}
+	adminVpc, err := cloud.findVpc(AdminNetName)
+	if err != nil {
+		return nil, err
+	}
+	if adminVpc == nil {
+		return nil, fmt.Errorf("Cloud not set up: %s", cloud.Name)
+	}
+	lst, err := cloud.ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+	v := &verifier{cloud: cloud, fix: fix}
+	admin := cloud.newNetwork(adminVpc)
+	err = v.checkJumphost(admin)
+	if err != nil {
+		return nil, err
+	}
+	for _, net := range lst {
+		if net.Id != admin.Id {
+			err = v.checkPeering(admin, net)
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = v.checkTags(net)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return v.found, nil
+}
+
+func (v *verifier) checkJumphost(admin *Network) error {
+	inst, err := admin.findJumphost()
+	if err != nil {
+		return err
+	}
+	if inst == nil {
+		v.report(admin, nil, "no jumphost (run setup to launch one)")
+		return nil
+	}
+	state := aws.StringValue(inst.State.Name)
+	if state != "stopped" && state != "stopping" {
+		return nil
+	}
+	v.report(admin, func() error {
+		if state == "stopping" {
+			err := v.cloud.waitForInstanceState(inst, "stopped")
+			if err != nil {
+				return err
+			}
+		}
+		_, err := v.cloud.ec2.StartInstances(&ec2.StartInstancesInput{InstanceIds: []*string{inst.InstanceId}})
+		if err != nil {
+			return err
+		}
+		return v.cloud.waitForInstanceState(inst, "running")
+	}, "jumphost %s is %s", *inst.InstanceId, state)
+	return nil
+}
+
+// checkPeering checks the network's peering with the admin network, the routes over it both ways, and that the
+// bastion zone can ssh in. With no admin network, it is a RemoteAdmin, and only the network's side is checked.
+func (v *verifier) checkPeering(admin *Network, net *Network) error {
+	cloud := v.cloud
+	var adminNetBlock, bastionNetBlock string
+	var peering *ec2.VpcPeeringConnection
+	var err error
+	if admin == nil {
+		adminNetBlock, bastionNetBlock = cloud.RemoteAdmin.NetBlock, cloud.RemoteAdmin.BastionBlock
+		peering, err = cloud.findAdminPeering(net.Id, cloud.RemoteAdmin.VpcId)
+	} else {
+		adminNetBlock, bastionNetBlock = adminBlocks(admin.vpc)
+		peering, err = cloud.findAdminPeering(admin.Id, net.Id)
+	}
+	if err != nil {
+		return err
+	}
+	peeringName := cloud.adminPeeringName(net)
+	var peeringId *string
+	pending := false //routes over a peering that is not accepted yet are blackholes until it is
+	switch {
+	case peering == nil && admin == nil:
+		if v.report(net, func() error {
+			var err error
+			peeringId, err = cloud.requestPeering(net)
+			return err
+		}, "has not requested peering with the admin network") {
+			pending = true
+		}
+	case peering == nil:
+		v.report(net, func() error {
+			var err error
+			peeringId, err = cloud.peerWithAdmin(admin.vpc, net)
+			return err
+		}, "not peered with the admin network")
+	case aws.StringValue(peering.Status.Code) != "active" && admin == nil:
+		//only the admin account can accept it
+		v.report(net, nil, "peering %s with the admin network is %s, waiting for account %s to accept it", *peering.VpcPeeringConnectionId, *peering.Status.Code, cloud.RemoteAdmin.Account)
+		peeringId = peering.VpcPeeringConnectionId
+		pending = true
+	case aws.StringValue(peering.Status.Code) != "active":
+		if v.report(net, func() error {
+			_, err := cloud.ec2.AcceptVpcPeeringConnection(&ec2.AcceptVpcPeeringConnectionInput{VpcPeeringConnectionId: peering.VpcPeeringConnectionId})
+			return err
+		}, "peering %s with the admin network is %s", *peering.VpcPeeringConnectionId, *peering.Status.Code) {
+			peeringId = peering.VpcPeeringConnectionId
+		}
+	default:
+		peeringId = peering.VpcPeeringConnectionId
+	}
+	if peering != nil && (findTag(peering.Tags, "Name") != peeringName || findTag(peering.Tags, "Env") != cloud.Name) {
+		v.report(net, func() error {
+			return cloud.tagPeering(peering.VpcPeeringConnectionId, peeringName)
+		}, "peering %s is not tagged as '%s'", *peering.VpcPeeringConnectionId, peeringName)
+	}
+	if peeringId != nil { //there are no routes to check without a peering
+		if admin != nil {
+			err = v.checkRoutes(net, admin, net.AddressBlock, *peeringId, pending)
+			if err != nil {
+				return err
+			}
+		}
+		err = v.checkRoutes(net, net, adminNetBlock, *peeringId, pending)
+		if err != nil {
+			return err
+		}
+	}
+	sg, err := net.defaultSecurityGroup()
+	if err != nil {
+		return err
+	}
+	if !allowsInbound(sg, bastionNetBlock, "tcp", 22) {
+		v.report(net, func() error {
+			return cloud.authorizeInboundAddress(sg.GroupId, bastionNetBlock, "tcp", 22)
+		}, "default security group %s does not allow tcp/22 from the bastion zone (%s)", *sg.GroupId, bastionNetBlock)
+	}
+	return nil
+}
+
+// checkRoutes checks that every route table of the network (in) routes the destination over the peering, reporting
+// the discrepancies against the app network (net). While the peering is pending, its routes are expected to be
+// blackholes.
+func (v *verifier) checkRoutes(net *Network, in *Network, destination string, peeringId string, pending bool) error {
+	lst, err := in.routeTables()
+	if err != nil {
+		return err
+	}
+	for _, rt := range lst {
+		rt := rt
+		tableName := "main route table " + *rt.RouteTableId
+		if !isMainRouteTable(rt) {
+			tableName = "route table " + *rt.RouteTableId
+			if zoneName := findTag(rt.Tags, "Zone"); zoneName != "" {
+				tableName += " (" + zoneName + ")"
+			}
+		}
+		fix := func() error {
+			return v.cloud.putRoute(rt, destination, peeringId)
+		}
+		route := findRoute(rt, destination)
+		switch {
+		case route == nil:
+			v.report(net, fix, "%s of %s has no route for %s", tableName, in.Name, destination)
+		case aws.StringValue(route.VpcPeeringConnectionId) != peeringId:
+			v.report(net, fix, "%s of %s routes %s to %s, not the peering %s", tableName, in.Name, destination, newRoute(route).Target, peeringId)
+		case aws.StringValue(route.State) != "active" && !pending:
+			v.report(net, fix, "%s of %s routes %s to the peering, but the route is %s", tableName, in.Name, destination, aws.StringValue(route.State))
+		}
+	}
+	return nil
+}
+
+// allowsInbound reports whether the security group lets the net block in on the port.
+func allowsInbound(sg *ec2.SecurityGroup, addr string, protocol string, port int) bool {
+	for _, perm := range sg.IpPermissions {
+		p := aws.StringValue(perm.IpProtocol)
+		if p != "-1" && (p != protocol || aws.Int64Value(perm.FromPort) > int64(port) || aws.Int64Value(perm.ToPort) < int64(port)) {
+			continue
+		}
+		for _, r := range perm.IpRanges {
+			if aws.StringValue(r.CidrIp) == addr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkTags checks that the resources in the network carry the tags they are found by. Missing Network and Env tags
+// can be added, and so can a missing name, where the name is a conventional one.
+func (v *verifier) checkTags(net *Network) error {
+	cloud := v.cloud
+	if findTag(net.vpc.Tags, "Env") != cloud.Name {
+		v.report(net, func() error {
+			_, err := cloud.ec2.CreateTags(&ec2.CreateTagsInput{
+				Resources: []*string{net.vpc.VpcId},
+				Tags:      []*ec2.Tag{&ec2.Tag{Key: aws.String("Env"), Value: aws.String(cloud.Name)}},
+			})
+			return err
+		}, "VPC %s is not tagged with Env", net.Id)
+	}
+	byVpc := []*ec2.Filter{filter("vpc-id", net.Id)}
+	subnets, err := cloud.ec2.DescribeSubnets(&ec2.DescribeSubnetsInput{Filters: byVpc})
+	if err != nil {
+		return err
+	}
+	for _, sn := range subnets.Subnets {
+		v.checkResourceTags(net, "subnet", sn.SubnetId, sn.Tags, "")
+	}
+	groups, err := cloud.ec2.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{Filters: byVpc})
+	if err != nil {
+		return err
+	}
+	for _, sg := range groups.SecurityGroups {
+		if aws.StringValue(sg.GroupName) != "default" {
+			v.checkResourceTags(net, "security group", sg.GroupId, sg.Tags, aws.StringValue(sg.GroupName))
+		}
+	}
+	tables, err := net.routeTables()
+	if err != nil {
+		return err
+	}
+	for _, rt := range tables {
+		if !isMainRouteTable(rt) {
+			v.checkResourceTags(net, "route table", rt.RouteTableId, rt.Tags, "")
+		}
+	}
+	gws, err := cloud.ec2.DescribeInternetGateways(&ec2.DescribeInternetGatewaysInput{Filters: []*ec2.Filter{filter("attachment.vpc-id", net.Id)}})
+	if err != nil {
+		return err
+	}
+	for _, gw := range gws.InternetGateways {
+		v.checkResourceTags(net, "internet gateway", gw.InternetGatewayId, gw.Tags, net.Name+".gateway")
+	}
+	nats, err := cloud.ec2.DescribeNatGateways(&ec2.DescribeNatGatewaysInput{Filter: byVpc})
+	if err != nil {
+		return err
+	}
+	for _, nat := range nats.NatGateways {
+		switch aws.StringValue(nat.State) {
+		case "pending", "available":
+			v.checkResourceTags(net, "NAT gateway", nat.NatGatewayId, nat.Tags, net.Name+".nat")
+		}
+	}
+	instances, err := cloud.ec2.DescribeInstances(&ec2.DescribeInstancesInput{Filters: byVpc})
+	if err != nil {
+		return err
+	}
+	for _, rez := range instances.Reservations {
+		for _, inst := range rez.Instances {
+			switch aws.StringValue(inst.State.Name) {
+			case "shutting-down", "terminated":
+			default:
+				v.checkResourceTags(net, "instance", inst.InstanceId, inst.Tags, "")
+			}
+		}
+	}
+	return nil
+}
+
+// checkResourceTags reports a resource that is missing its Name, Network or Env tag. The name can only be added when
+// it is known.
+func (v *verifier) checkResourceTags(net *Network, kind string, id *string, tags []*ec2.Tag, name string) {
+	var missing []*ec2.Tag
+	var problem string
+	for _, tag := range net.tags(name) {
+		if findTag(tags, *tag.Key) == *tag.Value || (*tag.Key == "Name" && findTag(tags, "Name") != "") {
+			continue
+		}
+		if problem == "" {
+			problem = *tag.Key
+		} else {
+			problem += ", " + *tag.Key
+		}
+		if *tag.Value != "" {
+			missing = append(missing, tag)
+		}
+	}
+	if problem == "" {
+		return
+	}
+	var fix func() error
+	if len(missing) > 0 {
+		fix = func() error {
+			_, err := v.cloud.ec2.CreateTags(&ec2.CreateTagsInput{Resources: []*string{id}, Tags: missing})
+			if err == nil && findTag(tags, "Name") == "" && name == "" {
+				err = fmt.Errorf("Its Network and Env tags were added, but its name is not known")
+			}
+			return err
+		}
+	}
+	v.report(net, fix, "%s %s is not tagged with %s", kind, *id, problem)
+}
@@ -0,0 +1,114 @@
+package awsnet
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"strings"
+	"testing"
+)
+
+func newVerifiedCloud(t *testing.T) (*Cloud, *FakeEC2, *Network, *Zone) {
+	cloud, fake := newTestCloud(t)
+	err := cloud.Setup("0.0.0.0/0", AdminNetBlock, BastionNetBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	net, err := cloud.CreateNetwork("myapp", "10.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone, err := net.CreateZone("fe", "10.0.0.0/28")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDiscrepancies(t, cloud, false)
+	return cloud, fake, net, zone
+}
+
+// expectDiscrepancies runs Verify, and checks that it finds one discrepancy with each of the problems, in order, and
+// (when fixing) that each was fixed.
+func expectDiscrepancies(t *testing.T, cloud *Cloud, fix bool, problems ...string) {
+	lst, err := cloud.Verify(fix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lst) != len(problems) {
+		t.Fatalf("Expected %d discrepancies, got %v", len(problems), lst)
+	}
+	for i, d := range lst {
+		if !strings.Contains(d.Problem, problems[i]) {
+			t.Errorf("Expected a discrepancy with %q, got %s", problems[i], d)
+		}
+		if fix && !d.Fixed {
+			t.Errorf("Expected %s to be fixed", d)
+		}
+	}
+}
+
+func TestVerifyFixes(t *testing.T) {
+	cloud, fake, net, zone := newVerifiedCloud(t)
+	admin, err := cloud.FindNetwork(AdminNetName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jumphost, err := admin.findJumphost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.StopInstances(&ec2.StopInstancesInput{InstanceIds: []*string{jumphost.InstanceId}})
+	sg, err := net.defaultSecurityGroup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.groups[*sg.GroupId].IpPermissions = nil
+	*fake.tagsOf(zone.Id) = []*ec2.Tag{&ec2.Tag{Key: aws.String("Name"), Value: aws.String(zone.Name)}}
+	peering, err := cloud.findAdminPeering(admin.Id, net.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.DeleteVpcPeeringConnection(&ec2.DeleteVpcPeeringConnectionInput{VpcPeeringConnectionId: peering.VpcPeeringConnectionId})
+
+	problems := []string{
+		"jumphost " + *jumphost.InstanceId + " is stop",
+		"not peered with the admin network",
+		"does not allow tcp/22 from the bastion zone",
+		"subnet " + zone.Id + " is not tagged with Network, Env",
+	}
+	expectDiscrepancies(t, cloud, false, problems...)
+	//the new peering leaves the routes over the old one to be fixed, too
+	old := " to " + *peering.VpcPeeringConnectionId + ", not the peering"
+	problems = []string{problems[0], problems[1], "of dev.admin routes 10.0.0.0/24" + old, "of dev.admin routes 10.0.0.0/24" + old,
+		"of dev.myapp routes " + AdminNetBlock + old, "of dev.myapp routes " + AdminNetBlock + old, problems[2], problems[3]}
+	expectDiscrepancies(t, cloud, true, problems...)
+	expectDiscrepancies(t, cloud, false)
+}
+
+func TestVerifyFixesRoutes(t *testing.T) {
+	cloud, _, net, zone := newVerifiedCloud(t)
+	gwId, err := net.ensureInternetGateway()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = zone.SetRoute(AdminNetBlock, *gwId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDiscrepancies(t, cloud, true, "routes "+AdminNetBlock+" to "+*gwId+", not the peering")
+	expectDiscrepancies(t, cloud, false)
+}
+
+func TestVerifyAcceptsPendingPeering(t *testing.T) {
+	cloud, fake, net, _ := newVerifiedCloud(t)
+	admin, err := cloud.FindNetwork(AdminNetName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peering, err := cloud.findAdminPeering(admin.Id, net.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.peerings[*peering.VpcPeeringConnectionId].Status.Code = aws.String("pending-acceptance")
+	*fake.tagsOf(*peering.VpcPeeringConnectionId) = nil
+	expectDiscrepancies(t, cloud, true, "is pending-acceptance", "is not tagged as 'dev.admin:dev.myapp'")
+	expectDiscrepancies(t, cloud, false)
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+
+package awsnet
+
+import (
+	"golang.org/x/term"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchWindowSize calls resize with the terminal's new size whenever it changes, until the returned stop is called.
+func watchWindowSize(fd int, resize func(width int, height int)) func() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGWINCH)
+	go func() {
+		for range ch {
+			if width, height, err := term.GetSize(fd); err == nil {
+				resize(width, height)
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(ch)
+	}
+}
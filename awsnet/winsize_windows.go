@@ -0,0 +1,6 @@
+package awsnet
+
+// watchWindowSize does nothing on windows, which has no SIGWINCH. The PTY keeps its initial size.
+func watchWindowSize(fd int, resize func(width int, height int)) func() {
+	return func() {}
+}
@@ -2,35 +2,164 @@ package main
 
 import (
 	"fmt"
-	"os"
+	"github.com/boynton/hacks/awsnet"
 )
 
-func (cloud *Cloud) describeCommand(help bool) {
-	if help {
-		fmt.Println("describe command help")
-		
-	} else {
-		fmt.Println("describe command")
+func describeCommand(cloud *awsnet.Cloud) {
+	err := cloud.Status()
+	if err != nil {
+		fatal(err)
 	}
-	os.Exit(0)
 }
 
-func (cloud *Cloud) setupCommand(adminCidr string, bastionCidr string, ctrlCidr string) {
-	fmt.Println("setup cloud ", adminCidr, bastionCidr, ctrlCidr)
-	os.Exit(0)
+func setupCommand(cloud *awsnet.Cloud, adminCidr string, bastionCidr string, ctrlCidr string) {
+	err := cloud.Setup(ctrlCidr, adminCidr, bastionCidr)
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func cleanupCommand(cloud *awsnet.Cloud, dryRun bool, sweepOrphans bool) {
+	cloud.DryRun = dryRun
+	cloud.SweepOrphans = sweepOrphans
+	err := cloud.Cleanup()
+	if err != nil {
+		fatal(err)
+	}
+	printRemovals(cloud)
+}
+
+func printRemovals(cloud *awsnet.Cloud) {
+	if cloud.DryRun {
+		if len(cloud.Removals) == 0 {
+			fmt.Println("Nothing would be removed")
+		}
+		for _, r := range cloud.Removals {
+			fmt.Println("would remove", r)
+		}
+	}
+}
+
+func listNetworksCommand(cloud *awsnet.Cloud) {
+	lst, err := cloud.ListNetworks()
+	if err != nil {
+		fatal(err)
+	}
+	for _, net := range lst {
+		fmt.Printf("%s (%s) - %s\n", net.Name, net.Id, net.AddressBlock)
+	}
+}
+
+func findNetwork(cloud *awsnet.Cloud, netName string) *awsnet.Network {
+	net, err := cloud.FindNetwork(netName)
+	if err != nil {
+		fatal(err)
+	}
+	if net == nil {
+		fatal(fmt.Errorf("No such network in %s: %s", cloud.Name, netName))
+	}
+	return net
+}
+
+func describeNetworkCommand(cloud *awsnet.Cloud, netName string) {
+	net := findNetwork(cloud, netName)
+	fmt.Printf("network %s (%s) - %s:\n", net.Name, net.Id, net.AddressBlock)
+	zones, err := net.ListZones()
+	if err != nil {
+		fatal(err)
+	}
+	for _, zone := range zones {
+		fmt.Printf("  zone %s (%s) - %s\n", zone.Name, zone.Id, zone.AddressBlock)
+		rtId, routes, err := zone.Routes()
+		if err != nil {
+			fatal(err)
+		}
+		for _, route := range routes {
+			fmt.Printf("    route %s via %s\n", route, rtId)
+		}
+	}
+	peerings, err := net.Peerings()
+	if err != nil {
+		fatal(err)
+	}
+	for _, p := range peerings {
+		fmt.Printf("  peering %s\n", p)
+	}
+	machines, err := net.ListMachines()
+	if err != nil {
+		fatal(err)
+	}
+	for _, machine := range machines {
+		pub := machine.PublicIp()
+		if pub == "" {
+			pub = "(no public ip)"
+		}
+		fmt.Printf("  machine %s (%s) - %s/%s\n", machine.Name, machine.Id(), machine.PrivateIp(), pub)
+	}
+}
+
+func createNetworkCommand(cloud *awsnet.Cloud, netName string, netCidr string) {
+	_, err := cloud.CreateNetwork(netName, netCidr)
+	if err != nil {
+		fatal(err)
+	}
 }
 
-func (cloud *Cloud) cleanupCommand() {
-	fmt.Println("cleanup command")
-	os.Exit(0)
+func destroyNetworkCommand(cloud *awsnet.Cloud, netName string, force bool, dryRun bool) {
+	net := findNetwork(cloud, netName)
+	cloud.DryRun = dryRun
+	if !force && !dryRun {
+		machines, err := net.ListMachines()
+		if err != nil {
+			fatal(err)
+		}
+		if len(machines) > 0 {
+			fatal(fmt.Errorf("Network %s has %d running machines, use --force to shut them down", net.Name, len(machines)))
+		}
+	}
+	err := cloud.DestroyNetwork(netName)
+	if err != nil {
+		fatal(err)
+	}
+	printRemovals(cloud)
 }
 
-func (cloud *Cloud) listNetworksCommand() {
-	fmt.Println("list networks here")
-	os.Exit(0)
+func networkUpCommand(cloud *awsnet.Cloud, netName string) {
+	err := findNetwork(cloud, netName).Start()
+	if err != nil {
+		fatal(err)
+	}
 }
 
-func (cloud *Cloud) describeNetworkCommand(netName string) {
-	fmt.Println("describe network '" + netName + "' here")
-	os.Exit(0)
+func networkDownCommand(cloud *awsnet.Cloud, netName string, force bool) {
+	err := findNetwork(cloud, netName).Stop(force)
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func upCommand(cloud *awsnet.Cloud) {
+	lst, err := cloud.ListNetworks()
+	if err != nil {
+		fatal(err)
+	}
+	for _, net := range lst {
+		err = net.Start()
+		if err != nil {
+			fatal(err)
+		}
+	}
+}
+
+func downCommand(cloud *awsnet.Cloud, force bool) {
+	lst, err := cloud.ListNetworks()
+	if err != nil {
+		fatal(err)
+	}
+	for _, net := range lst {
+		err = net.Stop(force)
+		if err != nil {
+			fatal(err)
+		}
+	}
 }
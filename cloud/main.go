@@ -1,7 +1,7 @@
 package main
 
 import (
-	"fmt"
+	"github.com/boynton/hacks/awsnet"
 	"github.com/jawher/mow.cli"
 	"os"
 )
@@ -9,70 +9,135 @@ import (
 func main() {
 	app := cli.App("cloud", "")
 	app.Version("v version", "cloud 0.0.1")
-	var cloud *Cloud
-	pEnv := app.StringOpt("e env", "dev", "select the environment to use")
-	app.Before = func () {
-		cloud = NamedCloud(*pEnv)
+	config, err := awsnet.LoadConfig()
+	if err != nil {
+		fatal(err)
 	}
-	app.Command("describe", "", func (cmd *cli.Cmd) {
-		cloud.describeCommand(false)
+	var cloud *awsnet.Cloud
+	var settings *awsnet.Settings
+	var envSet bool
+	pEnv := app.String(cli.StringOpt{Name: "e env", Value: config.EnvName(), Desc: "select the environment to use", SetByUser: &envSet})
+	pQuiet := app.BoolOpt("q quiet", false, "suppress progress messages")
+	app.Before = func() {
+		awsnet.Quiet = *pQuiet
+		settings = config.Effective(*pEnv)
+		if envSet {
+			settings.Override("env", *pEnv, "flag --env")
+		}
+		var err error
+		cloud, err = awsnet.ConfiguredCloud(settings)
+		if err != nil {
+			fatal(err)
+		}
+	}
+	app.Command("config", "Show the effective settings", func(cmd *cli.Cmd) {
+		cmd.Command("show", "Show the effective settings, and where each came from", func(subcmd *cli.Cmd) {
+			subcmd.Action = func() {
+				settings.Show(config)
+			}
+		})
+	})
+	app.Command("describe", "Describe the networks and machines in the environment", func(cmd *cli.Cmd) {
+		cmd.Action = func() {
+			describeCommand(cloud)
+		}
 	})
-	app.Command("setup", "", func (cmd *cli.Cmd) {
-		pAdminNet := cmd.StringOpt("n admin-net-cidr", "10.255.255.0/24", "CIDR of the admin network for the cloud")
-		pBastionSubnet := cmd.StringOpt("a admin-bastion-subnet", "10.255.255.192/28", "CIDR of the admin's bastion subnet")
-		pControlNet := cmd.StringOpt("c control-net", "0.0.0.0/0", "CIDR of the controlling network to allow SSH from")
-		cloud.setupCommand(*pAdminNet, *pBastionSubnet, *pControlNet)
+	app.Command("list", "List the networks in the environment", func(cmd *cli.Cmd) {
+		cmd.Action = func() {
+			listNetworksCommand(cloud)
+		}
 	})
-	app.Command("cleanup", "", func (cmd *cli.Cmd) {
-		cloud.cleanupCommand()
+	app.Command("setup", "Set up the admin network and its jumphost", func(cmd *cli.Cmd) {
+		var adminSet, bastionSet, controlSet bool
+		pAdminNet := cmd.String(cli.StringOpt{Name: "n admin-net-cidr", Value: awsnet.BuiltinSettings.AdminNet, Desc: "CIDR of the admin network for the cloud", SetByUser: &adminSet})
+		pBastionSubnet := cmd.String(cli.StringOpt{Name: "a admin-bastion-subnet", Value: awsnet.BuiltinSettings.BastionNet, Desc: "CIDR of the admin's bastion subnet, within the admin network", SetByUser: &bastionSet})
+		pControlNet := cmd.String(cli.StringOpt{Name: "c control-net", Value: awsnet.BuiltinSettings.Control, Desc: "CIDR of the controlling network to allow SSH from", SetByUser: &controlSet})
+		cmd.Action = func() {
+			if adminSet {
+				settings.Override("admin-net", *pAdminNet, "flag --admin-net-cidr")
+			}
+			if bastionSet {
+				settings.Override("bastion-net", *pBastionSubnet, "flag --admin-bastion-subnet")
+			}
+			if controlSet {
+				settings.Override("control", *pControlNet, "flag --control-net")
+			}
+			setupCommand(cloud, settings.AdminNet, settings.BastionNet, settings.Control)
+		}
 	})
-	app.Command("up", "", func (cmd *cli.Cmd) {
-		fmt.Println("bring entire cloud up")
+	app.Command("cleanup", "Terminate all machines and delete all resources in the environment", func(cmd *cli.Cmd) {
+		pDryRun := cmd.BoolOpt("n dry-run", false, "list what would be removed, without removing anything")
+		pSweep := cmd.BoolOpt("sweep-orphans", false, "also release unassociated EIPs that are not tagged for any environment")
+		cmd.Action = func() {
+			cleanupCommand(cloud, *pDryRun, *pSweep)
+		}
 	})
-	app.Command("down", "", func (cmd *cli.Cmd) {
-		fmt.Println("bring entire cloud down")
+	app.Command("up", "Bring entire cloud up", func(cmd *cli.Cmd) {
+		cmd.Action = func() {
+			upCommand(cloud)
+		}
 	})
-	app.Command("net", "", func (cmd *cli.Cmd) {
+	app.Command("down", "Bring entire cloud down", func(cmd *cli.Cmd) {
+		pForce := cmd.BoolOpt("f force", false, "force shutdown of all machines")
+		cmd.Action = func() {
+			downCommand(cloud, *pForce)
+		}
+	})
+	app.Command("net", "Manage a network", func(cmd *cli.Cmd) {
 		pNetName := cmd.StringArg("NAME", "", "the name of the network")
-		cmd.Command("describe", "List the network", func (subcmd *cli.Cmd) {
-			cloud.describeNetworkCommand(*pNetName)
+		cmd.Command("describe", "List the network", func(subcmd *cli.Cmd) {
+			subcmd.Action = func() {
+				describeNetworkCommand(cloud, *pNetName)
+			}
 		})
-		cmd.Command("create", "Create the network definition", func (subcmd *cli.Cmd) {
-			subcmd.StringOpt("n net-cidr", "10.0.0.0/24", "CIDR of the new network")
-			subcmd.StringOpt("a net-cidr", "10.255.255.0/24", "CIDR of the admin network to peer with")
+		cmd.Command("create", "Create the network, peered with the admin network", func(subcmd *cli.Cmd) {
+			pNetCidr := subcmd.StringOpt("n net-cidr", "", "CIDR of the new network, or just its size (i.e. /20), to allocate the next free one")
+			subcmd.Action = func() {
+				createNetworkCommand(cloud, *pNetName, *pNetCidr)
+			}
 		})
-		cmd.Command("destroy", "Destroy the network definition", func (subcmd *cli.Cmd) {
-			subcmd.BoolOpt("f --force", false, "force shutdown of all machines in the network")
+		cmd.Command("destroy", "Destroy the network", func(subcmd *cli.Cmd) {
+			pForce := subcmd.BoolOpt("f force", false, "force shutdown of all machines in the network")
+			pDryRun := subcmd.BoolOpt("n dry-run", false, "list what would be removed, without removing anything")
+			subcmd.Action = func() {
+				destroyNetworkCommand(cloud, *pNetName, *pForce, *pDryRun)
+			}
 		})
-		cmd.Command("up", "bring up the network", func (subcmd *cli.Cmd) {
+		cmd.Command("up", "bring up the network", func(subcmd *cli.Cmd) {
+			subcmd.Action = func() {
+				networkUpCommand(cloud, *pNetName)
+			}
 		})
-		cmd.Command("down", "bring down the network", func (subcmd *cli.Cmd) {
-			subcmd.BoolOpt("f --force", false, "force shutdown of all machines in the network")
+		cmd.Command("down", "bring down the network", func(subcmd *cli.Cmd) {
+			pForce := subcmd.BoolOpt("f force", false, "force shutdown of all machines in the network")
+			subcmd.Action = func() {
+				networkDownCommand(cloud, *pNetName, *pForce)
+			}
 		})
 	})
-/*
- --> use terraform to define the machine clusters and how to bring them up. Not this
+	/*
+	    --> use terraform to define the machine clusters and how to bring them up. Not this
 
-	app.Command("cluster", "", func (cmd *cli.Cmd) {
-		pClusterName := cmd.StringArg("NAME", "", "the name of the machine cluster")
-		cmd.Command("describe", "List the network", func (subcmd *cli.Cmd) {
-			cloud.describeNetworkCommand(*pNetName)
-		})
-		cmd.Command("create", "Create the cluster definition", func (subcmd *cli.Cmd) {
-			subcmd.StringOpt("t instance-type", "t2.micro", "the type of machine instance to use")
-			subcmd.StringOpt("i image", "ami-81f7e8b1", "CIDR of the admin network to peer with")
-		})
-		cmd.Command("destroy", "Destroy the network definition", func (subcmd *cli.Cmd) {
-			subcmd.BoolOpt("f --force", false, "force shutdown of all machines in the network")
-		})
-		cmd.Command("up", "bring up the network", func (subcmd *cli.Cmd) {
-		})
-		cmd.Command("down", "bring down the network", func (subcmd *cli.Cmd) {
-			subcmd.BoolOpt("f --force", false, "force shutdown of all machines in the network")
-		})
-		
-	})
-*/
+	   	app.Command("cluster", "", func (cmd *cli.Cmd) {
+	   		pClusterName := cmd.StringArg("NAME", "", "the name of the machine cluster")
+	   		cmd.Command("describe", "List the network", func (subcmd *cli.Cmd) {
+	   			cloud.describeNetworkCommand(*pNetName)
+	   		})
+	   		cmd.Command("create", "Create the cluster definition", func (subcmd *cli.Cmd) {
+	   			subcmd.StringOpt("t instance-type", "t2.micro", "the type of machine instance to use")
+	   			subcmd.StringOpt("i image", "ami-81f7e8b1", "CIDR of the admin network to peer with")
+	   		})
+	   		cmd.Command("destroy", "Destroy the network definition", func (subcmd *cli.Cmd) {
+	   			subcmd.BoolOpt("f --force", false, "force shutdown of all machines in the network")
+	   		})
+	   		cmd.Command("up", "bring up the network", func (subcmd *cli.Cmd) {
+	   		})
+	   		cmd.Command("down", "bring down the network", func (subcmd *cli.Cmd) {
+	   			subcmd.BoolOpt("f --force", false, "force shutdown of all machines in the network")
+	   		})
+
+	   	})
+	*/
 	//to do: decide how best to expose the "ssh" functionality to a machine instance.
 	app.Run(os.Args)
 	os.Exit(0)
@@ -3,11 +3,10 @@ package main
 import (
 	"flag"
 	"fmt"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/boynton/hacks/awsnet"
+	"io"
+	"io/ioutil"
 	"os"
-	"os/exec"
-	"time"
 )
 
 func fatal(msg string) {
@@ -16,18 +15,24 @@ func fatal(msg string) {
 }
 
 func usage() {
-	fatal("usage: ec2 [-k] [-n] [-t] [-i] [up,down,id,status,wait] [other args]")
+	fatal("usage: ec2 [-k] [-n] [-t] [-i] [-u] [up,down,id,status,wait,config] [other args]")
 }
 
 var verbose = false
 var quiet = false
+var cloud *awsnet.Cloud
 
 func main() {
 	//   ec2 run-instances --image-id ami-81f7e8b1 --count 1 --instance-type t1.micro --key-name docker --security-groups default > .aws-docker-machine
+	config, err := awsnet.LoadConfig()
+	if err != nil {
+		fatal(err.Error())
+	}
 	pName := flag.String("n", "default", "instance name")
-	pImage := flag.String("i", "ami-81f7e8b1", "instance image")
-	pType := flag.String("t", "t1.micro", "instance type")
-	pKeyname := flag.String("k", "ec2-user", "keypair name")
+	flag.String("i", awsnet.BuiltinSettings.Image, "instance image")
+	flag.String("t", awsnet.BuiltinSettings.Type, "instance type")
+	flag.String("k", "", "keypair name (default: the key the machine was launched with, or ec2-user to launch)")
+	flag.String("u", "", "SSH login user, overriding the machine's User tag and image default")
 	pVerbose := flag.Bool("v", false, "verbose")
 	pQuiet := flag.Bool("q", false, "quiet")
 	flag.Parse()
@@ -35,10 +40,33 @@ func main() {
 	if len(args) > 0 {
 		verbose = *pVerbose
 		quiet = *pQuiet
+		awsnet.Quiet = !verbose
+		settings := config.Effective("") //standalone machines, outside of any environment
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "i":
+				settings.Override("image", f.Value.String(), "flag -i")
+			case "t":
+				settings.Override("type", f.Value.String(), "flag -t")
+			case "k":
+				settings.Override("key", f.Value.String(), "flag -k")
+			case "u":
+				settings.Override("user", f.Value.String(), "flag -u")
+			}
+		})
+		cloud, err = awsnet.ConfiguredCloud(settings)
+		if err != nil {
+			fatal(err.Error())
+		}
 		op := args[0]
 		switch op {
+		case "config":
+			if len(args) == 2 && args[1] == "show" {
+				settings.Show(config)
+				os.Exit(0)
+			}
 		case "up":
-			up(*pName, *pKeyname, *pImage, *pType)
+			up(*pName, settings.Key, settings.Image, settings.Type)
 		case "down":
 			down(*pName)
 		case "id":
@@ -50,9 +78,9 @@ func main() {
 		case "status":
 			status(*pName)
 		case "wait":
-			wait(*pName, *pKeyname)
+			wait(*pName, settings.Key)
 		case "ssh":
-			ssh(*pName, *pKeyname, args[1:])
+			ssh(*pName, settings.Key, args[1:])
 		case "put":
 			if len(args) > 1 {
 				src := args[1]
@@ -60,7 +88,7 @@ func main() {
 				if len(args) == 3 {
 					dst = args[2]
 				}
-				putfile(*pName, *pKeyname, src, dst)
+				putfile(*pName, settings.Key, src, dst)
 			}
 		case "get":
 			if len(args) > 1 {
@@ -69,7 +97,7 @@ func main() {
 				if len(args) == 3 {
 					dst = args[2]
 				}
-				getfile(*pName, *pKeyname, src, dst)
+				getfile(*pName, settings.Key, src, dst)
 			}
 		}
 	}
@@ -77,22 +105,22 @@ func main() {
 }
 
 func up(name string, keyname string, instanceImage string, instanceType string) {
-	inst, err := findInstance(name)
-	if inst != nil && err == nil {
+	machine, err := cloud.FindStandaloneMachine(name)
+	if machine != nil && err == nil {
 		if verbose {
-			fmt.Println("Already running: ", *inst.InstanceId)
+			fmt.Println("Already running: ", machine.Id())
 		} else {
-			fmt.Println(*inst.InstanceId)
+			fmt.Println(machine.Id())
 		}
 		os.Exit(0)
 	}
 	if verbose {
 		fmt.Println("Launching...")
 	}
-	inst, err = launchInstance(name, keyname, instanceImage, instanceType)
-	if inst != nil && err == nil {
+	machine, err = cloud.LaunchStandaloneMachine(name, keyname, instanceImage, instanceType)
+	if machine != nil && err == nil {
 		if verbose {
-			fmt.Println("Launched", *inst.InstanceId)
+			fmt.Println("Launched", machine.Id())
 		}
 		wait(name, keyname)
 	}
@@ -111,9 +139,9 @@ func down(name string) {
 }
 
 func id(name string) {
-	inst, err := findInstance(name)
-	if err == nil && inst != nil {
-		fmt.Println(*inst.InstanceId)
+	machine, err := cloud.FindStandaloneMachine(name)
+	if err == nil && machine != nil {
+		fmt.Println(machine.Id())
 		os.Exit(0)
 	}
 	if verbose {
@@ -123,18 +151,18 @@ func id(name string) {
 }
 
 func status(name string) {
-	inst, err := findInstance(name)
-	if err == nil && inst != nil {
-		fmt.Println(*inst.State.Name)
+	machine, err := cloud.FindStandaloneMachine(name)
+	if err == nil && machine != nil {
+		fmt.Println(machine.State())
 		os.Exit(0)
 	}
 	os.Exit(1)
 }
 
 func ip(name string) {
-	inst, err := findInstance(name)
-	if err == nil && inst != nil {
-		fmt.Println(*inst.PublicIpAddress)
+	machine, err := cloud.FindStandaloneMachine(name)
+	if err == nil && machine != nil {
+		fmt.Println(machine.PublicIp())
 		os.Exit(0)
 	}
 	if verbose {
@@ -144,9 +172,9 @@ func ip(name string) {
 }
 
 func host(name string) {
-	inst, err := findInstance(name)
-	if err == nil && inst != nil {
-		fmt.Println(*inst.PublicDnsName)
+	machine, err := cloud.FindStandaloneMachine(name)
+	if err == nil && machine != nil {
+		fmt.Println(machine.PublicDnsName())
 		os.Exit(0)
 	}
 	if verbose {
@@ -156,64 +184,26 @@ func host(name string) {
 }
 
 func wait(name string, keyname string) {
-	inst, err := findInstance(name)
-	if err == nil && inst != nil {
-		instanceId := *inst.InstanceId
-		if *inst.State.Name != "running" {
-			if *inst.State.Name != "pending" {
-				if verbose {
-					fmt.Println("cannot wait, instance status is: ", *inst.State.Name)
-				}
-				os.Exit(1)
-			}
-			for inst != nil && *inst.State.Name == "pending" {
-				delayInSeconds := 3.0
-				dur := time.Duration(delayInSeconds * float64(time.Second))
-				time.Sleep(dur)
-				inst, err = findInstance(name)
-				if inst == nil || err != nil {
-					fmt.Println(err)
-					os.Exit(1)
-				}
-				if verbose {
-					fmt.Print(".")
-				}
-			}
-		}
-		if *inst.State.Name != "running" {
+	machine, err := cloud.FindStandaloneMachine(name)
+	if err == nil && machine != nil {
+		err = machine.WaitForRunning()
+		if err != nil {
 			if verbose {
-				fmt.Println("wait failed, instance status is:", *inst.State.Name)
+				fmt.Println("wait failed:", err)
 			}
 			os.Exit(1)
 		}
 		if verbose {
 			fmt.Println("Running. Now wait for it to respond to us...")
 		}
-		output, err := execRemoteCommand(name, keyname)
-		for err != nil {
-			if verbose {
-				fmt.Print(".")
-			}
-			delayInSeconds := 10.0
-			dur := time.Duration(delayInSeconds * float64(time.Second))
-			time.Sleep(dur)
-			output, err = execRemoteCommand(name, keyname)
+		err = machine.WaitForSSH(keyname)
+		if err != nil {
 			if verbose {
-				if err != nil {
-					fmt.Println("***", err)
-				} else {
-					fmt.Print(output)
-				}
-			}
-		}
-		if verbose {
-			if err != nil {
 				fmt.Println("***", err)
-			} else {
-				fmt.Print(output)
 			}
+			os.Exit(1)
 		}
-		fmt.Println(instanceId)
+		fmt.Println(machine.Id())
 		os.Exit(0)
 	}
 	if verbose {
@@ -223,192 +213,72 @@ func wait(name string, keyname string) {
 }
 
 func putfile(name string, keyname string, src string, dst string) {
-	inst, err := findInstance(name)
-	if err != nil || inst == nil {
+	machine, err := cloud.FindStandaloneMachine(name)
+	if err != nil || machine == nil {
 		fmt.Println("Cannot find instance: ", name)
 		os.Exit(1)
 	}
-	host := *inst.PublicIpAddress
-	args := make([]string, 0)
-	args = append(args, "-rp")
-	args = append(args, "-o")
-	args = append(args, "StrictHostKeyChecking=no")
-
-	keyfile := os.Getenv("HOME") + "/.ssh/" + keyname + ".pem"
-	args = append(args, "-i")
-	args = append(args, keyfile)
-
-	args = append(args, src)
-	args = append(args, "ec2-user@"+host+":"+dst)
-
-	if verbose {
-		fmt.Print("[scp")
-		for _, s := range args {
-			fmt.Printf(" %s", s)
-		}
-		fmt.Println("]")
-	}
-	out, err := exec.Command("scp", args...).Output()
+	err = machine.Put(keyname, src, dst)
 	if err != nil {
-		fmt.Println("Cannot execute scp command:", err)
+		fmt.Println(err)
 		os.Exit(1)
 	}
-	if verbose {
-		fmt.Println(string(out))
-	}
 	os.Exit(0)
 }
 
 func getfile(name string, keyname string, src string, dst string) {
-	inst, err := findInstance(name)
-	if err != nil || inst == nil {
+	machine, err := cloud.FindStandaloneMachine(name)
+	if err != nil || machine == nil {
 		fmt.Println("Cannot find instance: ", name)
 		os.Exit(1)
 	}
-	host := *inst.PublicIpAddress
-	args := make([]string, 0)
-	args = append(args, "-rp")
-	args = append(args, "-o")
-	args = append(args, "StrictHostKeyChecking=no")
-
-	keyfile := os.Getenv("HOME") + "/.ssh/" + keyname + ".pem"
-	args = append(args, "-i")
-	args = append(args, keyfile)
-
-	args = append(args, "ec2-user@"+host+":"+src)
-	args = append(args, dst)
-
-	if verbose {
-		fmt.Print("[scp")
-		for _, s := range args {
-			fmt.Printf(" %s", s)
-		}
-		fmt.Println("]")
-	}
-	out, err := exec.Command("scp", args...).Output()
+	err = machine.Get(keyname, src, dst)
 	if err != nil {
-		fmt.Println("Cannot execute scp command:", err)
+		fmt.Println(err)
 		os.Exit(1)
 	}
-	if verbose {
-		fmt.Println(string(out))
-	}
 	os.Exit(0)
 }
 
-func execRemoteCommand(name string, keyname string, remoteCommand ...string) (string, error) {
-	inst, err := findInstance(name)
-	if err != nil {
-		return "", err
-	}
-	if inst == nil {
-		return "", fmt.Errorf("Instance not found: %s", name)
-	}
-	host := *inst.PublicIpAddress
-	cmd := "ssh"
-	args := make([]string, 0)
-	keyfile := os.Getenv("HOME") + "/.ssh/" + keyname + ".pem"
-	args = append(args, "-t")
-	args = append(args, "-o")
-	args = append(args, "StrictHostKeyChecking=no")
-
-	args = append(args, "-i")
-	args = append(args, keyfile)
-
-	args = append(args, "ec2-user@"+host)
-
-	if len(remoteCommand) == 0 {
-		args = append(args, "hostname")
-	} else {
-		for _, s := range remoteCommand {
-			args = append(args, s)
-		}
-	}
-	if verbose {
-		fmt.Print("[" + cmd)
-		for _, s := range args {
-			fmt.Printf(" %s", s)
+func ssh(name string, keyname string, cmd []string) {
+	machine, err := cloud.FindStandaloneMachine(name)
+	if err == nil && machine == nil {
+		err = fmt.Errorf("Instance not found: %s", name)
+	}
+	if err == nil {
+		var stdout io.Writer = os.Stdout
+		if quiet && !verbose {
+			stdout = ioutil.Discard
 		}
-		fmt.Println("]")
+		err = machine.Run(keyname, nil, stdout, os.Stderr, cmd...)
 	}
-	out, err := exec.Command(cmd, args...).Output()
-	if err != nil {
-		return "", err
-	}
-	return string(out), nil
-}
-
-func ssh(name string, keyname string, cmd []string) {
-	output, err := execRemoteCommand(name, keyname, cmd...)
 	if err != nil {
+		if e, ok := err.(*awsnet.ExitError); ok {
+			os.Exit(exitStatus(e))
+		}
 		if !quiet {
 			fmt.Println("Cannot ssh: ", err)
 		}
-		os.Exit(1)
-	}
-	if verbose || !quiet {
-		fmt.Print(output)
+		os.Exit(255)
 	}
 	os.Exit(0)
 }
 
-// ---
-
-func findInstance(name string) (*ec2.Instance, error) {
-	client := ec2.New(nil)
-	tname := "tag:Name"
-	req := &ec2.DescribeInstancesInput{Filters: []*ec2.Filter{&ec2.Filter{Name: &tname, Values: []*string{&name}}}}
-	res, err := client.DescribeInstances(req)
-	if err != nil {
-		return nil, err
-	}
-	for _, rez := range res.Reservations {
-		for _, inst := range rez.Instances {
-			state := *inst.State.Name
-			if state == "pending" || state == "running" {
-				return inst, nil
-			} //treat "stopping", "stopped", "terminating", and "terminated" as nonexistent
-		}
+// exitStatus is the remote command's status, like ssh exits with, or 255 when it didn't report one.
+func exitStatus(e *awsnet.ExitError) int {
+	if e.Status < 0 {
+		return 255
 	}
-	return nil, nil
-}
-
-func launchInstance(name string, keyname string, instanceImage string, instanceType string) (*ec2.Instance, error) {
-	//launch, tag, and wait for it to be running
-	//if already pending, just wait
-	client := ec2.New(nil)
-	runResult, err := client.RunInstances(&ec2.RunInstancesInput{
-		ImageId:      aws.String(instanceImage),
-		InstanceType: aws.String(instanceType),
-		KeyName:      aws.String(keyname),
-		MinCount:     aws.Int64(1),
-		MaxCount:     aws.Int64(1),
-	})
-	if err != nil {
-		return nil, err
-	}
-	inst := runResult.Instances[0]
-	instanceId := inst.InstanceId
-	_, err = client.CreateTags(&ec2.CreateTagsInput{
-		Resources: []*string{instanceId},
-		Tags:      []*ec2.Tag{&ec2.Tag{Key: aws.String("Name"), Value: aws.String(name)}},
-	})
-	if err != nil {
-		return nil, err
-	}
-	return inst, nil
+	return e.Status
 }
 
 func terminateInstance(name string) error {
-	inst, err := findInstance(name)
+	machine, err := cloud.FindStandaloneMachine(name)
 	if err != nil {
 		return err
 	}
-	if inst != nil {
-		instanceId := *inst.InstanceId
-		client := ec2.New(nil)
-		_, err := client.TerminateInstances(&ec2.TerminateInstancesInput{InstanceIds: []*string{aws.String(instanceId)}})
-		return err
+	if machine != nil {
+		return machine.Terminate()
 	}
 	return nil
 }
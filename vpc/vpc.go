@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"github.com/boynton/hacks/awsnet"
+	"net"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -12,35 +17,232 @@ func fatal(msg string) {
 	os.Exit(1)
 }
 
+// confirm asks the question on the terminal, and reports whether the answer was yes.
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func pretty(obj interface{}) string {
+	b, _ := json.MarshalIndent(obj, "", "   ")
+	return string(b)
+}
+
 func usage() {
-	fatal("usage: vpc [options] [setup,list,describe,create,destroy,create-zone,destroy-zone,run-machine,machines,cleanup] [other args]")
+	fatal("usage: vpc [options] [setup,list,describe,create,destroy,create-zone,destroy-zone,routes,run-machine,machines,ssh,exec,shell,put,get,tunnel,socks,keys,peering,apply,cleanup,rollback,verify,config] [other args]")
 }
 
-var quiet = false
 var env = "dev"
 
-func main() {
-	defCtrl := os.Getenv("VPC_CTRL")
-	if defCtrl == "" {
-		defCtrl = "0.0.0.0/0"
+func keysCommand(cloud *awsnet.Cloud, args []string) {
+	if len(args) == 0 {
+		fatal("usage: vpc keys [list | create NAME | import NAME PRIVATEKEYFILE | delete [-local] NAME]")
 	}
-	defEnv := os.Getenv("VPC_ENV")
-	if defEnv == "" {
-		defEnv = "dev"
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		lst, err := cloud.ListKeyPairs()
+		if err != nil {
+			fatal(err.Error())
+		}
+		for _, kp := range lst {
+			local := "(no private key here)"
+			if kp.Local {
+				local = awsnet.KeyPath(kp.Name)
+			}
+			fmt.Printf("%s - %s %s\n", kp.Name, kp.Fingerprint, local)
+		}
+	case args[0] == "create" && len(args) == 2:
+		_, err := cloud.CreateKeyPair(args[1])
+		if err != nil {
+			fatal(err.Error())
+		}
+	case args[0] == "import" && len(args) == 3:
+		_, err := cloud.ImportKeyPair(args[1], args[2])
+		if err != nil {
+			fatal(err.Error())
+		}
+	case args[0] == "delete" && len(args) == 2:
+		err := cloud.DeleteKeyPair(args[1], false)
+		if err != nil {
+			fatal(err.Error())
+		}
+	case args[0] == "delete" && len(args) == 3 && args[1] == "-local":
+		err := cloud.DeleteKeyPair(args[2], true)
+		if err != nil {
+			fatal(err.Error())
+		}
+	default:
+		fatal("usage: vpc keys [list | create NAME | import NAME PRIVATEKEYFILE | delete [-local] NAME]")
+	}
+	os.Exit(0)
+}
+
+func routesCommand(cloud *awsnet.Cloud, args []string) {
+	usage := "usage: vpc routes ZONE [set CIDR TARGET | delete CIDR]"
+	if len(args) == 0 {
+		fatal(usage)
+	}
+	zone, err := cloud.GetZone(args[0])
+	if err != nil {
+		fatal(err.Error())
+	} else if zone == nil {
+		fatal("No such zone: " + args[0])
+	}
+	switch {
+	case len(args) == 1:
+		rtId, routes, err := zone.Routes()
+		if err != nil {
+			fatal(err.Error())
+		}
+		fmt.Printf("zone %s - route table %s:\n", zone.Name, rtId)
+		for _, route := range routes {
+			fmt.Printf("  %s\n", route)
+		}
+	case args[1] == "set" && len(args) == 4:
+		err = zone.SetRoute(args[2], args[3])
+	case args[1] == "delete" && len(args) == 3:
+		err = zone.DeleteRoute(args[2])
+	default:
+		fatal(usage)
+	}
+	if err != nil {
+		fatal(err.Error())
+	}
+	os.Exit(0)
+}
+
+func peeringCommand(cloud *awsnet.Cloud, args []string) {
+	usage := "usage: vpc peering [pending | accept PCX [NET] | reject PCX]"
+	var err error
+	switch {
+	case len(args) == 1 && args[0] == "pending":
+		lst, err := cloud.PendingPeerings()
+		if err != nil {
+			fatal(err.Error())
+		}
+		if len(lst) == 0 {
+			fmt.Printf("No peering requests are waiting for the admin network of %s\n", cloud.Name)
+		}
+		for _, p := range lst {
+			fmt.Printf("%s from %s (%s) in account %s\n", p.Id, p.Peer, p.PeerBlock, p.PeerAccount)
+		}
+	case (len(args) == 2 || len(args) == 3) && args[0] == "accept":
+		netName := ""
+		if len(args) == 3 {
+			netName = args[2]
+		}
+		err = cloud.AcceptPeering(args[1], netName)
+	case len(args) == 2 && args[0] == "reject":
+		err = cloud.RejectPeering(args[1])
+	default:
+		fatal(usage)
+	}
+	if err != nil {
+		fatal(err.Error())
+	}
+	os.Exit(0)
+}
+
+// findMachine looks up a machine by instance id, or by name within the environment, i.e. "myapp.web".
+func findMachine(cloud *awsnet.Cloud, idOrName string) *awsnet.Machine {
+	if strings.HasPrefix(idOrName, "i-") {
+		machine, err := cloud.GetMachineById(idOrName)
+		if err != nil {
+			fatal(err.Error())
+		}
+		return machine
+	}
+	machine, err := cloud.FindMachine(idOrName)
+	if err != nil {
+		fatal(err.Error())
+	}
+	if machine == nil {
+		fatal("No such machine: " + idOrName)
+	}
+	return machine
+}
+
+func port(s string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 || n > 65535 {
+		fatal("Bad port: " + s)
 	}
-	pCtrl := flag.String("c", defCtrl, "controlling net block") //the net block of your "home" or controlling machines
-	//	pAdmin := flag.String("a", "10.255.255.0/24", "admin net block") //the net block of the 'admin' Network
-	pEnv := flag.String("e", defEnv, "environment")
+	return n
+}
+
+// exitWith exits with the remote command's status, like ssh does, or 255 when it didn't get to report one.
+func exitWith(err error) {
+	if e, ok := err.(*awsnet.ExitError); ok {
+		if e.Status < 0 {
+			os.Exit(255)
+		}
+		os.Exit(e.Status)
+	} else if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(255)
+	}
+	os.Exit(0)
+}
+
+func printRemovals(cloud *awsnet.Cloud) {
+	if cloud.DryRun {
+		if len(cloud.Removals) == 0 {
+			fmt.Println("Nothing would be removed")
+		}
+		for _, r := range cloud.Removals {
+			fmt.Println("would remove", r)
+		}
+	}
+}
+
+// flagSettings are the settings that flags override, by flag name.
+var flagSettings = map[string]string{"e": "env", "c": "control", "a": "admin-net", "b": "bastion-net", "i": "image", "t": "type", "k": "key", "u": "user"}
+
+func main() {
+	config, err := awsnet.LoadConfig()
+	if err != nil {
+		fatal(err.Error())
+	}
+	builtin := awsnet.BuiltinSettings
+	flag.String("c", builtin.Control, "controlling net block")                     //the net block of your "home" or controlling machines
+	flag.String("a", builtin.AdminNet, "admin net block, for setup")               //the net block of the 'admin' Network
+	flag.String("b", builtin.BastionNet, "bastion net block within it, for setup") //where the jumphost goes
+	pEnv := flag.String("e", config.EnvName(), "environment")
 	pQuiet := flag.Bool("q", false, "quiet")
-	pImage := flag.String("i", "ami-81f7e8b1", "instance image")
-	pType := flag.String("t", "t1.micro", "instance type")
-	pKeyname := flag.String("k", "ec2-user", "keypair name")
+	flag.String("i", builtin.Image, "instance image")
+	flag.String("t", builtin.Type, "instance type")
+	flag.String("k", "", "keypair name (default: the key a machine was launched with, or ec2-user to launch)")
+	flag.String("u", "", "SSH login user, overriding the machine's User tag and image default")
+	pDryRun := flag.Bool("dry-run", false, "list what destroy or cleanup would remove, or the plan apply would make, without changing anything")
+	pSweep := flag.Bool("sweep-orphans", false, "cleanup also releases unassociated EIPs that are not tagged for any environment")
+	pKeep := flag.Bool("keep-partial", false, "a failed setup, create or run-machine leaves what it created, for rollback")
 	flag.Parse()
 	args := flag.Args()
 	if len(args) > 0 {
 		env = *pEnv
-		quiet = *pQuiet
-		cloud := NamedCloud(env)
+		awsnet.Quiet = *pQuiet
+		settings := config.Effective(env)
+		flag.Visit(func(f *flag.Flag) {
+			if name, ok := flagSettings[f.Name]; ok {
+				settings.Override(name, f.Value.String(), "flag -"+f.Name)
+			}
+		})
+		if args[0] == "config" {
+			if len(args) == 2 && args[1] == "show" {
+				settings.Show(config)
+				os.Exit(0)
+			}
+			fatal("usage: vpc [options] config show")
+		}
+		cloud, err := awsnet.ConfiguredCloud(settings)
+		if err != nil {
+			fatal(err.Error())
+		}
+		cloud.DryRun = *pDryRun
+		cloud.SweepOrphans = *pSweep
+		cloud.KeepPartial = *pKeep
 		op := args[0]
 		switch op {
 		case "describe":
@@ -57,7 +259,7 @@ func main() {
 			fmt.Println(pretty(lst))
 			os.Exit(0)
 		case "setup":
-			err := cloud.Setup(*pCtrl)
+			err := cloud.Setup(settings.Control, settings.AdminNet, settings.BastionNet)
 			if err != nil {
 				fatal(err.Error())
 			}
@@ -75,9 +277,12 @@ func main() {
 			}
 			os.Exit(0)
 		case "create":
-			if len(args) == 3 {
+			if len(args) == 2 || len(args) == 3 {
 				name := args[1]
-				cidr := args[2]
+				cidr := "" //allocate the next free block
+				if len(args) == 3 {
+					cidr = args[2]
+				}
 				_, err := cloud.CreateNetwork(name, cidr)
 				if err != nil {
 					fatal(err.Error())
@@ -91,12 +296,19 @@ func main() {
 				if err != nil {
 					fatal(err.Error())
 				}
+				printRemovals(cloud)
 				os.Exit(0)
 			}
 		case "create-zone":
-			if len(args) >= 3 {
-				netName := args[1]
-				name := args[2]
+			fs := flag.NewFlagSet("create-zone", flag.ExitOnError)
+			pAz := fs.String("az", "", "the availability zone to put the zone in, i.e. us-west-2b (default: AWS picks)")
+			pSpread := fs.Int("spread", 0, "spread the zone across this many availability zones, with a subnet in each")
+			pPrivate := fs.Bool("private", false, "no way in from the internet, outbound traffic goes through the network's NAT gateway")
+			fs.Parse(args[1:])
+			rest := fs.Args()
+			if len(rest) == 2 || len(rest) == 3 {
+				netName := rest[0]
+				name := rest[1]
 				net, err := cloud.FindNetwork(netName)
 				if err != nil {
 					fatal(err.Error())
@@ -104,17 +316,30 @@ func main() {
 				if net == nil {
 					fatal("No such network: " + netName)
 				}
-				cidr := net.AddressBlock //default to the entire network
-				if len(args) == 3 {
-					cidr = args[3]
-					//to do: validate that the subnet is in the network
+				cidr := "" //allocate the next free block
+				if len(rest) == 3 {
+					cidr = rest[2]
+				}
+				var zone *awsnet.Zone
+				switch {
+				case *pSpread > 0 && *pAz != "":
+					fatal("Use either -az or -spread, not both")
+				case *pSpread > 0:
+					zone, err = net.CreateSpreadZone(name, cidr, *pSpread, *pPrivate)
+				default:
+					zone, err = net.CreateZoneIn(name, cidr, *pAz, *pPrivate)
 				}
-				_, err = net.CreateZone(name, cidr)
 				if err != nil {
 					fatal(err.Error())
 				}
+				if !awsnet.Quiet {
+					for _, sn := range zone.Subnets {
+						fmt.Printf("Created zone '%s' - %s in %s\n", zone.Name, sn.AddressBlock, sn.AvailabilityZone)
+					}
+				}
 				os.Exit(0)
 			}
+			fatal("usage: vpc create-zone [-az AZ | -spread N] [-private] NET ZONE [CIDR | /SIZE]")
 		case "run-machine":
 			if len(args) == 3 {
 				name := args[1]
@@ -125,7 +350,7 @@ func main() {
 				} else if zone == nil {
 					fatal("No such zone: " + zoneName)
 				}
-				machine, err := cloud.LaunchMachine(zone, name, *pKeyname, *pImage, *pType)
+				machine, err := cloud.LaunchMachine(zone, name, settings.Key, settings.Image, settings.Type)
 				if err != nil {
 					fatal(err.Error())
 				}
@@ -134,30 +359,175 @@ func main() {
 			}
 		case "ssh":
 			if len(args) >= 2 {
-				machine, err := cloud.GetMachineById(args[1])
+				machine := findMachine(cloud, args[1])
+				exitWith(machine.Run(settings.Key, nil, os.Stdout, os.Stderr, args[2:]...))
+			}
+		case "exec":
+			fs := flag.NewFlagSet("exec", flag.ExitOnError)
+			pNet := fs.String("net", "", "only machines in this network")
+			pZone := fs.String("zone", "", "only machines in this zone")
+			pParallel := fs.Int("p", 10, "how many machines to run on at once")
+			pJson := fs.Bool("json", false, "print a JSON summary of the results")
+			pName := fs.String("name", "", "only machines whose name matches this glob, i.e. 'myapp.web*'")
+			fs.Parse(args[1:])
+			rest := fs.Args() //the flags end at the command, or at a -- before it
+			if len(rest) == 0 {
+				fatal("usage: vpc exec [-net NET] [-zone ZONE] [-name NAMEGLOB] [-p N] [-json] [--] command [args]")
+			}
+			sel := awsnet.Selector{Network: *pNet, Zone: *pZone, Name: *pName}
+			machines, err := cloud.SelectMachines(sel)
+			if err != nil {
+				fatal(err.Error())
+			}
+			if len(machines) == 0 {
+				fatal("No machines match")
+			}
+			stdout := os.Stdout
+			if *pJson {
+				//the summary is all that goes to stdout, machine output and progress messages go to stderr
+				os.Stdout = os.Stderr
+			}
+			results := cloud.ExecAll(machines, settings.Key, *pParallel, os.Stdout, os.Stderr, rest...)
+			status := 0
+			failed := 0
+			for _, r := range results {
+				if r.Status != 0 {
+					failed++
+					st := r.Status
+					if st < 0 {
+						st = 255
+					}
+					if st > status {
+						status = st
+					}
+				}
+			}
+			if *pJson {
+				fmt.Fprintln(stdout, pretty(map[string]interface{}{
+					"command":   strings.Join(rest, " "),
+					"succeeded": len(results) - failed,
+					"failed":    failed,
+					"results":   results,
+				}))
+			}
+			os.Exit(status)
+		case "keys":
+			keysCommand(cloud, args[1:])
+		case "routes":
+			routesCommand(cloud, args[1:])
+		case "peering":
+			peeringCommand(cloud, args[1:])
+		case "put", "get":
+			if len(args) == 3 || len(args) == 4 {
+				machine := findMachine(cloud, args[1])
+				src := args[2]
+				dst := src
+				if len(args) == 4 {
+					dst = args[3]
+				}
+				var err error
+				if op == "put" {
+					err = machine.Put(settings.Key, src, dst)
+				} else {
+					err = machine.Get(settings.Key, src, dst)
+				}
 				if err != nil {
 					fatal(err.Error())
 				}
-				if strings.HasSuffix(machine.Name, ".admin.jumphost") {
-					result, err := machine.SSH(*pKeyname, args[2:]...)
-					if err != nil {
-						fatal(err.Error())
-					}
-					fmt.Print(result)
-				} else {
-					jumpHost, err := cloud.FindMachine("admin.jumphost")
-					if err != nil {
-						fatal("Cannot find jumphost to connect through: " + err.Error())
-					}
-					tmp := []string{"ssh", "-o", "StrictHostKeyChecking=no", machine.PrivateIp()}
-					for _, s := range args[2:] {
-						tmp = append(tmp, s)
-					}
-					result, err := jumpHost.SSH(*pKeyname, tmp...)
-					if err != nil {
-						fatal(err.Error())
-					}
-					fmt.Print(result)
+				os.Exit(0)
+			}
+		case "tunnel":
+			if len(args) == 3 || len(args) == 4 {
+				machine := findMachine(cloud, args[1])
+				remotePort := port(args[2])
+				localPort := remotePort
+				if len(args) == 4 {
+					localPort = port(args[3])
+				}
+				l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+				if err != nil {
+					fatal(err.Error())
+				}
+				fmt.Printf("Forwarding localhost:%d to %s (%s) port %d, ^C to stop\n", localPort, machine.Name, machine.PrivateIp(), remotePort)
+				err = machine.Tunnel(settings.Key, l, remotePort)
+				if err != nil {
+					fatal(err.Error())
+				}
+				os.Exit(0)
+			}
+		case "socks":
+			if len(args) == 1 || len(args) == 2 {
+				localPort := 1080
+				if len(args) == 2 {
+					localPort = port(args[1])
+				}
+				l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+				if err != nil {
+					fatal(err.Error())
+				}
+				conn, err := cloud.ConnectJumphost(settings.Key)
+				if err != nil {
+					fatal(err.Error())
+				}
+				fmt.Printf("SOCKS5 proxy on localhost:%d, connecting from the jumphost, ^C to stop\n", localPort)
+				err = conn.ServeSOCKS(l)
+				if err != nil {
+					fatal(err.Error())
+				}
+				os.Exit(0)
+			}
+		case "shell":
+			if len(args) == 2 {
+				machine := findMachine(cloud, args[1])
+				exitWith(machine.Shell(settings.Key, os.Stdin, os.Stdout, os.Stderr))
+			}
+		case "destroy-zone":
+			if len(args) == 2 {
+				zoneName := args[1]
+				zone, err := cloud.GetZone(zoneName)
+				if err != nil {
+					fatal(err.Error())
+				} else if zone == nil {
+					fatal("No such zone: " + zoneName)
+				}
+				err = zone.Destroy()
+				if err != nil {
+					fatal(err.Error())
+				}
+				os.Exit(0)
+			}
+		case "apply":
+			fs := flag.NewFlagSet("apply", flag.ExitOnError)
+			pYes := fs.Bool("yes", false, "apply a plan that destroys or replaces something without asking first")
+			fs.Parse(args[1:])
+			if fs.NArg() == 1 {
+				spec, err := awsnet.LoadSpec(fs.Arg(0))
+				if err != nil {
+					fatal(err.Error())
+				}
+				if spec.Defaults.Image == "" {
+					spec.Defaults.Image = settings.Image
+				}
+				if spec.Defaults.Type == "" {
+					spec.Defaults.Type = settings.Type
+				}
+				if spec.Defaults.Key == "" {
+					spec.Defaults.Key = settings.Key
+				}
+				plan, err := cloud.Plan(spec)
+				if err != nil {
+					fatal(err.Error())
+				}
+				fmt.Println(plan)
+				if cloud.DryRun || len(plan.Changes) == 0 {
+					os.Exit(0)
+				}
+				if plan.Destructive() && !*pYes && !confirm("Destroy or replace the resources above?") {
+					fatal("Nothing changed")
+				}
+				err = cloud.Apply(plan)
+				if err != nil {
+					fatal(err.Error())
 				}
 				os.Exit(0)
 			}
@@ -166,7 +536,40 @@ func main() {
 			if err != nil {
 				fatal(err.Error())
 			}
+			printRemovals(cloud)
 			os.Exit(0)
+		case "verify":
+			fs := flag.NewFlagSet("verify", flag.ExitOnError)
+			pFix := fs.Bool("fix", false, "fix what can be fixed")
+			fs.Parse(args[1:])
+			if fs.NArg() == 0 {
+				lst, err := cloud.Verify(*pFix)
+				if err != nil {
+					fatal(err.Error())
+				}
+				if len(lst) == 0 {
+					fmt.Printf("No discrepancies in %s\n", cloud.Name)
+					os.Exit(0)
+				}
+				status := 0
+				for _, d := range lst {
+					fmt.Println(d)
+					if !d.Fixed {
+						status = 1
+					}
+				}
+				os.Exit(status)
+			}
+			fatal("usage: vpc verify [-fix]")
+		case "rollback":
+			if len(args) == 1 {
+				err := cloud.Rollback()
+				if err != nil {
+					fatal(err.Error())
+				}
+				printRemovals(cloud)
+				os.Exit(0)
+			}
 		}
 	}
 	usage()